@@ -0,0 +1,135 @@
+package main
+
+/*
+    s3pop-server: An AWS S3 backed POP3 server
+	Copyright (C) 2018 James W Matheson
+	fractal.mango@gmail.com
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/FractalJim/s3pop-server/metrics"
+)
+
+//adminServer is the optional HTTP listener for operational endpoints
+type adminServer struct {
+	address string
+	server  *http.Server
+}
+
+func newAdminMux(server *popServer) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.Handle("/healthz", server.healthHandler(false))
+	mux.Handle("/readyz", server.healthHandler(true))
+	mux.HandleFunc("/quota", server.quotaHandler)
+	return mux
+}
+
+//startAdminServer listens on address and serves the admin endpoints in
+//the background
+func startAdminServer(address string, server *popServer) (*adminServer, error) {
+	listener, err := net.Listen("tcp", address)
+	if nil != err {
+		return nil, err
+	}
+	admin := &adminServer{
+		address: address,
+		server: &http.Server{
+			Handler:           newAdminMux(server),
+			ReadHeaderTimeout: 10 * time.Second,
+		},
+	}
+	go func() {
+		err := admin.server.Serve(listener)
+		if err != http.ErrServerClosed {
+			slog.Error("admin listener failed", "address", address, "error", err)
+		}
+	}()
+	slog.Info("admin listening", "address", address)
+	return admin, nil
+}
+
+func (admin *adminServer) stop() {
+	if nil == admin {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	admin.server.Shutdown(ctx)
+}
+
+//meteredConn notes whether the first response written after a reset was
+//positive or negative and how many bytes were written, so that commands
+//can be counted without threading state through every response
+type meteredConn struct {
+	net.Conn
+	status string
+	sent   int
+}
+
+func (c *meteredConn) Write(b []byte) (int, error) {
+	if c.status == "" {
+		if strings.HasPrefix(string(b), "+OK") {
+			c.status = "ok"
+		} else if strings.HasPrefix(string(b), "-ERR") {
+			c.status = "err"
+		}
+	}
+	n, err := c.Conn.Write(b)
+	c.sent += n
+	return n, err
+}
+
+func (c *meteredConn) reset() (status string, sent int) {
+	status, sent = c.status, c.sent
+	c.status, c.sent = "", 0
+	return
+}
+
+//recordCommand counts a completed command using the response written
+//since the last reset
+func recordCommand(cmd string, conn *meteredConn) {
+	status, sent := conn.reset()
+	if status == "" {
+		//no response, the connection was lost
+		status = "none"
+	}
+	label := strings.ToUpper(cmd)
+	if _, known := knownCommands[label]; !known {
+		label = "UNKNOWN"
+	}
+	metrics.Commands.WithLabelValues(label, status).Inc()
+
+	switch label {
+	case "RETR", "TOP":
+		if status == "ok" {
+			metrics.BytesSent.WithLabelValues(label).Add(float64(sent))
+		}
+	case "USER", "PASS", "APOP", "AUTH":
+		if status == "err" {
+			metrics.AuthFailures.Inc()
+		}
+	}
+}
@@ -20,13 +20,18 @@ package backend
 */
 import (
 	"bufio"
+	"bytes"
 	"errors"
 	"fmt"
-	"log"
+	"io/ioutil"
+	"log/slog"
 	"os"
 	"os/user"
 	"path"
 	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
@@ -34,6 +39,8 @@ import (
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 
 	"github.com/FractalJim/s3pop-server/mailutils"
+	"github.com/FractalJim/s3pop-server/metrics"
+	"github.com/FractalJim/s3pop-server/sieve"
 )
 
 const indexFileName = "_email_index.txt"
@@ -46,23 +53,25 @@ type mailFile struct {
 
 //index management functions
 //index keeps track of ids of all emails ever seen, it is never deleted from
-func loadIndex(emailDir string) (filesByIndex map[int]*mailFile, filesByName map[string]*mailFile) {
+func loadIndex(emailDir string) (filesByIndex map[int]*mailFile, filesByName map[string]*mailFile, err error) {
 	filesByIndex = make(map[int]*mailFile)
 	filesByName = make(map[string]*mailFile)
 	var indexFile = filepath.Join(emailDir, indexFileName)
-	_, err := os.Stat(indexFile)
-	if nil != err {
-		//index does not exist yet or cant be opened
-		return
-	}
-
 	var indexData *os.File
 	indexData, err = os.Open(indexFile)
-	checkError(err)
+	if os.IsNotExist(err) {
+		//index does not exist yet, nothing has been downloaded
+		return filesByIndex, filesByName, nil
+	}
+	if nil != err {
+		return nil, nil, mailutils.NewCacheError(mailutils.ErrCacheUnavailable, indexFile, err)
+	}
 	defer indexData.Close()
 
 	var indexScanner = bufio.NewScanner(indexData)
-	var currentIndex int = 0
+	//ids start at 1 to match getNextID on an empty index, they are used
+	//as IMAP UIDs which must not be zero
+	var currentIndex int = 1
 	for indexScanner.Scan() {
 		var thisFile = &mailFile{
 			filename: indexScanner.Text(),
@@ -73,11 +82,78 @@ func loadIndex(emailDir string) (filesByIndex map[int]*mailFile, filesByName map
 		currentIndex++
 	}
 
-	checkError(indexScanner.Err())
-	return
+	if err = indexScanner.Err(); nil != err {
+		return nil, nil, mailutils.NewCacheError(mailutils.ErrCorruptIndex, indexFile, err)
+	}
+	return filesByIndex, filesByName, nil
+}
+
+//indexVersionFileName marks a cache whose metadata ids match the lines of
+//its index. Before ids started at 1, email downloaded after the index was
+//reloaded got the id of an earlier email.
+const indexVersionFileName = "_index_version.txt"
+const indexVersion = "2"
+
+//upgradeIndex renumbers the metadata of a cache written before
+//indexVersion so each email has its line in the index as its id. IMAP
+//clients may have seen the old ids as UIDs, so if any changed every
+//folder gets a new UIDVALIDITY. Email filed away from the folder in its
+//index entry only exists in newer caches and already has the right id.
+func upgradeIndex(emailDir string) error {
+	versionFile := filepath.Join(emailDir, indexVersionFileName)
+	version, err := ioutil.ReadFile(versionFile)
+	if nil == err && strings.TrimSpace(string(version)) == indexVersion {
+		return nil
+	}
+	if nil != err && !os.IsNotExist(err) {
+		return mailutils.NewCacheError(mailutils.ErrCacheUnavailable, versionFile, err)
+	}
+	filesByIndex, _, err := loadIndex(emailDir)
+	if nil != err {
+		return err
+	}
+	renumbered := 0
+	for id, file := range filesByIndex {
+		dir, name := filepath.Split(filepath.Join(emailDir, filepath.FromSlash(file.filename)))
+		metadata, err := mailutils.LoadMailData(dir, name)
+		if errors.Is(err, os.ErrNotExist) {
+			//deleted or filed in another folder
+			continue
+		}
+		if nil != err {
+			return err
+		}
+		if metadata.ID == id {
+			continue
+		}
+		metadata.ID = id
+		err = metadata.Save(dir)
+		if nil != err {
+			return err
+		}
+		renumbered++
+	}
+	if renumbered > 0 {
+		folders, err := mailutils.ListFolders(emailDir)
+		if nil != err {
+			return err
+		}
+		for _, folder := range append([]string{""}, folders...) {
+			err = mailutils.ResetUIDValidity(filepath.Join(emailDir, filepath.FromSlash(folder)))
+			if nil != err {
+				return err
+			}
+		}
+		slog.Warn("renumbered cached email with duplicate ids, IMAP clients will download it again", "dir", emailDir, "emails", renumbered)
+	}
+	err = ioutil.WriteFile(versionFile, []byte(indexVersion+"\n"), 0600)
+	if nil != err {
+		return mailutils.NewCacheError(mailutils.ErrCacheUnavailable, versionFile, err)
+	}
+	return nil
 }
 
-func appendIndex(name, emailDir string, filesByIndex map[int]*mailFile, filesByName map[string]*mailFile) {
+func appendIndex(name, emailDir string, filesByIndex map[int]*mailFile, filesByName map[string]*mailFile) error {
 	var indexFile = filepath.Join(emailDir, indexFileName)
 	var indexData *os.File
 	_, err := os.Stat(indexFile)
@@ -88,10 +164,20 @@ func appendIndex(name, emailDir string, filesByIndex map[int]*mailFile, filesByN
 		indexData, err = os.OpenFile(indexFile, os.O_APPEND|os.O_WRONLY, 0600)
 	}
 
-	checkError(err)
+	if nil != err {
+		return mailutils.NewCacheError(mailutils.ErrCacheUnavailable, indexFile, err)
+	}
 	defer indexData.Close()
 
-	indexData.WriteString(name + "\n")
+	_, err = indexData.WriteString(name + "\n")
+	if nil == err {
+		//make sure the entry is on disk before the email is offered to a
+		//client, a shutdown part way through a sync must not lose it
+		err = indexData.Sync()
+	}
+	if nil != err {
+		return mailutils.NewCacheError(mailutils.ErrCacheUnavailable, indexFile, err)
+	}
 	var newID = getNextID(filesByIndex)
 
 	var thisFile = &mailFile{
@@ -100,6 +186,7 @@ func appendIndex(name, emailDir string, filesByIndex map[int]*mailFile, filesByN
 	}
 	filesByIndex[newID] = thisFile
 	filesByName[name] = thisFile
+	return nil
 }
 
 func getNextID(filesByIndex map[int]*mailFile) int {
@@ -112,7 +199,110 @@ func getNextID(filesByIndex map[int]*mailFile) int {
 	return res + 1
 }
 
-func DownloadEmails(emailBucket, emailFolder string) error {
+//NextID returns the id the next message downloaded to emailDir will get
+func NextID(emailDir string) (int, error) {
+	filesByIndex, _, err := loadIndex(emailDir)
+	if nil != err {
+		return 0, err
+	}
+	return getNextID(filesByIndex), nil
+}
+
+//syncLocks stops two sessions downloading the same mailbox at once, which
+//would give a message two ids
+var syncLocks = struct {
+	sync.Mutex
+	byMailbox map[string]*sync.Mutex
+}{byMailbox: make(map[string]*sync.Mutex)}
+
+//syncLockFileName is locked while a mailbox's cache is changed, keeping
+//out other processes such as the import and expire commands run while the
+//server is up
+const syncLockFileName = "_sync.lock"
+
+//syncLock is held while a mailbox's index and cache are changed
+type syncLock struct {
+	mu   *sync.Mutex
+	file *os.File
+}
+
+//lockSync waits for the sync lock of the mailbox cached in emailDir, both
+//within this process and against others
+func lockSync(emailFolder string, emailDir string) (*syncLock, error) {
+	syncLocks.Lock()
+	mu, ok := syncLocks.byMailbox[emailFolder]
+	if !ok {
+		mu = new(sync.Mutex)
+		syncLocks.byMailbox[emailFolder] = mu
+	}
+	syncLocks.Unlock()
+	mu.Lock()
+
+	filename := filepath.Join(emailDir, syncLockFileName)
+	file, err := os.OpenFile(filename, os.O_CREATE|os.O_RDWR, 0600)
+	if nil == err {
+		err = lockFile(file)
+		if nil != err {
+			file.Close()
+		}
+	}
+	if nil != err {
+		mu.Unlock()
+		return nil, mailutils.NewCacheError(mailutils.ErrCacheUnavailable, filename, err)
+	}
+	return &syncLock{mu: mu, file: file}, nil
+}
+
+//Unlock releases the lock, closing the file drops the lock on it
+func (l *syncLock) Unlock() {
+	l.file.Close()
+	l.mu.Unlock()
+}
+
+//ingest is the state of one DownloadEmails call
+type ingest struct {
+	mailbox      string
+	emailDir     string
+	options      *IngestOptions
+	sess         *session.Session
+	filesByIndex map[int]*mailFile
+	filesByName  map[string]*mailFile
+	//filter is loaded with the first new email, nil if there is none or
+	//it could not be loaded
+	filter       *sieve.Script
+	filterLoaded bool
+	//redirected holds the redirects already sent, loaded with the first
+	//redirect
+	redirected map[string]bool
+}
+
+//delivery is a folder a new email is filed in and the flags it gets there
+type delivery struct {
+	folder string
+	flags  []string
+}
+
+//DownloadEmails caches the email in a mailbox that has not been seen before,
+//after applying the ingest options to it
+func DownloadEmails(emailBucket, emailFolder string, options *IngestOptions) (err error) {
+	defer func() {
+		recordSync(emailFolder, err)
+		if nil != err {
+			metrics.SyncErrors.WithLabelValues(metrics.MailboxLabel(emailFolder)).Inc()
+		} else if metrics.KnownMailbox(emailFolder) {
+			metrics.LastSyncSuccess.WithLabelValues(emailFolder).SetToCurrentTime()
+		}
+	}()
+
+	userEmailDir, err := mailutils.GetEmailDir(emailFolder)
+	if nil != err {
+		return err
+	}
+	lock, err := lockSync(emailFolder, userEmailDir)
+	if nil != err {
+		return err
+	}
+	defer lock.Unlock()
 
 	sess, err := getSession()
 	if nil != err {
@@ -120,76 +310,399 @@ func DownloadEmails(emailBucket, emailFolder string) error {
 	}
 	svc := s3.New(sess)
 
+	//the trailing / keeps mailbox bob from picking up bobby's email
+	prefix := emailFolder + "/"
 	params := &s3.ListObjectsInput{
 		Bucket: aws.String(emailBucket),
-		Prefix: aws.String(emailFolder),
+		Prefix: aws.String(prefix),
 	}
 
-	resp, err := svc.ListObjects(params)
+	keys := make([]string, 0)
+	sizes := make(map[string]int)
+	start := time.Now()
+	err = svc.ListObjectsPages(params, func(page *s3.ListObjectsOutput, lastPage bool) bool {
+		for _, object := range page.Contents {
+			keys = append(keys, *object.Key)
+			sizes[*object.Key] = int(aws.Int64Value(object.Size))
+		}
+		return true
+	})
+	metrics.ObserveS3("list", start, err)
+	if nil != err {
+		return err
+	}
+	err = upgradeIndex(userEmailDir)
+	if nil != err {
+		return err
+	}
+	filesByIndex, filesByName, err := loadIndex(userEmailDir)
 	if nil != err {
 		return err
 	}
-	userEmailDir := mailutils.GetEmailDir(emailFolder)
-	filesByIndex, filesByName := loadIndex(userEmailDir)
+	err = pruneRedirects(userEmailDir, filesByName)
+	if nil != err {
+		//the records are still right, there are just more of them
+		slog.Warn("could not prune redirected email", "mailbox", emailFolder, "error", err)
+	}
+	in := &ingest{
+		mailbox:      emailFolder,
+		emailDir:     userEmailDir,
+		options:      options,
+		sess:         sess,
+		filesByIndex: filesByIndex,
+		filesByName:  filesByName,
+	}
+	//over the quota new email is left in S3 until some is deleted
+	used, skipped := 0, 0
+	if nil != options.Quota {
+		usage, err := checkQuota(emailFolder, userEmailDir, options.Quota)
+		if nil != err {
+			return err
+		}
+		used = usage.Used
+	}
 
-	for _, key := range resp.Contents {
-		emailId := path.Base(*key.Key)
-		_, known := filesByName[emailId]
+	for _, key := range keys {
+		//email under a sub-prefix such as bob/archive/ goes in a folder of
+		//the same name, the index records it with the folder in front
+		folder, emailId := path.Split(strings.TrimPrefix(key, prefix))
+		folder = strings.TrimSuffix(folder, "/")
+		if emailId == "" {
+			//placeholder object created for an empty folder
+			continue
+		}
+		if !mailutils.ValidName(emailId) || !mailutils.ValidFolder(folder) {
+			slog.Warn("skipping email with unusable key", "key", key)
+			continue
+		}
+		indexName := path.Join(folder, emailId)
+		_, known := filesByName[indexName]
 		if !known {
-			nextPopId := getNextID(filesByIndex)
-			emailFile := filepath.Join(userEmailDir, emailId)
-			err = downloadFile(*key.Key, emailBucket, emailFile, sess)
+			if nil != options.Quota && used+sizes[key] > options.Quota.Limit {
+				skipped++
+				continue
+			}
+			used += sizes[key]
+			folderDir, err := mailutils.GetFolderDir(userEmailDir, folder)
+			if nil != err {
+				return err
+			}
+			emailFile := filepath.Join(folderDir, emailId)
+			err = downloadFile(key, emailBucket, emailFile, sess)
+			if nil != err {
+				return err
+			}
+			err = in.processEmail(folder, emailId)
 			if nil != err {
 				return err
 			}
-			processEmail(userEmailDir, emailId, nextPopId)
-			appendIndex(emailId, userEmailDir, filesByIndex, filesByName)
+		}
+	}
+	if nil == options.Quota {
+		return nil
+	}
+	if skipped > 0 {
+		slog.Warn("mailbox over quota, email left in S3", "mailbox", emailFolder, "emails", skipped)
+	}
+	usage, err := checkQuota(emailFolder, userEmailDir, options.Quota)
+	if nil != err {
+		return err
+	}
+	usage.Waiting = skipped
+	recordQuota(emailFolder, &usage)
+	return in.warnQuota(usage)
+}
+
+//StoreEmail writes a message into a folder of a mailbox in S3, where the
+//next sync picks it up like any other email
+func StoreEmail(emailBucket, emailFolder, folder, name string, message []byte) error {
+	sess, err := getSession()
+	if nil != err {
+		return err
+	}
+	svc := s3.New(sess)
+	start := time.Now()
+	_, err = svc.PutObject(&s3.PutObjectInput{
+		Bucket: aws.String(emailBucket),
+		Key:    aws.String(path.Join(emailFolder, folder, name)),
+		Body:   bytes.NewReader(message),
+	})
+	metrics.ObserveS3("put", start, err)
+	return err
+}
+
+//CheckBucket confirms AWS credentials can be resolved and the bucket
+//can be reached with them
+func CheckBucket(emailBucket string) error {
+	sess, err := getSession()
+	if nil != err {
+		return err
+	}
+	svc := s3.New(sess)
+	start := time.Now()
+	_, err = svc.HeadBucket(&s3.HeadBucketInput{
+		Bucket: aws.String(emailBucket),
+	})
+	metrics.ObserveS3("head", start, err)
+	return err
+}
+
+//processEmail files a newly downloaded email and records it in the index.
+//Email that failed the SES checks is dealt with by the verdict policy,
+//anything else is passed through the mailbox's Sieve script.
+func (in *ingest) processEmail(folder string, filename string) error {
+	indexName := path.Join(folder, filename)
+	folderDir, err := mailutils.GetFolderDir(in.emailDir, folder)
+	if nil != err {
+		return err
+	}
+	emailFile := filepath.Join(folderDir, filename)
+	headers, body, err := splitEmail(emailFile)
+	if nil != err {
+		return err
+	}
+	verdicts := mailutils.ParseVerdicts(headers)
+
+	deliveries := []delivery{{folder: folder}}
+	switch action := in.options.Policy.action(verdicts); action {
+	case VERDICT_HIDE:
+		slog.Info("email hidden", "email", indexName, "failed", verdicts.Failed())
+		deliveries = nil
+	case VERDICT_QUARANTINE:
+		slog.Info("email quarantined", "email", indexName, "failed", verdicts.Failed())
+		deliveries = []delivery{{folder: in.options.Policy.QuarantineFolder}}
+	default:
+		if action == VERDICT_TAG {
+			headers = tagSubject(headers, in.options.Policy.SubjectTag)
+			err = writeEmail(emailFile, headers, body)
+			if nil != err {
+				return err
+			}
+		}
+		if filter := in.loadFilter(); nil != filter {
+			size := calcPartSizeBytes(headers) + calcPartSizeBytes(body)
+			deliveries = in.runFilter(filter, indexName, headers, body, size)
+		}
+	}
+
+	if len(deliveries) == 0 {
+		//the index entry stops it being downloaded again
+		err = os.Remove(emailFile)
+		if nil != err {
+			return mailutils.NewCacheError(mailutils.ErrCacheUnavailable, emailFile, err)
+		}
+		return appendIndex(indexName, in.emailDir, in.filesByIndex, in.filesByName)
+	}
+
+	//the first delivery takes the downloaded file and the email's own
+	//index entry, each further one is a copy with an entry of its own
+	var firstFile string
+	for i, target := range deliveries {
+		targetDir, err := mailutils.GetFolderDir(in.emailDir, target.folder)
+		if nil != err {
+			return err
+		}
+		targetFile := filepath.Join(targetDir, filename)
+		targetIndexName := indexName
+		if i == 0 {
+			if targetFile != emailFile {
+				err = os.Rename(emailFile, targetFile)
+			}
+			firstFile = targetFile
+		} else {
+			targetIndexName = path.Join(target.folder, filename)
+			if _, known := in.filesByName[targetIndexName]; known {
+				slog.Warn("email already in folder", "email", indexName, "folder", target.folder)
+				continue
+			}
+			err = copyFile(firstFile, targetFile)
+		}
+		if nil != err {
+			return mailutils.NewCacheError(mailutils.ErrCacheUnavailable, targetFile, err)
+		}
+
+		headerSize := calcPartSizeBytes(headers)
+		bodySize := calcPartSizeBytes(body)
+		metadata := &mailutils.MailData{
+			Name:        filename,
+			Folder:      target.folder,
+			Key:         indexName,
+			ID:          getNextID(in.filesByIndex),
+			Read:        false,
+			HeaderSize:  headerSize,
+			MessageSize: bodySize,
+			TotalSize:   headerSize + bodySize,
+			Verdicts:    verdicts,
+		}
+		for _, flag := range target.flags {
+			if strings.EqualFold(flag, `\Seen`) {
+				metadata.MarkRead(true)
+			} else {
+				metadata.Flags = append(metadata.Flags, flag)
+			}
+		}
+		err = metadata.Save(targetDir)
+		if nil != err {
+			return err
+		}
+		err = appendIndex(targetIndexName, in.emailDir, in.filesByIndex, in.filesByName)
+		if nil != err {
+			return err
 		}
 	}
 	return nil
 }
 
-func processEmail(emailDir string, filename string, id int) {
-	emailFile := filepath.Join(emailDir, filename)
-	headers, body := splitEmail(emailFile)
-	headerSize := calcPartSizeBytes(headers)
-	bodySize := calcPartSizeBytes(body)
-	metadata := &mailutils.MailData{
-		Name:        filename,
-		ID:          id,
-		Read:        false,
-		HeaderSize:  headerSize,
-		MessageSize: bodySize,
-		TotalSize:   headerSize + bodySize,
-	}
-	metadata.Save(emailDir)
+//loadFilter returns the mailbox's Sieve script, loading it the first time.
+//A script that can't be loaded is logged and email is filed as if there
+//were none, as RFC 5228 section 2.10.6 asks.
+func (in *ingest) loadFilter() *sieve.Script {
+	if in.filterLoaded || in.options.Filter == "" {
+		return in.filter
+	}
+	in.filterLoaded = true
+	filter, err := loadFilter(in.options.Filter, in.sess)
+	if nil != err {
+		slog.Error("could not load filter", "filter", in.options.Filter, "error", err)
+		return nil
+	}
+	in.filter = filter
+	return filter
+}
+
+//runFilter runs the Sieve script over an email, sending any redirects and
+//returning the folders to file it in
+func (in *ingest) runFilter(filter *sieve.Script, indexName string, headers []string, body []string, size int) []delivery {
+	deliveries := make([]delivery, 0)
+	redirectFailed := false
+	folder := path.Dir(indexName)
+	if folder == "." {
+		folder = ""
+	}
+	for _, action := range filter.Evaluate(sieveMessage(headers, size)) {
+		switch action.Type {
+		case sieve.ACTION_KEEP:
+			deliveries = append(deliveries, delivery{folder: folder, flags: action.Flags})
+		case sieve.ACTION_FILEINTO:
+			target := action.Target
+			if !mailutils.ValidFolder(target) {
+				slog.Warn("filter used an unusable folder name", "email", indexName, "folder", target)
+				target = folder
+			}
+			deliveries = append(deliveries, delivery{folder: target, flags: action.Flags})
+		case sieve.ACTION_REDIRECT:
+			if hasLoopHeader(headers, in.options.RedirectFrom) {
+				//RFC 5228 section 4.2, it came back after being redirected
+				slog.Warn("email already redirected by this mailbox, not redirecting again", "email", indexName, "to", action.Target)
+				redirectFailed = true
+				continue
+			}
+			if in.wasRedirected(indexName, action.Target) {
+				//sent by an earlier sync that failed before indexing it
+				continue
+			}
+			err := redirectEmail(in.options.RedirectFrom, action.Target, headers, body)
+			if nil != err {
+				slog.Error("could not redirect email", "email", indexName, "to", action.Target, "error", err)
+				redirectFailed = true
+				continue
+			}
+			slog.Info("email redirected", "email", indexName, "to", action.Target)
+			err = in.recordRedirect(indexName, action.Target)
+			if nil != err {
+				slog.Warn("could not record redirect, it is sent again if the email is not indexed", "email", indexName, "error", err)
+			}
+		}
+	}
+	//RFC 5228 section 2.10.6, a failed action falls back to keeping the
+	//email rather than losing it
+	if redirectFailed && len(deliveries) == 0 {
+		deliveries = append(deliveries, delivery{folder: folder})
+	}
+	//two deliveries to one folder would need two files of the same name,
+	//and a delivery to the email's own folder goes first so it keeps the
+	//email's index entry
+	unique := make([]delivery, 0, len(deliveries))
+	seen := make(map[string]bool)
+	for _, target := range deliveries {
+		if seen[target.folder] {
+			continue
+		}
+		seen[target.folder] = true
+		if target.folder == folder {
+			unique = append([]delivery{target}, unique...)
+		} else {
+			unique = append(unique, target)
+		}
+	}
+	return unique
+}
+
+//copyFile copies a cached email to another folder
+func copyFile(from string, to string) error {
+	data, err := ioutil.ReadFile(from)
+	if nil != err {
+		return err
+	}
+	return ioutil.WriteFile(to, data, 0600)
 }
 
-func splitEmail(fullFilePath string) (headers []string, body []string) {
+//writeEmail replaces a cached email with the given lines, which start with
+//the blank line between the headers and body as splitEmail returns them
+func writeEmail(fullFilePath string, headers []string, body []string) error {
+	tempFilePath := fullFilePath + ".tmp"
+	fileData, err := os.Create(tempFilePath)
+	if nil != err {
+		return mailutils.NewCacheError(mailutils.ErrCacheUnavailable, tempFilePath, err)
+	}
+	defer fileData.Close()
+
+	writer := bufio.NewWriter(fileData)
+	for _, line := range append(headers, body...) {
+		writer.WriteString(line + "\r\n")
+	}
+	err = writer.Flush()
+	if nil == err {
+		err = fileData.Close()
+	}
+	if nil == err {
+		err = os.Rename(tempFilePath, fullFilePath)
+	}
+	if nil != err {
+		os.Remove(tempFilePath)
+		return mailutils.NewCacheError(mailutils.ErrCacheUnavailable, fullFilePath, err)
+	}
+	return nil
+}
+
+func splitEmail(fullFilePath string) (headers []string, body []string, err error) {
 	fileData, err := os.Open(fullFilePath)
-	checkError(err)
+	if nil != err {
+		return nil, nil, mailutils.NewCacheError(mailutils.ErrCacheUnavailable, fullFilePath, err)
+	}
 	defer fileData.Close()
 
 	headers = make([]string, 0)
 	body = make([]string, 0)
 	var inHeaders = true
 
-	fileScanner := bufio.NewScanner(fileData)
-
-	for fileScanner.Scan() {
-		if fileScanner.Text() == "" {
+	err = mailutils.ReadLines(fileData, func(line string) bool {
+		if line == "" {
 			if inHeaders {
 				inHeaders = false
 			}
 		}
 		if inHeaders {
-			headers = append(headers, fileScanner.Text())
+			headers = append(headers, line)
 		} else {
-			body = append(body, fileScanner.Text())
+			body = append(body, line)
 		}
+		return true
+	})
+	if nil != err {
+		return nil, nil, mailutils.NewCacheError(mailutils.ErrCacheUnavailable, fullFilePath, err)
 	}
-
-	return
+	return headers, body, nil
 }
 
 func calcPartSizeBytes(part []string) int {
@@ -202,7 +715,7 @@ func calcPartSizeBytes(part []string) int {
 
 func downloadFile(key, bucket string, outputPath string, sess *session.Session) error {
 
-	fmt.Printf("Beginning download of %s.\n", key)
+	slog.Debug("download started", "key", key)
 	file, err := os.Create(outputPath)
 	if nil != err {
 		return err
@@ -211,16 +724,17 @@ func downloadFile(key, bucket string, outputPath string, sess *session.Session)
 
 	downloader := s3manager.NewDownloader(sess)
 
+	start := time.Now()
 	_, err = downloader.Download(file, &s3.GetObjectInput{
 		Bucket: aws.String(bucket),
 		Key:    aws.String(key),
 	})
+	metrics.ObserveS3("get", start, err)
 	if nil != err {
 		return err
 	}
 	file.Close()
-	fmt.Printf("Download of %s complete.\n", key)
-	fmt.Printf("Downloaded file written to %s.\n", outputPath)
+	slog.Info("downloaded", "key", key, "path", outputPath)
 
 	return err
 }
@@ -228,7 +742,7 @@ func downloadFile(key, bucket string, outputPath string, sess *session.Session)
 func getSession() (sess *session.Session, err error) {
 	defer func() {
 		if r := recover(); r != nil {
-			fmt.Println("Panic creating Session:", r)
+			slog.Error("panic creating session", "panic", r)
 			err = errors.New(r.(string))
 		}
 	}()
@@ -240,12 +754,7 @@ func getSession() (sess *session.Session, err error) {
 
 	_, err = os.Stat(filepath.Join(userInfo.HomeDir, ".aws", "config"))
 	if nil != err {
-		return nil, err
-	}
-
-	_, err = os.Stat(filepath.Join(userInfo.HomeDir, ".aws", "config"))
-	if nil != err {
-		return nil, err
+		return nil, fmt.Errorf("%w: %v", ErrNoCredentials, err)
 	}
 
 	sess, err = session.NewSessionWithOptions(session.Options{
@@ -253,9 +762,3 @@ func getSession() (sess *session.Session, err error) {
 	})
 	return
 }
-
-func checkError(err error) {
-	if err != nil {
-		log.Fatal(err)
-	}
-}
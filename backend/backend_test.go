@@ -0,0 +1,165 @@
+package backend
+
+/*
+    s3pop-server: An AWS S3 backed POP3 server
+	Copyright (C) 2018 James W Matheson
+	fractal.mango@gmail.com
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/FractalJim/s3pop-server/mailutils"
+)
+
+func TestSplitEmailLongLines(t *testing.T) {
+	long := strings.Repeat("A", 70000)
+	tests := []struct {
+		name    string
+		content string
+		headers []string
+		body    []string
+	}{
+		{"crlf", "Subject: hi\r\nFrom: a@b\r\n\r\nbody\r\n", []string{"Subject: hi", "From: a@b"}, []string{"", "body"}},
+		{"lf", "Subject: hi\n\nbody\n", []string{"Subject: hi"}, []string{"", "body"}},
+		{"no final newline", "Subject: hi\r\n\r\nbody", []string{"Subject: hi"}, []string{"", "body"}},
+		{"long body line", "Subject: hi\r\n\r\n" + long + "\r\nend\r\n", []string{"Subject: hi"}, []string{"", long, "end"}},
+		{"long header line", "X-Long: " + long + "\r\n\r\nbody\r\n", []string{"X-Long: " + long}, []string{"", "body"}},
+	}
+	dir := t.TempDir()
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			filename := filepath.Join(dir, test.name)
+			err := os.WriteFile(filename, []byte(test.content), 0600)
+			if nil != err {
+				t.Fatal(err)
+			}
+			headers, body, err := splitEmail(filename)
+			if nil != err {
+				t.Fatalf("splitEmail: %s", err)
+			}
+			if strings.Join(headers, "\n") != strings.Join(test.headers, "\n") {
+				t.Errorf("headers: got %d lines, want %d", len(headers), len(test.headers))
+			}
+			if strings.Join(body, "\n") != strings.Join(test.body, "\n") {
+				t.Errorf("body: got %d lines, want %d", len(body), len(test.body))
+			}
+		})
+	}
+}
+
+func TestLoadIndexIDs(t *testing.T) {
+	dir := t.TempDir()
+	err := os.WriteFile(filepath.Join(dir, indexFileName), []byte("a\nb\nWork/c\n"), 0600)
+	if nil != err {
+		t.Fatal(err)
+	}
+	filesByIndex, filesByName, err := loadIndex(dir)
+	if nil != err {
+		t.Fatal(err)
+	}
+	for id, name := range map[int]string{1: "a", 2: "b", 3: "Work/c"} {
+		if file := filesByIndex[id]; nil == file || file.filename != name {
+			t.Errorf("id %d: got %v, want %s", id, file, name)
+		}
+		if file := filesByName[name]; nil == file || file.index != id {
+			t.Errorf("%s: got %v, want id %d", name, file, id)
+		}
+	}
+	if next := getNextID(filesByIndex); next != 4 {
+		t.Errorf("getNextID = %d, want 4", next)
+	}
+	err = appendIndex("d", dir, filesByIndex, filesByName)
+	if nil != err {
+		t.Fatal(err)
+	}
+	reloaded, _, err := loadIndex(dir)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if file := reloaded[4]; nil == file || file.filename != "d" || filesByName["d"].index != 4 {
+		t.Errorf("appended email does not keep its id after a reload")
+	}
+
+	empty, _, err := loadIndex(t.TempDir())
+	if nil != err || getNextID(empty) != 1 {
+		t.Errorf("first id of an empty index = %d, %v, want 1", getNextID(empty), err)
+	}
+}
+
+func TestUpgradeIndex(t *testing.T) {
+	dir := t.TempDir()
+	err := os.WriteFile(filepath.Join(dir, indexFileName), []byte("a\nb\nWork/c\ngone\n"), 0600)
+	if nil != err {
+		t.Fatal(err)
+	}
+	workDir, err := mailutils.GetFolderDir(dir, "Work")
+	if nil != err {
+		t.Fatal(err)
+	}
+	//ids as the old loadIndex gave them, b repeats a's id
+	for _, old := range []struct {
+		dir  string
+		name string
+		id   int
+	}{{dir, "a", 1}, {dir, "b", 1}, {workDir, "c", 2}} {
+		err = (&mailutils.MailData{ID: old.id, Name: old.name}).Save(old.dir)
+		if nil != err {
+			t.Fatal(err)
+		}
+	}
+	validity, err := mailutils.UIDValidity(workDir)
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	err = upgradeIndex(dir)
+	if nil != err {
+		t.Fatal(err)
+	}
+	for _, want := range []struct {
+		dir  string
+		name string
+		id   int
+	}{{dir, "a", 1}, {dir, "b", 2}, {workDir, "c", 3}} {
+		metadata, err := mailutils.LoadMailData(want.dir, want.name)
+		if nil != err {
+			t.Fatal(err)
+		}
+		if metadata.ID != want.id {
+			t.Errorf("%s: id %d, want %d", want.name, metadata.ID, want.id)
+		}
+	}
+	if changed, err := mailutils.UIDValidity(workDir); nil != err || changed == validity {
+		t.Errorf("UIDVALIDITY not changed after renumbering: %d, %v", changed, err)
+	}
+
+	//once upgraded the metadata is left alone
+	err = (&mailutils.MailData{ID: 9, Name: "a"}).Save(dir)
+	if nil != err {
+		t.Fatal(err)
+	}
+	err = upgradeIndex(dir)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if metadata, err := mailutils.LoadMailData(dir, "a"); nil != err || metadata.ID != 9 {
+		t.Errorf("upgradeIndex ran twice")
+	}
+}
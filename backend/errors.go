@@ -0,0 +1,64 @@
+package backend
+
+/*
+    s3pop-server: An AWS S3 backed POP3 server
+	Copyright (C) 2018 James W Matheson
+	fractal.mango@gmail.com
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+//ErrNoCredentials means there is no AWS configuration for the user the
+//server runs as
+var ErrNoCredentials = errors.New("no AWS configuration found")
+
+//IsPermanent reports whether a backend error will happen again if the
+//request is retried without someone fixing the configuration, such as
+//missing credentials or a bucket that does not exist. Anything else, S3
+//being unreachable for example, is treated as temporary.
+func IsPermanent(err error) bool {
+	if errors.Is(err, ErrNoCredentials) {
+		return true
+	}
+	var awsErr awserr.Error
+	if errors.As(err, &awsErr) {
+		switch awsErr.Code() {
+		case "Throttling", "ThrottlingException", "SlowDown", "RequestTimeout":
+			//sent with a 400 status but worth retrying
+			return false
+		}
+	}
+	var requestErr awserr.RequestFailure
+	if errors.As(err, &requestErr) {
+		switch requestErr.StatusCode() {
+		case http.StatusBadRequest, http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound:
+			return true
+		}
+		return false
+	}
+	if errors.As(err, &awsErr) {
+		switch awsErr.Code() {
+		case "NoCredentialProviders", "AccessDenied", "InvalidAccessKeyId", "NoSuchBucket":
+			return true
+		}
+	}
+	return false
+}
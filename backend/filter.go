@@ -0,0 +1,260 @@
+package backend
+
+/*
+    s3pop-server: An AWS S3 backed POP3 server
+	Copyright (C) 2018 James W Matheson
+	fractal.mango@gmail.com
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+//Running a mailbox's Sieve script over new email
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+
+	"github.com/FractalJim/s3pop-server/mailutils"
+	"github.com/FractalJim/s3pop-server/metrics"
+	"github.com/FractalJim/s3pop-server/sieve"
+)
+
+const s3Scheme = "s3://"
+
+//loopHeader is added to redirected email with the address it was sent
+//from, email that already has it for the mailbox is not redirected again
+const loopHeader = "X-Loop"
+
+//redirectedFileName lists the redirects sent for each email, so that a
+//sync that fails after redirecting does not send them again next time.
+//Entries are dropped once the email is indexed.
+const redirectedFileName = "_redirected.txt"
+
+//IngestOptions decide what DownloadEmails does with new email before it
+//is indexed
+type IngestOptions struct {
+	//Policy is applied to email that failed the SES checks
+	Policy *VerdictPolicy
+	//Filter is the location of the mailbox's Sieve script, a local path or
+	//s3://bucket/key, no script is run when it is empty
+	Filter string
+	//RedirectFrom is the verified address redirected email is sent from,
+	//redirect is refused when it is empty
+	RedirectFrom string
+	//Quota limits the email cached, nil for no limit
+	Quota *Quota
+	//NoticeFolder is where messages from the server such as quota
+	//warnings are put
+	NoticeFolder string
+}
+
+//CheckFilterLocation checks a filter location is a path or names an S3
+//object
+func CheckFilterLocation(location string) error {
+	if location == "" {
+		return fmt.Errorf("filter location is empty")
+	}
+	if strings.HasPrefix(location, s3Scheme) {
+		bucket, key, _ := strings.Cut(strings.TrimPrefix(location, s3Scheme), "/")
+		if bucket == "" || key == "" {
+			return fmt.Errorf("filter location %q must be s3://bucket/key", location)
+		}
+	}
+	return nil
+}
+
+//loadFilter reads and checks the Sieve script at location
+func loadFilter(location string, sess *session.Session) (*sieve.Script, error) {
+	var src []byte
+	var err error
+	if strings.HasPrefix(location, s3Scheme) {
+		bucket, key, _ := strings.Cut(strings.TrimPrefix(location, s3Scheme), "/")
+		svc := s3.New(sess)
+		start := time.Now()
+		var resp *s3.GetObjectOutput
+		resp, err = svc.GetObject(&s3.GetObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key),
+		})
+		metrics.ObserveS3("get", start, err)
+		if nil == err {
+			defer resp.Body.Close()
+			src, err = ioutil.ReadAll(resp.Body)
+		}
+	} else {
+		src, err = ioutil.ReadFile(location)
+	}
+	if nil != err {
+		return nil, err
+	}
+	return sieve.Parse(string(src))
+}
+
+//sieveMessage gives a script the headers and size of an email
+func sieveMessage(headers []string, size int) *sieve.Message {
+	message, err := mail.ReadMessage(strings.NewReader(strings.Join(headers, "\r\n") + "\r\n\r\n"))
+	if nil != err {
+		//tests see no headers rather than the email being lost
+		return &sieve.Message{Header: mail.Header{}, Size: size}
+	}
+	return &sieve.Message{Header: message.Header, Size: size}
+}
+
+//redirectEmail sends a copy of an email to another address through SES.
+//SES only sends from verified addresses, so the email is sent from
+//redirectFrom with replies going to the original sender, and signatures
+//that would no longer verify are removed.
+func redirectEmail(redirectFrom string, to string, headers []string, body []string) error {
+	if redirectFrom == "" {
+		return fmt.Errorf("no sender domain configured for redirect")
+	}
+	var originalFrom, replyTo string
+	var message bytes.Buffer
+	var name string
+	for _, line := range headers {
+		continuation := strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")
+		value := line
+		if !continuation {
+			name, value, _ = strings.Cut(line, ":")
+			name = strings.ToLower(name)
+		}
+		switch name {
+		case "from":
+			originalFrom = strings.TrimSpace(originalFrom + " " + strings.TrimSpace(value))
+		case "reply-to":
+			replyTo = strings.TrimSpace(replyTo + " " + strings.TrimSpace(value))
+			message.WriteString(line + "\r\n")
+		case "return-path", "sender", "dkim-signature":
+		default:
+			message.WriteString(line + "\r\n")
+		}
+	}
+	message.WriteString(loopHeader + ": " + redirectFrom + "\r\n")
+	sender := &mail.Address{Address: redirectFrom}
+	if address, err := mail.ParseAddress(originalFrom); nil == err {
+		name := address.Name
+		if name == "" {
+			name = address.Address
+		}
+		sender.Name = name + " via"
+	}
+	message.WriteString("From: " + sender.String() + "\r\n")
+	if replyTo == "" && originalFrom != "" {
+		message.WriteString("Reply-To: " + originalFrom + "\r\n")
+	}
+	for _, line := range body {
+		message.WriteString(line + "\r\n")
+	}
+	_, err := SendRawEmail(redirectFrom, []string{to}, message.Bytes())
+	return err
+}
+
+//hasLoopHeader reports whether email was already redirected from address
+func hasLoopHeader(headers []string, address string) bool {
+	for _, line := range headers {
+		name, value, ok := strings.Cut(line, ":")
+		if ok && strings.EqualFold(strings.TrimSpace(name), loopHeader) && strings.EqualFold(strings.TrimSpace(value), address) {
+			return true
+		}
+	}
+	return false
+}
+
+//redirectRecord is the line of the redirected file for one redirect
+func redirectRecord(indexName string, to string) string {
+	return indexName + " " + to
+}
+
+//wasRedirected reports whether the email was already sent to the address
+func (in *ingest) wasRedirected(indexName string, to string) bool {
+	if nil == in.redirected {
+		in.redirected = make(map[string]bool)
+		records, err := ioutil.ReadFile(filepath.Join(in.emailDir, redirectedFileName))
+		if nil != err && !os.IsNotExist(err) {
+			slog.Warn("could not read redirected email", "error", err)
+		}
+		for _, record := range strings.Split(string(records), "\n") {
+			in.redirected[record] = true
+		}
+	}
+	return in.redirected[redirectRecord(indexName, to)]
+}
+
+//pruneRedirects drops the redirects of email that has since been indexed,
+//which is never filtered again, and removes the file once it is empty
+func pruneRedirects(emailDir string, filesByName map[string]*mailFile) error {
+	filename := filepath.Join(emailDir, redirectedFileName)
+	records, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if nil != err {
+		return mailutils.NewCacheError(mailutils.ErrCacheUnavailable, filename, err)
+	}
+	var kept strings.Builder
+	for _, record := range strings.Split(string(records), "\n") {
+		//the address has no spaces, the index name may
+		space := strings.LastIndexByte(record, ' ')
+		if space < 0 {
+			continue
+		}
+		if _, indexed := filesByName[record[:space]]; !indexed {
+			kept.WriteString(record + "\n")
+		}
+	}
+	if kept.Len() == len(records) {
+		return nil
+	}
+	if kept.Len() == 0 {
+		err = os.Remove(filename)
+	} else {
+		tempFilename := filename + ".tmp"
+		err = ioutil.WriteFile(tempFilename, []byte(kept.String()), 0600)
+		if nil == err {
+			err = os.Rename(tempFilename, filename)
+		}
+	}
+	if nil != err {
+		return mailutils.NewCacheError(mailutils.ErrCacheUnavailable, filename, err)
+	}
+	return nil
+}
+
+//recordRedirect notes a redirect that was sent
+func (in *ingest) recordRedirect(indexName string, to string) error {
+	filename := filepath.Join(in.emailDir, redirectedFileName)
+	file, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if nil == err {
+		_, err = file.WriteString(redirectRecord(indexName, to) + "\n")
+		if closeErr := file.Close(); nil == err {
+			err = closeErr
+		}
+	}
+	if nil != err {
+		return mailutils.NewCacheError(mailutils.ErrCacheUnavailable, filename, err)
+	}
+	in.redirected[redirectRecord(indexName, to)] = true
+	return nil
+}
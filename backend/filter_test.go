@@ -0,0 +1,94 @@
+package backend
+
+/*
+    s3pop-server: An AWS S3 backed POP3 server
+	Copyright (C) 2018 James W Matheson
+	fractal.mango@gmail.com
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestHasLoopHeader(t *testing.T) {
+	headers := []string{"From: a@example.com", "x-loop:  Bob@Example.com ", "Subject: hi"}
+	if !hasLoopHeader(headers, "bob@example.com") {
+		t.Error("loop header for the mailbox not found")
+	}
+	if hasLoopHeader(headers, "alice@example.com") {
+		t.Error("loop header for another mailbox matched")
+	}
+	if hasLoopHeader([]string{"Subject: X-Loop: bob@example.com"}, "bob@example.com") {
+		t.Error("loop header matched inside another header")
+	}
+}
+
+func TestRecordRedirect(t *testing.T) {
+	dir := t.TempDir()
+	in := &ingest{emailDir: dir}
+	if in.wasRedirected("Work/a b", "c@example.com") {
+		t.Fatal("redirect reported before it was sent")
+	}
+	err := in.recordRedirect("Work/a b", "c@example.com")
+	if nil != err {
+		t.Fatal(err)
+	}
+	//a later sync reads the record back
+	in = &ingest{emailDir: dir}
+	if !in.wasRedirected("Work/a b", "c@example.com") {
+		t.Error("recorded redirect not found")
+	}
+	if in.wasRedirected("Work/a b", "d@example.com") || in.wasRedirected("a", "c@example.com") {
+		t.Error("redirect found for another email or address")
+	}
+}
+
+func TestPruneRedirects(t *testing.T) {
+	dir := t.TempDir()
+	in := &ingest{emailDir: dir}
+	for _, name := range []string{"Work/a b", "c", "d"} {
+		in.wasRedirected(name, "x@example.com")
+		err := in.recordRedirect(name, "x@example.com")
+		if nil != err {
+			t.Fatal(err)
+		}
+	}
+
+	err := pruneRedirects(dir, map[string]*mailFile{"Work/a b": {}, "d": {}})
+	if nil != err {
+		t.Fatal(err)
+	}
+	records, err := os.ReadFile(filepath.Join(dir, redirectedFileName))
+	if nil != err {
+		t.Fatal(err)
+	}
+	if string(records) != "c x@example.com\n" {
+		t.Errorf("records after pruning = %q, want only c", records)
+	}
+
+	err = pruneRedirects(dir, map[string]*mailFile{"c": {}})
+	if nil != err {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(filepath.Join(dir, redirectedFileName)); !os.IsNotExist(err) {
+		t.Errorf("redirected file left once every email was indexed: %v", err)
+	}
+	if err = pruneRedirects(dir, nil); nil != err {
+		t.Errorf("pruning without a file: %v", err)
+	}
+}
@@ -0,0 +1,230 @@
+package backend
+
+/*
+    s3pop-server: An AWS S3 backed POP3 server
+	Copyright (C) 2018 James W Matheson
+	fractal.mango@gmail.com
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+//Adding email from other mail systems to a mailbox
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/mail"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+
+	"github.com/FractalJim/s3pop-server/mailutils"
+	"github.com/FractalJim/s3pop-server/metrics"
+)
+
+//Importer uploads email to a mailbox in S3 and caches it straight away,
+//as if it had been downloaded. It holds the mailbox's sync lock until it
+//is closed, which keeps a server running in another process from
+//syncing the mailbox and downloading the imported email a second time.
+type Importer struct {
+	emailBucket  string
+	emailFolder  string
+	emailDir     string
+	sess         *session.Session
+	lock         *syncLock
+	filesByIndex map[int]*mailFile
+	filesByName  map[string]*mailFile
+	//known are the Message-IDs, or content hashes for email without one,
+	//of the email already in the mailbox
+	known  map[string]bool
+	dryRun bool
+}
+
+//NewImporter starts importing into a mailbox. Email already cached is
+//read for its Message-ID so it is not imported twice, so the mailbox
+//should be synced first. With dryRun nothing is written.
+func NewImporter(emailBucket, emailFolder string, dryRun bool) (*Importer, error) {
+	sess, err := getSession()
+	if nil != err {
+		return nil, err
+	}
+	emailDir, err := mailutils.GetEmailDir(emailFolder)
+	if nil != err {
+		return nil, err
+	}
+	im := &Importer{
+		emailBucket: emailBucket,
+		emailFolder: emailFolder,
+		emailDir:    emailDir,
+		sess:        sess,
+		known:       make(map[string]bool),
+		dryRun:      dryRun,
+	}
+	im.lock, err = lockSync(emailFolder, emailDir)
+	if nil != err {
+		return nil, err
+	}
+	im.filesByIndex, im.filesByName, err = loadIndex(emailDir)
+	if nil == err {
+		err = im.loadKnown()
+	}
+	if nil != err {
+		im.Close()
+		return nil, err
+	}
+	return im, nil
+}
+
+//Close releases the mailbox's sync lock
+func (im *Importer) Close() {
+	if nil != im.lock {
+		im.lock.Unlock()
+		im.lock = nil
+	}
+}
+
+//loadKnown reads the identity of every email in the cache
+func (im *Importer) loadKnown() error {
+	folders, err := mailutils.ListFolders(im.emailDir)
+	if nil != err {
+		return err
+	}
+	for _, folder := range append([]string{""}, folders...) {
+		folderDir, err := mailutils.GetFolderDir(im.emailDir, folder)
+		if nil != err {
+			return err
+		}
+		mailData, err := mailutils.ListMailData(folderDir)
+		if nil != err {
+			return err
+		}
+		for _, data := range mailData {
+			content, err := ioutil.ReadFile(filepath.Join(folderDir, data.Name))
+			if nil != err {
+				continue
+			}
+			im.known[emailIdentity(content)] = true
+		}
+	}
+	return nil
+}
+
+//emailIdentity is the Message-ID of an email, or a hash of its content if
+//it has none
+func emailIdentity(content []byte) string {
+	message, err := mail.ReadMessage(bytes.NewReader(content))
+	if nil == err {
+		if messageID := strings.TrimSpace(message.Header.Get("Message-ID")); messageID != "" {
+			return messageID
+		}
+	}
+	sum := sha256.Sum256(content)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+//Import adds one email to a folder of the mailbox with the given flags,
+//\Seen marking it read. Email whose Message-ID is already in the mailbox
+//is skipped and false returned. The key is made from a hash of the email
+//so importing it again can't give a second copy in S3.
+func (im *Importer) Import(folder string, content []byte, flags []string, source string) (bool, error) {
+	identity := emailIdentity(content)
+	if im.known[identity] {
+		return false, nil
+	}
+	sum := sha256.Sum256(content)
+	name := "import-" + hex.EncodeToString(sum[:12])
+	indexName := path.Join(folder, name)
+	if _, exists := im.filesByName[indexName]; exists {
+		im.known[identity] = true
+		return false, nil
+	}
+	im.known[identity] = true
+	if im.dryRun {
+		return true, nil
+	}
+
+	metadata := map[string]*string{"Import-Source": aws.String(source)}
+	if !strings.HasPrefix(identity, "sha256:") {
+		//S3 metadata must be ASCII
+		metadata["Message-Id"] = aws.String(strings.Map(func(r rune) rune {
+			if r < ' ' || r > '~' {
+				return '?'
+			}
+			return r
+		}, identity))
+	}
+	svc := s3.New(im.sess)
+	start := time.Now()
+	_, err := svc.PutObject(&s3.PutObjectInput{
+		Bucket:      aws.String(im.emailBucket),
+		Key:         aws.String(path.Join(im.emailFolder, indexName)),
+		Body:        bytes.NewReader(content),
+		ContentType: aws.String("message/rfc822"),
+		Metadata:    metadata,
+	})
+	metrics.ObserveS3("put", start, err)
+	if nil != err {
+		return false, err
+	}
+
+	folderDir, err := mailutils.GetFolderDir(im.emailDir, folder)
+	if nil != err {
+		return false, err
+	}
+	emailFile := filepath.Join(folderDir, name)
+	err = ioutil.WriteFile(emailFile, content, 0600)
+	if nil != err {
+		return false, mailutils.NewCacheError(mailutils.ErrCacheUnavailable, emailFile, err)
+	}
+	headers, body, err := splitEmail(emailFile)
+	if nil != err {
+		return false, err
+	}
+	headerSize := calcPartSizeBytes(headers)
+	bodySize := calcPartSizeBytes(body)
+	data := &mailutils.MailData{
+		Name:        name,
+		Folder:      folder,
+		Key:         indexName,
+		ID:          getNextID(im.filesByIndex),
+		HeaderSize:  headerSize,
+		MessageSize: bodySize,
+		TotalSize:   headerSize + bodySize,
+	}
+	for _, flag := range flags {
+		if strings.EqualFold(flag, `\Seen`) {
+			data.MarkRead(true)
+		} else {
+			data.Flags = append(data.Flags, flag)
+		}
+	}
+	err = data.Save(folderDir)
+	if nil != err {
+		os.Remove(emailFile)
+		return false, err
+	}
+	err = appendIndex(indexName, im.emailDir, im.filesByIndex, im.filesByName)
+	if nil != err {
+		return false, err
+	}
+	return true, nil
+}
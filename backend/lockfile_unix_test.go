@@ -0,0 +1,61 @@
+//go:build unix
+
+package backend
+
+/*
+    s3pop-server: An AWS S3 backed POP3 server
+	Copyright (C) 2018 James W Matheson
+	fractal.mango@gmail.com
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLockSyncExcludesOtherOpens(t *testing.T) {
+	dir := t.TempDir()
+	lock, err := lockSync("bob", dir)
+	if nil != err {
+		t.Fatal(err)
+	}
+	//another process opens the lock file separately, as this does
+	locked := make(chan struct{})
+	go func() {
+		file, err := os.OpenFile(filepath.Join(dir, syncLockFileName), os.O_RDWR, 0600)
+		if nil != err {
+			t.Error(err)
+			close(locked)
+			return
+		}
+		defer file.Close()
+		lockFile(file)
+		close(locked)
+	}()
+	select {
+	case <-locked:
+		t.Fatal("lock file was not locked")
+	case <-time.After(100 * time.Millisecond):
+	}
+	lock.Unlock()
+	select {
+	case <-locked:
+	case <-time.After(5 * time.Second):
+		t.Fatal("lock file still locked after Unlock")
+	}
+}
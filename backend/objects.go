@@ -0,0 +1,108 @@
+package backend
+
+/*
+    s3pop-server: An AWS S3 backed POP3 server
+	Copyright (C) 2018 James W Matheson
+	fractal.mango@gmail.com
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+//Reading a mailbox straight from S3 without caching it
+
+import (
+	"io/ioutil"
+	"log/slog"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+
+	"github.com/FractalJim/s3pop-server/mailutils"
+	"github.com/FractalJim/s3pop-server/metrics"
+)
+
+//EmailObject is an email stored in S3
+type EmailObject struct {
+	//Key is relative to the mailbox, with the folder in front as in the
+	//index
+	Key          string
+	Folder       string
+	Name         string
+	Size         int
+	LastModified time.Time
+}
+
+//ListEmails lists the email stored in S3 for a mailbox. Folder
+//placeholders and keys that could not be cached are left out, as they are
+//by DownloadEmails.
+func ListEmails(emailBucket, emailFolder string) ([]EmailObject, error) {
+	sess, err := getSession()
+	if nil != err {
+		return nil, err
+	}
+	svc := s3.New(sess)
+	prefix := emailFolder + "/"
+	emails := make([]EmailObject, 0)
+	start := time.Now()
+	err = svc.ListObjectsPages(&s3.ListObjectsInput{
+		Bucket: aws.String(emailBucket),
+		Prefix: aws.String(prefix),
+	}, func(page *s3.ListObjectsOutput, lastPage bool) bool {
+		for _, object := range page.Contents {
+			key := strings.TrimPrefix(*object.Key, prefix)
+			folder, name := path.Split(key)
+			folder = strings.TrimSuffix(folder, "/")
+			if name == "" {
+				continue
+			}
+			if !mailutils.ValidName(name) || !mailutils.ValidFolder(folder) {
+				slog.Warn("skipping email with unusable key", "key", *object.Key)
+				continue
+			}
+			emails = append(emails, EmailObject{
+				Key:          key,
+				Folder:       folder,
+				Name:         name,
+				Size:         int(aws.Int64Value(object.Size)),
+				LastModified: aws.TimeValue(object.LastModified),
+			})
+		}
+		return true
+	})
+	metrics.ObserveS3("list", start, err)
+	return emails, err
+}
+
+//FetchEmail reads an email listed by ListEmails
+func FetchEmail(emailBucket, emailFolder string, email EmailObject) ([]byte, error) {
+	sess, err := getSession()
+	if nil != err {
+		return nil, err
+	}
+	svc := s3.New(sess)
+	start := time.Now()
+	resp, err := svc.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(emailBucket),
+		Key:    aws.String(path.Join(emailFolder, email.Key)),
+	})
+	metrics.ObserveS3("get", start, err)
+	if nil != err {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return ioutil.ReadAll(resp.Body)
+}
@@ -0,0 +1,255 @@
+package backend
+
+/*
+    s3pop-server: An AWS S3 backed POP3 server
+	Copyright (C) 2018 James W Matheson
+	fractal.mango@gmail.com
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+//Mailbox quotas, counted over the email cached in every folder
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/FractalJim/s3pop-server/mailutils"
+	"github.com/FractalJim/s3pop-server/metrics"
+)
+
+//quotaWarnedFileName holds the highest warning threshold the mailbox has
+//been sent a notice for, so each threshold is only warned about once
+//each time usage crosses it
+const quotaWarnedFileName = "_quota_warned.txt"
+
+var defaultQuotaWarnings = []int{80, 90, 100}
+
+//Quota limits how much email is cached for a mailbox
+type Quota struct {
+	//Limit is the most octets of email cached, new email is left in S3
+	//while the mailbox is over it
+	Limit int `json:"limit" yaml:"limit" toml:"limit"`
+	//Warnings are the percentages of Limit at which a notice is put in
+	//the mailbox
+	Warnings []int `json:"warnings" yaml:"warnings" toml:"warnings"`
+}
+
+//ApplyDefaults fills in settings that were left out of the config
+func (q *Quota) ApplyDefaults() {
+	if nil == q.Warnings {
+		q.Warnings = append([]int{}, defaultQuotaWarnings...)
+	}
+	sort.Ints(q.Warnings)
+}
+
+//Validate checks the quota values are usable
+func (q *Quota) Validate() error {
+	if q.Limit <= 0 {
+		return errors.New("limit must be more than 0")
+	}
+	for _, warning := range q.Warnings {
+		if warning <= 0 || warning > 100 {
+			return fmt.Errorf("warning %d is not a percentage from 1 to 100", warning)
+		}
+	}
+	return nil
+}
+
+//QuotaUsage is how much of its quota a mailbox is using. A mailbox is
+//full when it is over its limit or the last sync left email in S3 that
+//would not fit.
+type QuotaUsage struct {
+	Messages int `json:"messages"`
+	Used     int `json:"used"`
+	Limit    int `json:"limit"`
+	Percent  int `json:"percent"`
+	//Waiting is the number of emails the last sync left in S3
+	Waiting int       `json:"waiting"`
+	Full    bool      `json:"full"`
+	Time    time.Time `json:"time"`
+}
+
+var quotaUsage = struct {
+	sync.Mutex
+	byMailbox map[string]QuotaUsage
+}{byMailbox: make(map[string]QuotaUsage)}
+
+//CheckQuota totals the email cached for a mailbox against its quota
+func CheckQuota(emailFolder string, quota *Quota) (QuotaUsage, error) {
+	emailDir, err := mailutils.GetEmailDir(emailFolder)
+	if nil != err {
+		return QuotaUsage{}, err
+	}
+	return checkQuota(emailFolder, emailDir, quota)
+}
+
+func checkQuota(emailFolder, emailDir string, quota *Quota) (QuotaUsage, error) {
+	usage := QuotaUsage{Limit: quota.Limit, Time: time.Now()}
+	folders, err := mailutils.ListFolders(emailDir)
+	if nil != err {
+		return usage, err
+	}
+	for _, folder := range append([]string{""}, folders...) {
+		folderDir, err := mailutils.GetFolderDir(emailDir, folder)
+		if nil != err {
+			return usage, err
+		}
+		mailData, err := mailutils.ListMailData(folderDir)
+		if nil != err {
+			return usage, err
+		}
+		for _, data := range mailData {
+			usage.Messages++
+			usage.Used += data.TotalSize
+		}
+	}
+	usage.Percent = int(int64(usage.Used) * 100 / int64(quota.Limit))
+
+	quotaUsage.Lock()
+	usage.Waiting = quotaUsage.byMailbox[emailFolder].Waiting
+	quotaUsage.Unlock()
+	recordQuota(emailFolder, &usage)
+	return usage, nil
+}
+
+func recordQuota(emailFolder string, usage *QuotaUsage) {
+	usage.Full = usage.Used >= usage.Limit || usage.Waiting > 0
+	quotaUsage.Lock()
+	quotaUsage.byMailbox[emailFolder] = *usage
+	quotaUsage.Unlock()
+	if metrics.KnownMailbox(emailFolder) {
+		metrics.QuotaUsedBytes.WithLabelValues(emailFolder).Set(float64(usage.Used))
+		metrics.QuotaLimitBytes.WithLabelValues(emailFolder).Set(float64(usage.Limit))
+	}
+}
+
+//QuotaUsages returns the last usage checked for each mailbox with a quota
+//since the process started
+func QuotaUsages() map[string]QuotaUsage {
+	quotaUsage.Lock()
+	defer quotaUsage.Unlock()
+	usages := make(map[string]QuotaUsage, len(quotaUsage.byMailbox))
+	for mailbox, usage := range quotaUsage.byMailbox {
+		usages[mailbox] = usage
+	}
+	return usages
+}
+
+//warnQuota puts a notice in the mailbox when usage has reached a warning
+//threshold it has not been warned about since it last dropped below it
+func (in *ingest) warnQuota(usage QuotaUsage) error {
+	quota := in.options.Quota
+	percent := usage.Percent
+	if usage.Full {
+		percent = 100
+	}
+	reached := 0
+	for _, warning := range quota.Warnings {
+		if percent >= warning {
+			reached = warning
+		}
+	}
+	warnedFile := filepath.Join(in.emailDir, quotaWarnedFileName)
+	warned := 0
+	if data, err := ioutil.ReadFile(warnedFile); nil == err {
+		warned, _ = strconv.Atoi(strings.TrimSpace(string(data)))
+	}
+	if reached == warned {
+		return nil
+	}
+	if reached > warned {
+		headers, body := quotaNotice(in.mailbox, reached, usage)
+		err := in.deliverNotice(headers, body)
+		if nil != err {
+			return err
+		}
+		slog.Info("quota warning sent", "mailbox", in.mailbox, "percent", usage.Percent, "threshold", reached)
+	}
+	err := ioutil.WriteFile(warnedFile, []byte(strconv.Itoa(reached)+"\n"), 0600)
+	if nil != err {
+		return mailutils.NewCacheError(mailutils.ErrCacheUnavailable, warnedFile, err)
+	}
+	return nil
+}
+
+//quotaNotice writes the message telling the user how full the mailbox is
+func quotaNotice(mailbox string, threshold int, usage QuotaUsage) (headers []string, body []string) {
+	host, err := os.Hostname()
+	if nil != err || host == "" {
+		host = "localhost"
+	}
+	now := time.Now()
+	subject := fmt.Sprintf("Your mailbox is %d%% full", threshold)
+	explanation := "Please delete some email before the mailbox fills up."
+	if usage.Full {
+		subject = "Your mailbox is full"
+		explanation = "New email is being kept on the server until you delete some email."
+	}
+	headers = []string{
+		"From: Mail Server <postmaster@" + host + ">",
+		"To: " + mailbox,
+		"Subject: " + subject,
+		"Date: " + now.Format(time.RFC1123Z),
+		fmt.Sprintf("Message-ID: <quota.%d.%d@%s>", now.UnixNano(), threshold, host),
+		"MIME-Version: 1.0",
+		"Content-Type: text/plain; charset=us-ascii",
+	}
+	body = []string{
+		"",
+		fmt.Sprintf("Your mailbox %s is using %d of its %d octets (%d%%).", mailbox, usage.Used, usage.Limit, usage.Percent),
+		explanation,
+	}
+	return headers, body
+}
+
+//deliverNotice adds a message generated by the server to the mailbox's
+//notice folder, indexed like downloaded email so it gets the next id
+func (in *ingest) deliverNotice(headers []string, body []string) error {
+	folderDir, err := mailutils.GetFolderDir(in.emailDir, in.options.NoticeFolder)
+	if nil != err {
+		return err
+	}
+	name := fmt.Sprintf("notice-%d", time.Now().UnixNano())
+	emailFile := filepath.Join(folderDir, name)
+	err = writeEmail(emailFile, headers, body)
+	if nil != err {
+		return err
+	}
+	headerSize := calcPartSizeBytes(headers)
+	bodySize := calcPartSizeBytes(body)
+	metadata := &mailutils.MailData{
+		Name:        name,
+		Folder:      in.options.NoticeFolder,
+		ID:          getNextID(in.filesByIndex),
+		HeaderSize:  headerSize,
+		MessageSize: bodySize,
+		TotalSize:   headerSize + bodySize,
+	}
+	err = metadata.Save(folderDir)
+	if nil != err {
+		return err
+	}
+	return appendIndex(path.Join(in.options.NoticeFolder, name), in.emailDir, in.filesByIndex, in.filesByName)
+}
@@ -0,0 +1,327 @@
+package backend
+
+/*
+    s3pop-server: An AWS S3 backed POP3 server
+	Copyright (C) 2018 James W Matheson
+	fractal.mango@gmail.com
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+//Expiring old email from a mailbox's cache and its S3 prefix
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+
+	"github.com/FractalJim/s3pop-server/mailutils"
+	"github.com/FractalJim/s3pop-server/metrics"
+)
+
+//What happens to email when it expires
+const (
+	RETENTION_DELETE  = "delete"  //remove it from the cache and S3
+	RETENTION_ARCHIVE = "archive" //move it to ArchiveFolder
+)
+
+const defaultArchiveFolder = "archive"
+
+//RetentionPolicy decides how long email stays in a mailbox. A limit of
+//zero does not apply.
+type RetentionPolicy struct {
+	Action string `json:"action" yaml:"action" toml:"action"`
+	//RetrievedDays is how long email is kept after it was first read
+	RetrievedDays int `json:"retrievedDays" yaml:"retrievedDays" toml:"retrievedDays"`
+	//UnretrievedDays is how long email that has not been read is kept
+	//after it was downloaded
+	UnretrievedDays int `json:"unretrievedDays" yaml:"unretrievedDays" toml:"unretrievedDays"`
+	//MaxMailboxSize is the most octets of email kept, the oldest email
+	//expires first when there is more
+	MaxMailboxSize int    `json:"maxMailboxSize" yaml:"maxMailboxSize" toml:"maxMailboxSize"`
+	ArchiveFolder  string `json:"archiveFolder" yaml:"archiveFolder" toml:"archiveFolder"`
+}
+
+//ApplyDefaults fills in settings that were left out of the config
+func (p *RetentionPolicy) ApplyDefaults() {
+	if p.Action == "" {
+		p.Action = RETENTION_DELETE
+	}
+	if p.ArchiveFolder == "" {
+		p.ArchiveFolder = defaultArchiveFolder
+	}
+}
+
+//Validate checks the policy values are usable
+func (p *RetentionPolicy) Validate() error {
+	if p.Action != RETENTION_DELETE && p.Action != RETENTION_ARCHIVE {
+		return fmt.Errorf("retention action %q is not one of %s or %s", p.Action, RETENTION_DELETE, RETENTION_ARCHIVE)
+	}
+	if p.RetrievedDays < 0 || p.UnretrievedDays < 0 || p.MaxMailboxSize < 0 {
+		return errors.New("retrievedDays, unretrievedDays and maxMailboxSize must not be negative")
+	}
+	if p.ArchiveFolder == "" || !mailutils.ValidFolder(p.ArchiveFolder) {
+		return fmt.Errorf("archiveFolder %q is not a usable folder name", p.ArchiveFolder)
+	}
+	return nil
+}
+
+//ExpireResult counts what ExpireEmails did
+type ExpireResult struct {
+	Deleted  int
+	Archived int
+	Failed   int
+}
+
+//expiring is a cached email being considered for expiry
+type expiring struct {
+	data      *mailutils.MailData
+	folderDir string
+	arrived   time.Time
+}
+
+//ExpireEmails applies a retention policy to the email cached for a
+//mailbox and to the S3 objects it was downloaded from. When archiving,
+//email already in the archive folder is left alone. Email that could not
+//be expired is counted as failed and tried again next time.
+func ExpireEmails(emailBucket, emailFolder string, policy *RetentionPolicy, now time.Time) (ExpireResult, error) {
+	var result ExpireResult
+
+	emailDir, err := mailutils.GetEmailDir(emailFolder)
+	if nil != err {
+		return result, err
+	}
+	lock, err := lockSync(emailFolder, emailDir)
+	if nil != err {
+		return result, err
+	}
+	defer lock.Unlock()
+	folders, err := mailutils.ListFolders(emailDir)
+	if nil != err {
+		return result, err
+	}
+	emails := make([]*expiring, 0)
+	for _, folder := range append([]string{""}, folders...) {
+		if policy.Action == RETENTION_ARCHIVE && inFolder(folder, policy.ArchiveFolder) {
+			continue
+		}
+		folderDir, err := mailutils.GetFolderDir(emailDir, folder)
+		if nil != err {
+			return result, err
+		}
+		mailData, err := mailutils.ListMailData(folderDir)
+		if nil != err {
+			return result, err
+		}
+		for _, data := range mailData {
+			//the file's time is when the email was downloaded, as for purge
+			info, err := os.Stat(filepath.Join(folderDir, data.Name))
+			if nil != err {
+				continue
+			}
+			emails = append(emails, &expiring{data: data, folderDir: folderDir, arrived: info.ModTime()})
+		}
+	}
+
+	expired := selectExpired(emails, policy, now)
+	if len(expired) == 0 {
+		return result, nil
+	}
+	sess, err := getSession()
+	if nil != err {
+		return result, err
+	}
+	filesByIndex, filesByName, err := loadIndex(emailDir)
+	if nil != err {
+		return result, err
+	}
+	for _, email := range expired {
+		key := path.Join(emailFolder, email.data.ObjectKey())
+		if policy.Action == RETENTION_ARCHIVE {
+			err = archiveEmail(emailBucket, emailFolder, emailDir, email, policy.ArchiveFolder, sess, filesByIndex, filesByName)
+			if nil == err {
+				result.Archived++
+				metrics.MessagesExpired.WithLabelValues(RETENTION_ARCHIVE).Inc()
+			}
+		} else {
+			err = deleteObject(emailBucket, key, sess)
+			if nil == err {
+				err = removeCached(email)
+			}
+			if nil == err {
+				result.Deleted++
+				metrics.MessagesExpired.WithLabelValues(RETENTION_DELETE).Inc()
+			}
+		}
+		if nil != err {
+			slog.Error("could not expire email", "key", key, "action", policy.Action, "error", err)
+			result.Failed++
+		}
+	}
+	return result, nil
+}
+
+//selectExpired picks the email past the policy's age limits, then the
+//oldest of the rest until what is left fits in MaxMailboxSize
+func selectExpired(emails []*expiring, policy *RetentionPolicy, now time.Time) []*expiring {
+	sort.Slice(emails, func(i, j int) bool { return emails[i].arrived.Before(emails[j].arrived) })
+	expired := make([]*expiring, 0)
+	kept := make([]*expiring, 0, len(emails))
+	size := 0
+	for _, email := range emails {
+		if email.data.Read && policy.RetrievedDays > 0 {
+			//email read before the time was recorded counts from its arrival
+			retrieved := email.arrived
+			if nil != email.data.Retrieved {
+				retrieved = *email.data.Retrieved
+			}
+			if now.Sub(retrieved) > days(policy.RetrievedDays) {
+				expired = append(expired, email)
+				continue
+			}
+		}
+		if !email.data.Read && policy.UnretrievedDays > 0 && now.Sub(email.arrived) > days(policy.UnretrievedDays) {
+			expired = append(expired, email)
+			continue
+		}
+		kept = append(kept, email)
+		size += email.data.TotalSize
+	}
+	for _, email := range kept {
+		if policy.MaxMailboxSize == 0 || size <= policy.MaxMailboxSize {
+			break
+		}
+		expired = append(expired, email)
+		size -= email.data.TotalSize
+	}
+	return expired
+}
+
+func days(n int) time.Duration {
+	return time.Duration(n) * 24 * time.Hour
+}
+
+//inFolder reports whether folder is parent or nested inside it
+func inFolder(folder, parent string) bool {
+	return folder == parent || strings.HasPrefix(folder, parent+"/")
+}
+
+//archiveEmail moves an email into the archive folder in S3 and in the
+//cache, giving it a new id there as it is new to that folder
+func archiveEmail(emailBucket, emailFolder, emailDir string, email *expiring, archiveFolder string, sess *session.Session, filesByIndex map[int]*mailFile, filesByName map[string]*mailFile) error {
+	name := email.data.Name
+	archiveName := path.Join(archiveFolder, name)
+	if _, known := filesByName[archiveName]; known {
+		name = fmt.Sprintf("%d-%s", email.data.ID, name)
+		archiveName = path.Join(archiveFolder, name)
+	}
+	archiveDir, err := mailutils.GetFolderDir(emailDir, archiveFolder)
+	if nil != err {
+		return err
+	}
+	if _, err = os.Stat(filepath.Join(archiveDir, name)); nil == err {
+		return fmt.Errorf("%s is already in the archive folder", name)
+	}
+
+	key := path.Join(emailFolder, email.data.ObjectKey())
+	svc := s3.New(sess)
+	start := time.Now()
+	_, err = svc.CopyObject(&s3.CopyObjectInput{
+		Bucket:     aws.String(emailBucket),
+		CopySource: aws.String(url.PathEscape(emailBucket) + "/" + escapeKey(key)),
+		Key:        aws.String(path.Join(emailFolder, archiveName)),
+	})
+	metrics.ObserveS3("copy", start, err)
+	if isNoSuchKey(err) {
+		//another copy of the email was expired first, only the cache is
+		//left to move
+		err = nil
+	} else if nil == err {
+		err = deleteObject(emailBucket, key, sess)
+	}
+	if nil != err {
+		return err
+	}
+
+	//the entry stops the archived object being downloaded again
+	err = appendIndex(archiveName, emailDir, filesByIndex, filesByName)
+	if nil != err {
+		return err
+	}
+	oldFile := filepath.Join(email.folderDir, email.data.Name)
+	archived := *email.data
+	archived.ID = filesByName[archiveName].index
+	archived.Name = name
+	archived.Folder = archiveFolder
+	archived.Key = archiveName
+	err = os.Rename(oldFile, filepath.Join(archiveDir, name))
+	if nil != err {
+		return mailutils.NewCacheError(mailutils.ErrCacheUnavailable, oldFile, err)
+	}
+	err = archived.Save(archiveDir)
+	if nil != err {
+		return err
+	}
+	os.Remove(oldFile + ".json")
+	return nil
+}
+
+//removeCached removes an expired email from the cache, its index entry
+//is kept so it is not downloaded again
+func removeCached(email *expiring) error {
+	filename := filepath.Join(email.folderDir, email.data.Name)
+	err := os.Remove(filename + ".json")
+	if nil != err {
+		return mailutils.NewCacheError(mailutils.ErrCacheUnavailable, filename, err)
+	}
+	os.Remove(filename)
+	return nil
+}
+
+func deleteObject(emailBucket, key string, sess *session.Session) error {
+	svc := s3.New(sess)
+	start := time.Now()
+	_, err := svc.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(emailBucket),
+		Key:    aws.String(key),
+	})
+	metrics.ObserveS3("delete", start, err)
+	return err
+}
+
+//escapeKey escapes each level of an object key for CopySource
+func escapeKey(key string) string {
+	levels := strings.Split(key, "/")
+	for i, level := range levels {
+		levels[i] = url.PathEscape(level)
+	}
+	return strings.Join(levels, "/")
+}
+
+func isNoSuchKey(err error) bool {
+	var awsErr awserr.Error
+	return errors.As(err, &awsErr) && awsErr.Code() == s3.ErrCodeNoSuchKey
+}
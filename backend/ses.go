@@ -0,0 +1,101 @@
+package backend
+
+/*
+    s3pop-server: An AWS S3 backed POP3 server
+	Copyright (C) 2018 James W Matheson
+	fractal.mango@gmail.com
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+//Sending email through Amazon SES for the SMTP submission listener
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ses"
+
+	"github.com/FractalJim/s3pop-server/metrics"
+)
+
+//verificationTTL is how long the verification status of a domain is
+//remembered, so every message does not cost an SES request
+const verificationTTL = 10 * time.Minute
+
+type verification struct {
+	verified bool
+	checked  time.Time
+}
+
+var verifiedDomains = struct {
+	sync.Mutex
+	byDomain map[string]verification
+}{byDomain: make(map[string]verification)}
+
+//DomainVerified reports whether domain is a verified identity in SES and
+//so can be used as the sender of email
+func DomainVerified(domain string) (bool, error) {
+	domain = strings.ToLower(domain)
+	verifiedDomains.Lock()
+	cached, ok := verifiedDomains.byDomain[domain]
+	verifiedDomains.Unlock()
+	if ok && time.Since(cached.checked) < verificationTTL {
+		return cached.verified, nil
+	}
+
+	sess, err := getSession()
+	if nil != err {
+		return false, err
+	}
+	svc := ses.New(sess)
+	start := time.Now()
+	resp, err := svc.GetIdentityVerificationAttributes(&ses.GetIdentityVerificationAttributesInput{
+		Identities: aws.StringSlice([]string{domain}),
+	})
+	metrics.ObserveSES("verify", start, err)
+	if nil != err {
+		return false, err
+	}
+	attributes, ok := resp.VerificationAttributes[domain]
+	verified := ok && aws.StringValue(attributes.VerificationStatus) == ses.VerificationStatusSuccess
+
+	verifiedDomains.Lock()
+	verifiedDomains.byDomain[domain] = verification{verified: verified, checked: time.Now()}
+	verifiedDomains.Unlock()
+	return verified, nil
+}
+
+//SendRawEmail relays a complete message through SES to recipients,
+//returning the message id SES gave it
+func SendRawEmail(from string, recipients []string, message []byte) (string, error) {
+	sess, err := getSession()
+	if nil != err {
+		return "", err
+	}
+	svc := ses.New(sess)
+	start := time.Now()
+	resp, err := svc.SendRawEmail(&ses.SendRawEmailInput{
+		Source:       aws.String(from),
+		Destinations: aws.StringSlice(recipients),
+		RawMessage:   &ses.RawMessage{Data: message},
+	})
+	metrics.ObserveSES("send", start, err)
+	if nil != err {
+		return "", err
+	}
+	return aws.StringValue(resp.MessageId), nil
+}
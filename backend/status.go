@@ -0,0 +1,89 @@
+package backend
+
+/*
+    s3pop-server: An AWS S3 backed POP3 server
+	Copyright (C) 2018 James W Matheson
+	fractal.mango@gmail.com
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+import (
+	"sync"
+	"time"
+
+	"github.com/FractalJim/s3pop-server/metrics"
+)
+
+//SyncResult is the outcome of the last DownloadEmails call for a mailbox
+type SyncResult struct {
+	Time  time.Time `json:"time"`
+	OK    bool      `json:"ok"`
+	Error string    `json:"error,omitempty"`
+	//LastSuccess is zero if the mailbox has never synced successfully
+	LastSuccess time.Time `json:"lastSuccess,omitempty"`
+}
+
+var syncResults = struct {
+	sync.Mutex
+	byMailbox map[string]SyncResult
+}{byMailbox: make(map[string]SyncResult)}
+
+//recordSync keeps the result for mailboxes named in the config only, any
+//name a client logs in with is synced so the rest would grow without limit
+func recordSync(emailFolder string, err error) {
+	if !metrics.KnownMailbox(emailFolder) {
+		return
+	}
+	syncResults.Lock()
+	defer syncResults.Unlock()
+	result := syncResults.byMailbox[emailFolder]
+	result.Time = time.Now()
+	result.OK = nil == err
+	result.Error = ""
+	if nil != err {
+		result.Error = err.Error()
+	} else {
+		result.LastSuccess = result.Time
+	}
+	syncResults.byMailbox[emailFolder] = result
+}
+
+//SyncResults returns the last sync result for each mailbox named in the
+//config that has synced since the process started
+func SyncResults() map[string]SyncResult {
+	syncResults.Lock()
+	defer syncResults.Unlock()
+	results := make(map[string]SyncResult, len(syncResults.byMailbox))
+	for mailbox, result := range syncResults.byMailbox {
+		if !metrics.KnownMailbox(mailbox) {
+			//no longer named since a reload
+			delete(syncResults.byMailbox, mailbox)
+			continue
+		}
+		results[mailbox] = result
+	}
+	return results
+}
+
+//CheckCredentials confirms AWS credentials can be found without making a
+//request to AWS
+func CheckCredentials() error {
+	sess, err := getSession()
+	if nil != err {
+		return err
+	}
+	_, err = sess.Config.Credentials.Get()
+	return err
+}
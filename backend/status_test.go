@@ -0,0 +1,46 @@
+package backend
+
+/*
+    s3pop-server: An AWS S3 backed POP3 server
+	Copyright (C) 2018 James W Matheson
+	fractal.mango@gmail.com
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/FractalJim/s3pop-server/metrics"
+)
+
+func TestRecordSyncKnownMailboxes(t *testing.T) {
+	metrics.SetMailboxes([]string{"alice", "bob"})
+	defer metrics.SetMailboxes(nil)
+	recordSync("alice", nil)
+	recordSync("bob", errors.New("access denied"))
+	recordSync("mallory", nil)
+
+	results := SyncResults()
+	if len(results) != 2 || !results["alice"].OK || results["bob"].Error != "access denied" {
+		t.Fatalf("results = %+v, want alice and bob only", results)
+	}
+
+	metrics.SetMailboxes([]string{"alice"})
+	if results := SyncResults(); len(results) != 1 || !results["alice"].OK {
+		t.Errorf("results after reload = %+v, want alice only", results)
+	}
+}
@@ -0,0 +1,126 @@
+package backend
+
+/*
+    s3pop-server: An AWS S3 backed POP3 server
+	Copyright (C) 2018 James W Matheson
+	fractal.mango@gmail.com
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+//Acting on the SES verdicts of incoming email before clients see it
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/FractalJim/s3pop-server/mailutils"
+)
+
+//Actions for email that failed a check, in increasing order of severity
+const (
+	VERDICT_NONE       = "none"
+	VERDICT_TAG        = "tag"        //prefix the subject with SubjectTag
+	VERDICT_QUARANTINE = "quarantine" //file it in QuarantineFolder
+	VERDICT_HIDE       = "hide"       //leave it in S3 and never cache it
+)
+
+var verdictSeverity = map[string]int{
+	VERDICT_NONE:       0,
+	VERDICT_TAG:        1,
+	VERDICT_QUARANTINE: 2,
+	VERDICT_HIDE:       3,
+}
+
+const defaultQuarantineFolder = "quarantine"
+const defaultSubjectTag = "[SPAM]"
+
+//VerdictPolicy chooses what happens to email that failed one of the SES
+//checks, a verdict of fail for that check
+type VerdictPolicy struct {
+	Spam             string `json:"spam" yaml:"spam" toml:"spam"`
+	Virus            string `json:"virus" yaml:"virus" toml:"virus"`
+	SPF              string `json:"spf" yaml:"spf" toml:"spf"`
+	DKIM             string `json:"dkim" yaml:"dkim" toml:"dkim"`
+	DMARC            string `json:"dmarc" yaml:"dmarc" toml:"dmarc"`
+	QuarantineFolder string `json:"quarantineFolder" yaml:"quarantineFolder" toml:"quarantineFolder"`
+	SubjectTag       string `json:"subjectTag" yaml:"subjectTag" toml:"subjectTag"`
+}
+
+//ApplyDefaults fills in settings that were left out of the config
+func (p *VerdictPolicy) ApplyDefaults() {
+	for _, action := range p.actions() {
+		if *action == "" {
+			*action = VERDICT_NONE
+		}
+	}
+	if p.QuarantineFolder == "" {
+		p.QuarantineFolder = defaultQuarantineFolder
+	}
+	if p.SubjectTag == "" {
+		p.SubjectTag = defaultSubjectTag
+	}
+}
+
+//Validate checks the policy values are usable
+func (p *VerdictPolicy) Validate() error {
+	for _, action := range p.actions() {
+		if _, ok := verdictSeverity[*action]; !ok {
+			return fmt.Errorf("verdict action %q is not one of %s, %s, %s or %s",
+				*action, VERDICT_NONE, VERDICT_TAG, VERDICT_QUARANTINE, VERDICT_HIDE)
+		}
+	}
+	if !mailutils.ValidFolder(p.QuarantineFolder) {
+		return fmt.Errorf("quarantineFolder %q is not a usable folder name", p.QuarantineFolder)
+	}
+	return nil
+}
+
+func (p *VerdictPolicy) actions() []*string {
+	return []*string{&p.Spam, &p.Virus, &p.SPF, &p.DKIM, &p.DMARC}
+}
+
+//action returns the most severe action for the checks an email failed
+func (p *VerdictPolicy) action(verdicts *mailutils.Verdicts) string {
+	chosen := VERDICT_NONE
+	if nil == p {
+		return chosen
+	}
+	byCheck := map[string]string{"spam": p.Spam, "virus": p.Virus, "spf": p.SPF, "dkim": p.DKIM, "dmarc": p.DMARC}
+	for _, check := range verdicts.Failed() {
+		if verdictSeverity[byCheck[check]] > verdictSeverity[chosen] {
+			chosen = byCheck[check]
+		}
+	}
+	return chosen
+}
+
+//tagSubject prefixes the Subject header with tag, adding a Subject if
+//there is none
+func tagSubject(headers []string, tag string) []string {
+	for i, header := range headers {
+		name, value, ok := strings.Cut(header, ":")
+		if !ok || !strings.EqualFold(name, "Subject") {
+			continue
+		}
+		value = strings.TrimLeft(value, " ")
+		if strings.HasPrefix(value, tag) {
+			return headers
+		}
+		tagged := append([]string{}, headers...)
+		tagged[i] = name + ": " + tag + " " + value
+		return tagged
+	}
+	return append(headers, "Subject: "+tag)
+}
@@ -0,0 +1,389 @@
+package main
+
+/*
+    s3pop-server: An AWS S3 backed POP3 server
+	Copyright (C) 2018 James W Matheson
+	fractal.mango@gmail.com
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/FractalJim/s3pop-server/backend"
+	"github.com/FractalJim/s3pop-server/mailutils"
+)
+
+//EXIT_USAGE is returned when a subcommand is called with bad arguments
+const EXIT_USAGE = 64
+
+type command struct {
+	usage string
+	help  string
+	run   func(args []string) int
+}
+
+var commands map[string]*command
+
+func init() {
+	//assigned in init as the help command refers back to the table
+	commands = map[string]*command{
+		"serve": {
+			usage: "serve",
+			help:  "run the POP3 server (the default when no command is given)",
+			run:   serveCommand,
+		},
+		"sync": {
+			usage: "sync <mailbox>",
+			help:  "download new email for a mailbox from S3 into the local cache",
+			run:   syncCommand,
+		},
+		"list": {
+			usage: "list [-folder name] [mailbox]",
+			help:  "list cached mailboxes, or the folders and messages cached for a mailbox",
+			run:   listCommand,
+		},
+		"show": {
+			usage: "show [-folder name] <mailbox> <uid>",
+			help:  "print a cached message",
+			run:   showCommand,
+		},
+		"purge": {
+			usage: "purge [-days n] [-dry-run] [-folder name] <mailbox>",
+			help:  "remove messages older than n days from the local cache",
+			run:   purgeCommand,
+		},
+		"export": {
+			usage: "export [-format mboxrd|maildir] [-s3] [-folder name] [-since date] [-before date] <mailbox> <destination>",
+			help:  "write a mailbox's email to mbox files or a Maildir for other mail clients",
+			run:   exportCommand,
+		},
+		"import": {
+			usage: "import [-format auto|mbox|maildir|eml] [-folder name] [-dry-run] <mailbox> <source>",
+			help:  "upload email from an mbox file, a Maildir or a directory of .eml files to a mailbox",
+			run:   importCommand,
+		},
+		"expire": {
+			usage: "expire <mailbox>",
+			help:  "apply a mailbox's retention policy now",
+			run:   expireCommand,
+		},
+		"check-config": {
+			usage: "check-config",
+			help:  "validate the configuration and test access to the S3 bucket",
+			run:   checkConfigCommand,
+		},
+		"install-service": {
+			usage: "install-service [-user name] [-dir path] [-socket]",
+			help:  "write systemd unit files for running the server as a service",
+			run:   installService,
+		},
+		"help": {
+			usage: "help",
+			help:  "show this message",
+			run:   helpCommand,
+		},
+	}
+}
+
+//runCommand dispatches to the subcommand named in args, returning the exit
+//status for the process
+func runCommand(args []string) int {
+	global := flag.NewFlagSet(filepath.Base(os.Args[0]), flag.ContinueOnError)
+	global.StringVar(&configPathFlag, "config", "", "path of the config file")
+	global.Usage = func() { printUsage(global.Output()) }
+	if err := global.Parse(args); nil != err {
+		return EXIT_USAGE
+	}
+	args = global.Args()
+
+	if len(args) == 0 {
+		return serveCommand(args)
+	}
+	cmd, ok := commands[args[0]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown command: %s\n", args[0])
+		printUsage(os.Stderr)
+		return EXIT_USAGE
+	}
+	return cmd.run(args[1:])
+}
+
+func printUsage(out io.Writer) {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintf(out, "Usage: %s [--config path] <command> [arguments]\n\nCommands:\n", filepath.Base(os.Args[0]))
+	table := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	for _, name := range names {
+		fmt.Fprintf(table, "  %s\t%s\n", commands[name].usage, commands[name].help)
+	}
+	table.Flush()
+}
+
+func helpCommand(args []string) int {
+	printUsage(os.Stdout)
+	return EXIT_OK
+}
+
+//newFlagSet returns a flag set for a subcommand that prints the command's
+//usage line on error
+func newFlagSet(name string) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s %s\n", filepath.Base(os.Args[0]), commands[name].usage)
+		flags.PrintDefaults()
+	}
+	return flags
+}
+
+//parseArgs parses the flags for a subcommand and checks the number of
+//positional arguments is between min and max
+func parseArgs(flags *flag.FlagSet, args []string, min, max int) bool {
+	if err := flags.Parse(args); nil != err {
+		return false
+	}
+	if flags.NArg() < min || flags.NArg() > max {
+		flags.Usage()
+		return false
+	}
+	return true
+}
+
+func serveCommand(args []string) int {
+	flags := newFlagSet("serve")
+	if !parseArgs(flags, args, 0, 0) {
+		return EXIT_USAGE
+	}
+	config := loadConfig()
+	err := setupLogging(config.Logging)
+	if nil != err {
+		fmt.Fprintf(os.Stderr, "Error.. %s\n", err.Error())
+		return EXIT_STARTUP
+	}
+
+	server := newPopServer(config)
+	listeners, err := server.listen()
+	if err != nil {
+		slog.Error("could not listen", "error", err)
+		return EXIT_STARTUP
+	}
+	slog.Info("server started", "config", config.path)
+	return server.run(listeners)
+}
+
+func syncCommand(args []string) int {
+	flags := newFlagSet("sync")
+	if !parseArgs(flags, args, 1, 1) {
+		return EXIT_USAGE
+	}
+	config := loadConfig()
+	mailbox := flags.Arg(0)
+
+	err := backend.DownloadEmails(config.S3Bucket, mailbox, config.ingestOptions(mailbox))
+	if nil != err {
+		fmt.Fprintf(os.Stderr, "Could not download emails: %s\n", err.Error())
+		return EXIT_FAILURE
+	}
+	_, mailData, err := openMailbox(mailbox, "")
+	if nil != err {
+		fmt.Fprintf(os.Stderr, "Error.. %s\n", err.Error())
+		return EXIT_FAILURE
+	}
+	count, size := getStat(mailData, nil)
+	fmt.Printf("%s: %d messages (%d octets)\n", mailbox, count, size)
+	return EXIT_OK
+}
+
+func listCommand(args []string) int {
+	flags := newFlagSet("list")
+	folder := flags.String("folder", "", "list the messages in this folder instead of the top level")
+	if !parseArgs(flags, args, 0, 1) {
+		return EXIT_USAGE
+	}
+
+	table := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	defer table.Flush()
+
+	if flags.NArg() == 0 {
+		mailboxes, err := mailutils.ListMailboxes()
+		if nil != err {
+			fmt.Fprintf(os.Stderr, "Error.. %s\n", err.Error())
+			return EXIT_FAILURE
+		}
+		fmt.Fprintf(table, "MAILBOX\tMESSAGES\tOCTETS\n")
+		status := EXIT_OK
+		for _, mailbox := range mailboxes {
+			_, mailData, err := openMailbox(mailbox, "")
+			if nil != err {
+				//one broken cache should not hide the others
+				fmt.Fprintf(os.Stderr, "Error.. %s\n", err.Error())
+				status = EXIT_FAILURE
+				continue
+			}
+			count, size := getStat(mailData, nil)
+			fmt.Fprintf(table, "%s\t%d\t%d\n", mailbox, count, size)
+		}
+		return status
+	}
+
+	emailDir, mailData, err := openMailbox(flags.Arg(0), *folder)
+	if nil != err {
+		fmt.Fprintf(os.Stderr, "Error.. %s\n", err.Error())
+		return EXIT_FAILURE
+	}
+	folders, err := mailutils.ListFolders(emailDir)
+	if nil != err {
+		fmt.Fprintf(os.Stderr, "Error.. %s\n", err.Error())
+		return EXIT_FAILURE
+	}
+	fmt.Fprintf(table, "MSG\tUID\tOCTETS\tREAD\tFAILED\n")
+	for id, mailItem := range mailData {
+		failed := strings.Join(mailItem.Verdicts.Failed(), ",")
+		if failed == "" {
+			failed = "-"
+		}
+		fmt.Fprintf(table, "%d\t%s\t%d\t%t\t%s\n", id+1, mailItem.Name, mailItem.TotalSize, mailItem.Read, failed)
+	}
+	if len(folders) > 0 {
+		fmt.Fprintf(table, "\nFOLDER\n")
+		for _, name := range folders {
+			fmt.Fprintf(table, "%s\n", path.Join(*folder, name))
+		}
+	}
+	return EXIT_OK
+}
+
+func showCommand(args []string) int {
+	flags := newFlagSet("show")
+	folder := flags.String("folder", "", "the folder the message is in")
+	if !parseArgs(flags, args, 2, 2) {
+		return EXIT_USAGE
+	}
+	emailDir, mailData, err := openMailbox(flags.Arg(0), *folder)
+	if nil != err {
+		fmt.Fprintf(os.Stderr, "Error.. %s\n", err.Error())
+		return EXIT_FAILURE
+	}
+	uid := flags.Arg(1)
+
+	//only show files the index knows about rather than any path given
+	for _, mailItem := range mailData {
+		if mailItem.Name != uid {
+			continue
+		}
+		fileData, err := os.Open(filepath.Join(emailDir, mailItem.Name))
+		if nil != err {
+			fmt.Fprintf(os.Stderr, "Error.. %s\n", err.Error())
+			return EXIT_FAILURE
+		}
+		defer fileData.Close()
+		io.Copy(os.Stdout, fileData)
+		return EXIT_OK
+	}
+	fmt.Fprintf(os.Stderr, "No message with uid %s in %s\n", uid, path.Join(flags.Arg(0), *folder))
+	return EXIT_FAILURE
+}
+
+func purgeCommand(args []string) int {
+	flags := newFlagSet("purge")
+	days := flags.Int("days", 30, "remove messages cached more than this many days ago")
+	dryRun := flags.Bool("dry-run", false, "list the messages that would be removed")
+	folder := flags.String("folder", "", "purge this folder instead of the top level")
+	if !parseArgs(flags, args, 1, 1) {
+		return EXIT_USAGE
+	}
+	emailDir, mailData, err := openMailbox(flags.Arg(0), *folder)
+	if nil != err {
+		fmt.Fprintf(os.Stderr, "Error.. %s\n", err.Error())
+		return EXIT_FAILURE
+	}
+	cutoff := time.Now().AddDate(0, 0, -*days)
+
+	expired := make(map[int]struct{})
+	for id, mailItem := range mailData {
+		info, err := os.Stat(filepath.Join(emailDir, mailItem.Name))
+		if nil != err || info.ModTime().After(cutoff) {
+			continue
+		}
+		expired[id] = struct{}{}
+		if *dryRun {
+			fmt.Printf("%s\t%s\n", mailItem.Name, info.ModTime().Format(time.RFC3339))
+		}
+	}
+	if *dryRun {
+		fmt.Printf("%d messages would be removed\n", len(expired))
+		return EXIT_OK
+	}
+	//the index is left alone so purged messages are not downloaded again
+	removed, failed := deleteItems(emailDir, mailData, expired)
+	fmt.Printf("%d messages removed, %d failed\n", removed, failed)
+	if failed > 0 {
+		return EXIT_FAILURE
+	}
+	return EXIT_OK
+}
+
+//openMailbox returns the cache directory of a folder of a mailbox and the
+//messages in it, the empty folder being the top level
+func openMailbox(mailbox string, folder string) (string, []*mailutils.MailData, error) {
+	emailDir, err := mailutils.GetEmailDir(mailbox)
+	if nil == err {
+		emailDir, err = mailutils.GetFolderDir(emailDir, folder)
+	}
+	if nil != err {
+		return "", nil, err
+	}
+	mailData, err := mailutils.ListMailData(emailDir)
+	return emailDir, mailData, err
+}
+
+func checkConfigCommand(args []string) int {
+	flags := newFlagSet("check-config")
+	if !parseArgs(flags, args, 0, 0) {
+		return EXIT_USAGE
+	}
+	config, err := readConfig()
+	if nil != err {
+		fmt.Fprintf(os.Stderr, "Config: %s\n", err.Error())
+		return EXIT_FAILURE
+	}
+	if config.path == "" {
+		fmt.Println("Config: ok (from environment)")
+	} else {
+		fmt.Printf("Config: %s ok\n", config.path)
+	}
+
+	err = backend.CheckBucket(config.S3Bucket)
+	if nil != err {
+		fmt.Fprintf(os.Stderr, "S3 bucket %s: %s\n", config.S3Bucket, err.Error())
+		return EXIT_FAILURE
+	}
+	fmt.Printf("S3 bucket %s: ok\n", config.S3Bucket)
+	return EXIT_OK
+}
@@ -0,0 +1,607 @@
+package main
+
+/*
+    s3pop-server: An AWS S3 backed POP3 server
+	Copyright (C) 2018 James W Matheson
+	fractal.mango@gmail.com
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+
+	"github.com/FractalJim/s3pop-server/backend"
+	"github.com/FractalJim/s3pop-server/mailutils"
+)
+
+const defaultport = 5110
+const defaultShutdownTimeout = 30
+
+//configName is the base name of the config file, searched for with each
+//of the configExtensions
+const configName = "server-config"
+const configDirName = "s3pop-server"
+
+//envPrefix is prepended to the upper snake case form of each config
+//field's name to give the environment variable that overrides it
+const envPrefix = "S3POP_"
+
+var configExtensions = []string{".json", ".yaml", ".yml", ".toml"}
+
+//configPathFlag is set by the --config option, when empty the config file
+//is searched for in configSearchDirs
+var configPathFlag string
+
+type ServerConfig struct {
+	//Port is used for a single listener on the default address when no
+	//Listeners are configured
+	Port            int              `json:"port" yaml:"port" toml:"port"`
+	Listeners       []ListenerConfig `json:"listeners" yaml:"listeners" toml:"listeners"`
+	S3Bucket        string           `json:"s3Bucket" yaml:"s3Bucket" toml:"s3Bucket"`
+	ShutdownTimeout int              `json:"shutdownTimeout" yaml:"shutdownTimeout" toml:"shutdownTimeout"`
+
+	//session limits, timeouts are in seconds and a limit of zero means
+	//unlimited
+	IdleTimeout      int `json:"idleTimeout" yaml:"idleTimeout" toml:"idleTimeout"`
+	WriteTimeout     int `json:"writeTimeout" yaml:"writeTimeout" toml:"writeTimeout"`
+	MaxSessions      int `json:"maxSessions" yaml:"maxSessions" toml:"maxSessions"`
+	MaxSessionsPerIP int `json:"maxSessionsPerIP" yaml:"maxSessionsPerIP" toml:"maxSessionsPerIP"`
+	MaxLineLength    int `json:"maxLineLength" yaml:"maxLineLength" toml:"maxLineLength"`
+	//LoginDelay is the least time in seconds between POP3 logins to a
+	//mailbox (RFC 2449 LOGIN-DELAY), zero for none
+	LoginDelay int `json:"loginDelay" yaml:"loginDelay" toml:"loginDelay"`
+
+	Logging LoggingConfig `json:"logging" yaml:"logging" toml:"logging"`
+
+	//DowngradeHeaders rewrites UTF-8 headers as RFC 2047 encoded-words
+	//in RETR and TOP responses to clients that have not sent UTF8
+	DowngradeHeaders bool `json:"downgradeHeaders" yaml:"downgradeHeaders" toml:"downgradeHeaders"`
+
+	//PopFolder is the folder POP3 clients are given, a sub-prefix of the
+	//mailbox in S3 such as archive or archive/2024. Empty for the top
+	//level.
+	PopFolder string `json:"popFolder" yaml:"popFolder" toml:"popFolder"`
+
+	//VerdictPolicy decides what happens to incoming email that failed the
+	//SES spam, virus or authentication checks
+	VerdictPolicy backend.VerdictPolicy `json:"verdictPolicy" yaml:"verdictPolicy" toml:"verdictPolicy"`
+	//Filters are the Sieve scripts run over each mailbox's new email,
+	//keyed by mailbox. Each is a local path or s3://bucket/key.
+	Filters map[string]string `json:"filters" yaml:"filters" toml:"filters"`
+	//Retention decides when email leaves each mailbox, keyed by mailbox.
+	//Mailboxes without a policy keep their email until it is deleted.
+	Retention map[string]backend.RetentionPolicy `json:"retention" yaml:"retention" toml:"retention"`
+	//Quotas limit the email cached for each mailbox, keyed by mailbox
+	Quotas map[string]backend.Quota `json:"quotas" yaml:"quotas" toml:"quotas"`
+
+	//SenderDomains lists the domains each mailbox may send from through
+	//the SMTP submission listener, keyed by mailbox. The domains must
+	//also be verified in SES.
+	SenderDomains map[string][]string `json:"senderDomains" yaml:"senderDomains" toml:"senderDomains"`
+	//SenderAliases lists the local parts each mailbox may send as besides
+	//its own name, keyed by mailbox
+	SenderAliases map[string][]string `json:"senderAliases" yaml:"senderAliases" toml:"senderAliases"`
+	//SentFolder is the folder of the sender's mailbox a copy of each sent
+	//message is stored in, no copy is kept when it is empty
+	SentFolder string `json:"sentFolder" yaml:"sentFolder" toml:"sentFolder"`
+	//MaxMessageSize is the largest message accepted for sending, in octets
+	MaxMessageSize int `json:"maxMessageSize" yaml:"maxMessageSize" toml:"maxMessageSize"`
+
+	//AdminAddress is the host:port of the HTTP listener for metrics, it
+	//is not started when empty
+	AdminAddress string `json:"adminAddress" yaml:"adminAddress" toml:"adminAddress"`
+	//Mailboxes are given their own label in the metrics, as are those
+	//with a filter, retention policy, quota or sender domains
+	Mailboxes []string `json:"mailboxes" yaml:"mailboxes" toml:"mailboxes"`
+
+	//file the config was read from, empty if only the environment was used
+	path string
+}
+
+//ConfigError describes a problem with a config file, Line is zero when the
+//position of the problem is not known
+type ConfigError struct {
+	Path string
+	Line int
+	Msg  string
+}
+
+func (e *ConfigError) Error() string {
+	if e.Line > 0 {
+		return fmt.Sprintf("%s:%d: %s", e.Path, e.Line, e.Msg)
+	}
+	return e.Path + ": " + e.Msg
+}
+
+//namedMailboxes lists the mailboxes the config names, either in Mailboxes
+//or by giving them their own settings
+func (config *ServerConfig) namedMailboxes() []string {
+	names := append([]string{}, config.Mailboxes...)
+	for mailbox := range config.Filters {
+		names = append(names, mailbox)
+	}
+	for mailbox := range config.Retention {
+		names = append(names, mailbox)
+	}
+	for mailbox := range config.Quotas {
+		names = append(names, mailbox)
+	}
+	for mailbox := range config.SenderDomains {
+		names = append(names, mailbox)
+	}
+	for mailbox := range config.SenderAliases {
+		names = append(names, mailbox)
+	}
+	return names
+}
+
+//senderAllowed says whether a mailbox may send as address, the local part
+//must be the mailbox name or one of its aliases and the domain one of its
+//sender domains
+func (config *ServerConfig) senderAllowed(mailbox string, address string) bool {
+	at := strings.LastIndexByte(address, '@')
+	if at <= 0 {
+		return false
+	}
+	localPart, domain := address[:at], address[at+1:]
+	localParts := append([]string{mailbox}, config.SenderAliases[mailbox]...)
+	return includesFold(localParts, localPart) && includesFold(config.SenderDomains[mailbox], domain)
+}
+
+//includesFold reports whether values holds value, ignoring case
+func includesFold(values []string, value string) bool {
+	for _, candidate := range values {
+		if strings.EqualFold(candidate, value) {
+			return true
+		}
+	}
+	return false
+}
+
+//ingestOptions are what is done with a mailbox's new email when it is
+//downloaded
+func (config *ServerConfig) ingestOptions(mailbox string) *backend.IngestOptions {
+	options := &backend.IngestOptions{
+		Policy:       &config.VerdictPolicy,
+		Filter:       config.Filters[mailbox],
+		NoticeFolder: config.PopFolder,
+	}
+	if quota, ok := config.Quotas[mailbox]; ok {
+		options.Quota = &quota
+	}
+	//redirected email is sent from the mailbox's own address
+	if domains := config.SenderDomains[mailbox]; len(domains) > 0 {
+		options.RedirectFrom = mailbox + "@" + domains[0]
+	}
+	return options
+}
+
+func newConfig() *ServerConfig {
+	return &ServerConfig{
+		Port:             defaultport,
+		ShutdownTimeout:  defaultShutdownTimeout,
+		IdleTimeout:      defaultIdleTimeout,
+		WriteTimeout:     defaultWriteTimeout,
+		MaxSessions:      defaultMaxSessions,
+		MaxSessionsPerIP: defaultMaxSessionsPerIP,
+		MaxLineLength:    defaultMaxLineLength,
+		MaxMessageSize:   defaultMaxMessageSize,
+		SentFolder:       defaultSentFolder,
+	}
+}
+
+//loadConfig reads the config or exits the program if it is unusable
+func loadConfig() *ServerConfig {
+	config, err := readConfig()
+	if nil != err {
+		log.Fatal(err)
+	}
+	return config
+}
+
+//readConfig finds and parses the config file, applies any environment
+//overrides and validates the result
+func readConfig() (*ServerConfig, error) {
+	config := newConfig()
+	configPath, err := findConfig()
+	if nil != err {
+		return nil, err
+	}
+	if configPath != "" {
+		err = parseConfigFile(configPath, config)
+		if nil != err {
+			return nil, err
+		}
+		config.path = configPath
+	}
+	err = applyEnvOverrides(envPrefix, reflect.ValueOf(config).Elem())
+	if nil != err {
+		return nil, err
+	}
+	config.applyDefaults()
+	err = config.validate()
+	if nil != err {
+		if configPath == "" {
+			return nil, fmt.Errorf("no config file found in %s and %s",
+				strings.Join(configSearchDirs(), ", "), err.Error())
+		}
+		return nil, &ConfigError{Path: configPath, Msg: err.Error()}
+	}
+	return config, nil
+}
+
+//configSearchDirs lists the directories searched for a config file in
+//order of preference: the working directory, the XDG config directories
+//and finally /etc
+func configSearchDirs() []string {
+	dirs := []string{"."}
+	configHome := os.Getenv("XDG_CONFIG_HOME")
+	if configHome == "" {
+		if home, err := os.UserHomeDir(); nil == err {
+			configHome = filepath.Join(home, ".config")
+		}
+	}
+	if configHome != "" {
+		dirs = append(dirs, filepath.Join(configHome, configDirName))
+	}
+	configDirs := os.Getenv("XDG_CONFIG_DIRS")
+	if configDirs == "" {
+		configDirs = "/etc/xdg"
+	}
+	for _, dir := range filepath.SplitList(configDirs) {
+		dirs = append(dirs, filepath.Join(dir, configDirName))
+	}
+	return append(dirs, filepath.Join("/etc", configDirName))
+}
+
+//findConfig returns the path of the config file to use, or an empty path
+//if there is none
+func findConfig() (string, error) {
+	if configPathFlag != "" {
+		_, err := os.Stat(configPathFlag)
+		if nil != err {
+			return "", err
+		}
+		return filepath.Abs(configPathFlag)
+	}
+	for _, dir := range configSearchDirs() {
+		for _, ext := range configExtensions {
+			candidate := filepath.Join(dir, configName+ext)
+			if _, err := os.Stat(candidate); nil == err {
+				return filepath.Abs(candidate)
+			}
+		}
+	}
+	return "", nil
+}
+
+func parseConfigFile(configPath string, config *ServerConfig) error {
+	data, err := ioutil.ReadFile(configPath)
+	if nil != err {
+		return err
+	}
+	switch strings.ToLower(filepath.Ext(configPath)) {
+	case ".yaml", ".yml":
+		return parseYAMLConfig(configPath, data, config)
+	case ".toml":
+		return parseTOMLConfig(configPath, data, config)
+	default:
+		return parseJSONConfig(configPath, data, config)
+	}
+}
+
+func parseJSONConfig(configPath string, data []byte, config *ServerConfig) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(config)
+	if nil == err {
+		return nil
+	}
+
+	configErr := &ConfigError{Path: configPath, Msg: err.Error()}
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &syntaxErr) {
+		configErr.Line = lineAtOffset(data, syntaxErr.Offset)
+	} else if errors.As(err, &typeErr) {
+		configErr.Line = lineAtOffset(data, typeErr.Offset)
+		configErr.Msg = fmt.Sprintf("%s should be %s, found %s", typeErr.Field, typeErr.Type, typeErr.Value)
+	} else if field := strings.TrimPrefix(err.Error(), "json: unknown field "); field != err.Error() {
+		field, _ = strconv.Unquote(field)
+		configErr.Line = lineOfKey(data, field)
+		configErr.Msg = "unknown field " + field
+	}
+	return configErr
+}
+
+var yamlLine = regexp.MustCompile(`^(?:yaml: )?line (\d+): (.*)$`)
+var yamlUnknownField = regexp.MustCompile(`^field (\S+) not found in type .*$`)
+
+func parseYAMLConfig(configPath string, data []byte, config *ServerConfig) error {
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	err := decoder.Decode(config)
+	if nil == err || errors.Is(err, io.EOF) {
+		return nil
+	}
+
+	messages := []string{err.Error()}
+	var typeErr *yaml.TypeError
+	if errors.As(err, &typeErr) {
+		messages = typeErr.Errors
+	}
+	//report the first problem, yaml already includes its line number
+	configErr := &ConfigError{Path: configPath, Msg: messages[0]}
+	if match := yamlLine.FindStringSubmatch(messages[0]); nil != match {
+		configErr.Line, _ = strconv.Atoi(match[1])
+		configErr.Msg = yamlUnknownField.ReplaceAllString(match[2], "unknown field $1")
+	}
+	return configErr
+}
+
+func parseTOMLConfig(configPath string, data []byte, config *ServerConfig) error {
+	meta, err := toml.Decode(string(data), config)
+	if nil != err {
+		configErr := &ConfigError{Path: configPath, Msg: err.Error()}
+		var parseErr toml.ParseError
+		if errors.As(err, &parseErr) {
+			configErr.Line = parseErr.Position.Line
+			configErr.Msg = parseErr.Message
+		}
+		return configErr
+	}
+	if undecoded := meta.Undecoded(); len(undecoded) > 0 {
+		field := undecoded[0].String()
+		return &ConfigError{
+			Path: configPath,
+			Line: lineOfKey(data, undecoded[0][len(undecoded[0])-1]),
+			Msg:  "unknown field " + field,
+		}
+	}
+	return nil
+}
+
+func lineAtOffset(data []byte, offset int64) int {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	return bytes.Count(data[:offset], []byte("\n")) + 1
+}
+
+//lineOfKey finds the first line defining key, for errors where the parser
+//does not give a position
+func lineOfKey(data []byte, key string) int {
+	pattern := regexp.MustCompile(`(?m)^[ \t]*"?` + regexp.QuoteMeta(key) + `"?[ \t]*[:=]|"` + regexp.QuoteMeta(key) + `"\s*:`)
+	location := pattern.FindIndex(data)
+	if nil == location {
+		return 0
+	}
+	return lineAtOffset(data, int64(location[0]))
+}
+
+//envName converts a config field name such as s3Bucket to the environment
+//variable that overrides it, S3POP_S3_BUCKET
+func envName(prefix, fieldName string) string {
+	var name strings.Builder
+	name.WriteString(prefix)
+	runes := []rune(fieldName)
+	for i, r := range runes {
+		if i > 0 && unicode.IsUpper(r) && (unicode.IsLower(runes[i-1]) ||
+			(i+1 < len(runes) && unicode.IsLower(runes[i+1]))) {
+			name.WriteRune('_')
+		}
+		name.WriteRune(unicode.ToUpper(r))
+	}
+	return name.String()
+}
+
+//applyEnvOverrides sets each exported field of the struct from its
+//environment variable if present. Nested structs use the field name as a
+//further prefix, values that are not simple scalars are given as JSON.
+func applyEnvOverrides(prefix string, config reflect.Value) error {
+	configType := config.Type()
+	for i := 0; i < configType.NumField(); i++ {
+		field := configType.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		fieldName := strings.Split(field.Tag.Get("json"), ",")[0]
+		if fieldName == "" || fieldName == "-" {
+			fieldName = field.Name
+		}
+		name := envName(prefix, fieldName)
+		value := config.Field(i)
+
+		if value.Kind() == reflect.Struct {
+			err := applyEnvOverrides(name+"_", value)
+			if nil != err {
+				return err
+			}
+			continue
+		}
+		envValue, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		err := setFromEnv(value, envValue)
+		if nil != err {
+			return fmt.Errorf("environment variable %s: %s", name, err.Error())
+		}
+	}
+	return nil
+}
+
+func setFromEnv(value reflect.Value, envValue string) error {
+	switch value.Kind() {
+	case reflect.String:
+		value.SetString(envValue)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		parsed, err := strconv.ParseInt(envValue, 10, value.Type().Bits())
+		if nil != err {
+			return err
+		}
+		value.SetInt(parsed)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		parsed, err := strconv.ParseUint(envValue, 10, value.Type().Bits())
+		if nil != err {
+			return err
+		}
+		value.SetUint(parsed)
+	case reflect.Bool:
+		parsed, err := strconv.ParseBool(envValue)
+		if nil != err {
+			return err
+		}
+		value.SetBool(parsed)
+	case reflect.Float32, reflect.Float64:
+		parsed, err := strconv.ParseFloat(envValue, value.Type().Bits())
+		if nil != err {
+			return err
+		}
+		value.SetFloat(parsed)
+	default:
+		return json.Unmarshal([]byte(envValue), value.Addr().Interface())
+	}
+	return nil
+}
+
+//applyDefaults fills in settings that were left out of the config
+func (config *ServerConfig) applyDefaults() {
+	config.Logging.applyDefaults()
+	config.VerdictPolicy.ApplyDefaults()
+	for mailbox, policy := range config.Retention {
+		policy.ApplyDefaults()
+		config.Retention[mailbox] = policy
+	}
+	for mailbox, quota := range config.Quotas {
+		quota.ApplyDefaults()
+		config.Quotas[mailbox] = quota
+	}
+	if len(config.Listeners) == 0 {
+		config.Listeners = []ListenerConfig{{Port: config.Port}}
+	}
+	for i := range config.Listeners {
+		listener := &config.Listeners[i]
+		if listener.Address == "" {
+			listener.Address = defaultBindAddress
+		}
+		if listener.Port == 0 {
+			listener.Port = defaultport
+		}
+		if listener.TLS == "" {
+			listener.TLS = TLS_NONE
+		}
+		if listener.Protocol == "" {
+			listener.Protocol = PROTOCOL_POP3
+		}
+	}
+}
+
+//validate checks the config values are usable
+func (config *ServerConfig) validate() error {
+	seen := make(map[string]struct{}, len(config.Listeners))
+	for i := range config.Listeners {
+		listener := &config.Listeners[i]
+		err := listener.validate()
+		if nil != err {
+			return fmt.Errorf("listener %d: %s", i+1, err.Error())
+		}
+		if _, dup := seen[listener.addr()]; dup {
+			return fmt.Errorf("listener %d: %s is configured twice", i+1, listener.addr())
+		}
+		seen[listener.addr()] = struct{}{}
+	}
+	if config.S3Bucket == "" {
+		return errors.New("s3Bucket is not set")
+	}
+	if config.ShutdownTimeout < 0 {
+		return errors.New("shutdownTimeout must not be negative")
+	}
+	if config.IdleTimeout < minIdleTimeout {
+		return fmt.Errorf("idleTimeout must be at least %d seconds (RFC 1939)", minIdleTimeout)
+	}
+	if config.WriteTimeout < 0 || config.MaxSessions < 0 || config.MaxSessionsPerIP < 0 || config.LoginDelay < 0 {
+		return errors.New("writeTimeout, maxSessions, maxSessionsPerIP and loginDelay must not be negative")
+	}
+	if config.MaxLineLength < 255 {
+		return errors.New("maxLineLength must be at least 255 (RFC 2449)")
+	}
+	if config.MaxMessageSize <= 0 {
+		return errors.New("maxMessageSize must be more than 0")
+	}
+	if !mailutils.ValidFolder(config.PopFolder) {
+		return fmt.Errorf("popFolder %q is not a usable folder name", config.PopFolder)
+	}
+	if !mailutils.ValidFolder(config.SentFolder) {
+		return fmt.Errorf("sentFolder %q is not a usable folder name", config.SentFolder)
+	}
+	err := config.Logging.validate()
+	if nil != err {
+		return err
+	}
+	err = config.VerdictPolicy.Validate()
+	if nil != err {
+		return fmt.Errorf("verdictPolicy: %s", err.Error())
+	}
+	for mailbox, policy := range config.Retention {
+		err = policy.Validate()
+		if nil != err {
+			return fmt.Errorf("retention: %s: %s", mailbox, err.Error())
+		}
+	}
+	for mailbox, quota := range config.Quotas {
+		err = quota.Validate()
+		if nil != err {
+			return fmt.Errorf("quotas: %s: %s", mailbox, err.Error())
+		}
+	}
+	for mailbox, aliases := range config.SenderAliases {
+		for _, alias := range aliases {
+			if alias == "" || strings.ContainsAny(alias, "@<> ") {
+				return fmt.Errorf("senderAliases: %s: %q is not the local part of an address", mailbox, alias)
+			}
+		}
+	}
+	for mailbox, location := range config.Filters {
+		err = backend.CheckFilterLocation(location)
+		if nil != err {
+			return fmt.Errorf("filters: %s: %s", mailbox, err.Error())
+		}
+	}
+	if config.AdminAddress != "" {
+		_, _, err = net.SplitHostPort(config.AdminAddress)
+		if nil != err {
+			return fmt.Errorf("adminAddress: %s", err.Error())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package main
+
+/*
+    s3pop-server: An AWS S3 backed POP3 server
+	Copyright (C) 2018 James W Matheson
+	fractal.mango@gmail.com
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+
+import "testing"
+
+func TestSenderAllowed(t *testing.T) {
+	config := &ServerConfig{
+		SenderDomains: map[string][]string{"alice": {"example.com", "example.org"}, "bob": {"example.com"}},
+		SenderAliases: map[string][]string{"alice": {"info"}},
+	}
+	tests := []struct {
+		mailbox string
+		address string
+		allowed bool
+	}{
+		{"alice", "alice@example.com", true},
+		{"alice", "Alice@EXAMPLE.org", true},
+		{"alice", "info@example.com", true},
+		{"alice", "bob@example.com", false},
+		{"alice", "alice@example.net", false},
+		{"alice", "alice", false},
+		{"alice", "@example.com", false},
+		{"bob", "bob@example.com", true},
+		{"bob", "info@example.com", false},
+		{"carol", "carol@example.com", false},
+	}
+	for _, test := range tests {
+		if allowed := config.senderAllowed(test.mailbox, test.address); allowed != test.allowed {
+			t.Errorf("senderAllowed(%q, %q) = %v, want %v", test.mailbox, test.address, allowed, test.allowed)
+		}
+	}
+}
@@ -0,0 +1,497 @@
+package main
+
+/*
+    s3pop-server: An AWS S3 backed POP3 server
+	Copyright (C) 2018 James W Matheson
+	fractal.mango@gmail.com
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+//Exporting a mailbox to mboxrd or Maildir for other mail clients
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/FractalJim/s3pop-server/backend"
+	"github.com/FractalJim/s3pop-server/mailutils"
+)
+
+const (
+	EXPORT_MBOXRD  = "mboxrd"
+	EXPORT_MAILDIR = "maildir"
+)
+
+//exportMessage is an email to export, from the cache or from S3
+type exportMessage struct {
+	folder  string
+	arrived time.Time
+	//data is the cached metadata with the email's flags, nil for email
+	//that has not been cached
+	data *mailutils.MailData
+	read func() ([]byte, error)
+}
+
+//flags returns the IMAP flags of the message, \Seen first
+func (m *exportMessage) flags() []string {
+	flags := make([]string, 0)
+	if nil == m.data {
+		return flags
+	}
+	if m.data.Read {
+		flags = append(flags, `\Seen`)
+	}
+	for _, flag := range m.data.Flags {
+		if isKeyword(flag) {
+			flags = append(flags, flag)
+		}
+	}
+	return flags
+}
+
+//exportWriter writes exported email in one of the export formats
+type exportWriter interface {
+	write(message *exportMessage, content []byte) error
+	close() error
+}
+
+func exportCommand(args []string) int {
+	flags := newFlagSet("export")
+	format := flags.String("format", EXPORT_MBOXRD, "mboxrd or maildir")
+	fromS3 := flags.Bool("s3", false, "export the email stored in S3 rather than the local cache")
+	folder := flags.String("folder", "", "export only this folder and the folders in it, INBOX for the top level")
+	since := flags.String("since", "", "export only email that arrived on or after this date (YYYY-MM-DD)")
+	before := flags.String("before", "", "export only email that arrived before this date (YYYY-MM-DD)")
+	if !parseArgs(flags, args, 2, 2) {
+		return EXIT_USAGE
+	}
+	mailbox, destination := flags.Arg(0), flags.Arg(1)
+	if *format != EXPORT_MBOXRD && *format != EXPORT_MAILDIR {
+		fmt.Fprintf(os.Stderr, "Unknown format %s, use %s or %s\n", *format, EXPORT_MBOXRD, EXPORT_MAILDIR)
+		return EXIT_USAGE
+	}
+	if *folder != imapInbox && !mailutils.ValidFolder(*folder) {
+		fmt.Fprintf(os.Stderr, "Folder %q is not a usable folder name\n", *folder)
+		return EXIT_USAGE
+	}
+	var from, to time.Time
+	for _, date := range []struct {
+		text  string
+		value *time.Time
+	}{{*since, &from}, {*before, &to}} {
+		if date.text == "" {
+			continue
+		}
+		parsed, err := time.ParseInLocation("2006-01-02", date.text, time.Local)
+		if nil != err {
+			fmt.Fprintf(os.Stderr, "Date %q is not YYYY-MM-DD\n", date.text)
+			return EXIT_USAGE
+		}
+		*date.value = parsed
+	}
+
+	var messages []*exportMessage
+	var err error
+	if *fromS3 {
+		messages, err = s3Messages(loadConfig().S3Bucket, mailbox)
+	} else {
+		messages, err = cachedMessages(mailbox)
+	}
+	if nil != err {
+		fmt.Fprintf(os.Stderr, "Error.. %s\n", err.Error())
+		return EXIT_FAILURE
+	}
+
+	var writer exportWriter
+	if *format == EXPORT_MAILDIR {
+		writer = newMaildirWriter(destination)
+	} else {
+		writer = newMboxWriter(destination)
+	}
+	exported := 0
+	status := EXIT_OK
+	for _, message := range messages {
+		if !exportFolder(message.folder, *folder) ||
+			(!from.IsZero() && message.arrived.Before(from)) ||
+			(!to.IsZero() && !message.arrived.Before(to)) {
+			continue
+		}
+		content, err := message.read()
+		if nil == err {
+			err = writer.write(message, content)
+		}
+		if nil != err {
+			fmt.Fprintf(os.Stderr, "Error.. %s\n", err.Error())
+			status = EXIT_FAILURE
+			if errors.Is(err, os.ErrExist) {
+				//the destination is not ours to add to
+				break
+			}
+			continue
+		}
+		exported++
+	}
+	err = writer.close()
+	if nil != err {
+		fmt.Fprintf(os.Stderr, "Error.. %s\n", err.Error())
+		status = EXIT_FAILURE
+	}
+	fmt.Printf("%d messages exported to %s\n", exported, destination)
+	return status
+}
+
+//exportFolder reports whether email in folder is wanted when the user
+//asked for wanted, which is empty for every folder
+func exportFolder(folder, wanted string) bool {
+	switch wanted {
+	case "":
+		return true
+	case imapInbox:
+		return folder == ""
+	}
+	return folder == wanted || strings.HasPrefix(folder, wanted+"/")
+}
+
+//cachedMessages lists the email cached for a mailbox, folder by folder
+//in id order. The file's time is when the email arrived, as for purge.
+func cachedMessages(mailbox string) ([]*exportMessage, error) {
+	emailDir, err := mailutils.GetEmailDir(mailbox)
+	if nil != err {
+		return nil, err
+	}
+	folders, err := mailutils.ListFolders(emailDir)
+	if nil != err {
+		return nil, err
+	}
+	messages := make([]*exportMessage, 0)
+	for _, folder := range append([]string{""}, folders...) {
+		folderDir, err := mailutils.GetFolderDir(emailDir, folder)
+		if nil != err {
+			return nil, err
+		}
+		mailData, err := mailutils.ListMailData(folderDir)
+		if nil != err {
+			return nil, err
+		}
+		sort.Slice(mailData, func(i, j int) bool { return mailData[i].ID < mailData[j].ID })
+		for _, data := range mailData {
+			filename := filepath.Join(folderDir, data.Name)
+			info, err := os.Stat(filename)
+			if nil != err {
+				return nil, err
+			}
+			messages = append(messages, &exportMessage{
+				folder:  folder,
+				arrived: info.ModTime(),
+				data:    data,
+				read:    func() ([]byte, error) { return ioutil.ReadFile(filename) },
+			})
+		}
+	}
+	return messages, nil
+}
+
+//s3Messages lists the email stored in S3 for a mailbox, with the flags of
+//any that are also cached
+func s3Messages(bucket, mailbox string) ([]*exportMessage, error) {
+	emails, err := backend.ListEmails(bucket, mailbox)
+	if nil != err {
+		return nil, err
+	}
+	cached := make(map[string]*mailutils.MailData)
+	if cachedList, err := cachedMessages(mailbox); nil == err {
+		for _, message := range cachedList {
+			cached[message.data.ObjectKey()] = message.data
+		}
+	}
+	sort.SliceStable(emails, func(i, j int) bool {
+		if emails[i].Folder != emails[j].Folder {
+			return emails[i].Folder < emails[j].Folder
+		}
+		return emails[i].LastModified.Before(emails[j].LastModified)
+	})
+	messages := make([]*exportMessage, 0, len(emails))
+	for _, email := range emails {
+		email := email
+		messages = append(messages, &exportMessage{
+			folder:  email.Folder,
+			arrived: email.LastModified,
+			data:    cached[email.Key],
+			read:    func() ([]byte, error) { return backend.FetchEmail(bucket, mailbox, email) },
+		})
+	}
+	return messages, nil
+}
+
+//unixLines converts CRLF line endings to LF as both formats expect,
+//ending the message with a line break
+func unixLines(content []byte) []byte {
+	content = bytes.ReplaceAll(content, []byte("\r\n"), []byte("\n"))
+	if len(content) > 0 && content[len(content)-1] != '\n' {
+		content = append(content, '\n')
+	}
+	return content
+}
+
+//mboxWriter writes each folder to a file of its own, INBOX.mbox for the
+//top level and the folder path with .mbox added for the others
+type mboxWriter struct {
+	destination string
+	files       map[string]*os.File
+}
+
+func newMboxWriter(destination string) *mboxWriter {
+	return &mboxWriter{destination: destination, files: make(map[string]*os.File)}
+}
+
+//fromQuoted matches the lines mboxrd quotes with one more >
+var fromQuoted = regexp.MustCompile(`(?m)^(>*From )`)
+
+//mboxStatusHeaders are replaced with the message's own flags
+var mboxStatusHeaders = map[string]bool{"status": true, "x-status": true, "x-keywords": true}
+
+func (w *mboxWriter) write(message *exportMessage, content []byte) error {
+	file, ok := w.files[message.folder]
+	if !ok {
+		name := imapInbox
+		if message.folder != "" {
+			name = filepath.FromSlash(message.folder)
+		}
+		filename := filepath.Join(w.destination, name+".mbox")
+		err := os.MkdirAll(filepath.Dir(filename), 0700)
+		if nil != err {
+			return err
+		}
+		//never appended to, a second export would duplicate the email
+		file, err = os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if nil != err {
+			return err
+		}
+		w.files[message.folder] = file
+	}
+
+	content = unixLines(content)
+	headerEnd := bytes.Index(content, []byte("\n\n"))
+	if headerEnd < 0 {
+		//no body, the blank line still ends the header
+		content = append(content, '\n')
+		headerEnd = len(content) - 2
+	}
+	var out bytes.Buffer
+	var statusName string
+	for _, line := range strings.SplitAfter(string(content[:headerEnd+1]), "\n") {
+		if line != "" && line[0] != ' ' && line[0] != '\t' {
+			statusName, _, _ = strings.Cut(line, ":")
+			statusName = strings.ToLower(statusName)
+		}
+		if !mboxStatusHeaders[statusName] {
+			out.WriteString(line)
+		}
+	}
+	out.WriteString(mboxFlagHeaders(message.flags()))
+	out.Write(content[headerEnd+1:])
+	out.WriteString("\n")
+	_, err := fmt.Fprintf(file, "From %s %s\n%s", envelopeSender(content[:headerEnd+1]),
+		message.arrived.UTC().Format(time.ANSIC), fromQuoted.ReplaceAll(out.Bytes(), []byte(">$1")))
+	return err
+}
+
+func (w *mboxWriter) close() error {
+	var failed error
+	for _, file := range w.files {
+		if err := file.Close(); nil != err {
+			failed = err
+		}
+	}
+	return failed
+}
+
+//envelopeSender is the address for an mbox From line, taken from the
+//Return-Path or else the From header
+func envelopeSender(header []byte) string {
+	parsed, err := mail.ReadMessage(bytes.NewReader(append(header, '\n')))
+	if nil == err {
+		returnPath := strings.Trim(strings.TrimSpace(parsed.Header.Get("Return-Path")), "<>")
+		if returnPath != "" && !strings.ContainsAny(returnPath, " \t") {
+			return returnPath
+		}
+		if from, err := mail.ParseAddress(parsed.Header.Get("From")); nil == err {
+			return from.Address
+		}
+	}
+	return "MAILER-DAEMON"
+}
+
+//mboxFlagHeaders writes the flags as the Status, X-Status and X-Keywords
+//headers used by mutt, Thunderbird and Dovecot
+func mboxFlagHeaders(flags []string) string {
+	status, xStatus := "O", ""
+	keywords := make([]string, 0)
+	for _, flag := range flags {
+		switch strings.ToLower(flag) {
+		case `\seen`:
+			status = "RO"
+		case `\answered`:
+			xStatus += "A"
+		case `\flagged`:
+			xStatus += "F"
+		case `\draft`:
+			xStatus += "T"
+		default:
+			keywords = append(keywords, flag)
+		}
+	}
+	headers := "Status: " + status + "\n"
+	if xStatus != "" {
+		headers += "X-Status: " + xStatus + "\n"
+	}
+	if len(keywords) > 0 {
+		headers += "X-Keywords: " + strings.Join(keywords, " ") + "\n"
+	}
+	return headers
+}
+
+//maildirWriter writes a Maildir++ tree, the top level in destination and
+//each folder in a directory named for it with . between the levels.
+//Keywords are listed in each folder's dovecot-keywords file.
+type maildirWriter struct {
+	destination string
+	host        string
+	count       int
+	keywords    map[string][]string
+}
+
+func newMaildirWriter(destination string) *maildirWriter {
+	host, err := os.Hostname()
+	if nil != err || host == "" {
+		host = "localhost"
+	}
+	//the characters Maildir file names can't contain
+	host = strings.NewReplacer("/", `\057`, ":", `\072`).Replace(host)
+	return &maildirWriter{destination: destination, host: host, keywords: make(map[string][]string)}
+}
+
+func (w *maildirWriter) folderDir(folder string) string {
+	if folder == "" {
+		return w.destination
+	}
+	return filepath.Join(w.destination, "."+strings.ReplaceAll(folder, "/", "."))
+}
+
+func (w *maildirWriter) write(message *exportMessage, content []byte) error {
+	dir := w.folderDir(message.folder)
+	if _, ok := w.keywords[message.folder]; !ok {
+		err := os.MkdirAll(dir, 0700)
+		if nil != err {
+			return err
+		}
+		//never added to, a second export would duplicate the email
+		for _, sub := range []string{"cur", "new", "tmp"} {
+			err = os.Mkdir(filepath.Join(dir, sub), 0700)
+			if nil != err {
+				return err
+			}
+		}
+		if message.folder != "" {
+			err := ioutil.WriteFile(filepath.Join(dir, "maildirfolder"), nil, 0600)
+			if nil != err {
+				return err
+			}
+		}
+		w.keywords[message.folder] = make([]string, 0)
+	}
+
+	w.count++
+	name := fmt.Sprintf("%d.P%dQ%d.%s", message.arrived.Unix(), os.Getpid(), w.count, w.host)
+	//unread email is new, flags can only be given to email in cur
+	target := filepath.Join(dir, "new", name)
+	flags := message.flags()
+	if len(flags) > 0 {
+		target = filepath.Join(dir, "cur", name+":2,"+w.infoFlags(message.folder, flags))
+	}
+	temp := filepath.Join(dir, "tmp", name)
+	err := ioutil.WriteFile(temp, unixLines(content), 0600)
+	if nil == err {
+		//clients take the file's time as when the email arrived
+		err = os.Chtimes(temp, message.arrived, message.arrived)
+	}
+	if nil == err {
+		err = os.Rename(temp, target)
+	}
+	if nil != err {
+		os.Remove(temp)
+	}
+	return err
+}
+
+//infoFlags writes the flags as Maildir info letters in ASCII order,
+//keywords taking the letters a to z in the order they are first seen
+func (w *maildirWriter) infoFlags(folder string, flags []string) string {
+	letters := make([]string, 0, len(flags))
+	for _, flag := range flags {
+		switch strings.ToLower(flag) {
+		case `\seen`:
+			letters = append(letters, "S")
+		case `\answered`:
+			letters = append(letters, "R")
+		case `\flagged`:
+			letters = append(letters, "F")
+		case `\draft`:
+			letters = append(letters, "D")
+		default:
+			index := -1
+			for i, keyword := range w.keywords[folder] {
+				if keyword == flag {
+					index = i
+				}
+			}
+			if index < 0 && len(w.keywords[folder]) < 26 {
+				index = len(w.keywords[folder])
+				w.keywords[folder] = append(w.keywords[folder], flag)
+			}
+			if index >= 0 {
+				letters = append(letters, string(rune('a'+index)))
+			}
+		}
+	}
+	sort.Strings(letters)
+	return strings.Join(letters, "")
+}
+
+func (w *maildirWriter) close() error {
+	for folder, keywords := range w.keywords {
+		if len(keywords) == 0 {
+			continue
+		}
+		var list bytes.Buffer
+		for i, keyword := range keywords {
+			fmt.Fprintf(&list, "%d %s\n", i, keyword)
+		}
+		err := ioutil.WriteFile(filepath.Join(w.folderDir(folder), "dovecot-keywords"), list.Bytes(), 0600)
+		if nil != err {
+			return err
+		}
+	}
+	return nil
+}
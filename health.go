@@ -0,0 +1,157 @@
+package main
+
+/*
+    s3pop-server: An AWS S3 backed POP3 server
+	Copyright (C) 2018 James W Matheson
+	fractal.mango@gmail.com
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+//Health endpoints. The /healthz endpoint reports whether the server itself
+//is working and /readyz also checks it can reach S3, so a client "cannot
+//connect" can be told apart from an S3 or credentials problem.
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/FractalJim/s3pop-server/backend"
+)
+
+//bucketProbeInterval limits how often readiness checks call S3
+const bucketProbeInterval = 30 * time.Second
+
+type checkResult struct {
+	OK     bool        `json:"ok"`
+	Error  string      `json:"error,omitempty"`
+	Detail interface{} `json:"detail,omitempty"`
+}
+
+type healthReport struct {
+	Status    string                        `json:"status"`
+	Checks    map[string]checkResult        `json:"checks"`
+	Mailboxes map[string]backend.SyncResult `json:"mailboxes,omitempty"`
+}
+
+type listenerStatus struct {
+	Address string `json:"address"`
+	TLS     string `json:"tls"`
+	Open    bool   `json:"open"`
+	Error   string `json:"error,omitempty"`
+}
+
+func newCheckResult(err error) checkResult {
+	if nil != err {
+		return checkResult{OK: false, Error: err.Error()}
+	}
+	return checkResult{OK: true}
+}
+
+//bucketProbe caches the result of the HeadBucket call so health checks
+//polled every few seconds do not turn into a stream of S3 requests
+var bucketProbe struct {
+	sync.Mutex
+	bucket string
+	at     time.Time
+	err    error
+}
+
+func probeBucket(bucket string) error {
+	bucketProbe.Lock()
+	defer bucketProbe.Unlock()
+	if bucketProbe.bucket == bucket && time.Since(bucketProbe.at) < bucketProbeInterval {
+		return bucketProbe.err
+	}
+	bucketProbe.err = backend.CheckBucket(bucket)
+	bucketProbe.bucket = bucket
+	bucketProbe.at = time.Now()
+	return bucketProbe.err
+}
+
+//listenerStatuses reports each open listener, ok is false if the server
+//is draining or any listener has stopped accepting connections
+func (s *popServer) listenerStatuses() (statuses []listenerStatus, ok bool) {
+	s.mu.Lock()
+	listeners := make([]*popListener, 0, len(s.listeners))
+	for _, listener := range s.listeners {
+		listeners = append(listeners, listener)
+	}
+	ok = !s.draining && len(listeners) > 0
+	s.mu.Unlock()
+
+	for _, listener := range listeners {
+		status := listenerStatus{
+			Address: listener.Addr().String(),
+			TLS:     listener.currentSettings().config.TLS,
+			Open:    true,
+		}
+		if err := listener.failure(); nil != err {
+			status.Open = false
+			status.Error = err.Error()
+			ok = false
+		}
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Address < statuses[j].Address })
+	return statuses, ok
+}
+
+func (s *popServer) healthy() bool {
+	_, ok := s.listenerStatuses()
+	return ok
+}
+
+func (s *popServer) healthReport(ready bool) (*healthReport, bool) {
+	report := &healthReport{Checks: make(map[string]checkResult)}
+	statuses, ok := s.listenerStatuses()
+	report.Checks["listeners"] = checkResult{OK: ok, Detail: statuses}
+
+	if ready {
+		credentials := newCheckResult(backend.CheckCredentials())
+		report.Checks["credentials"] = credentials
+		ok = ok && credentials.OK
+
+		bucket := newCheckResult(probeBucket(s.currentConfig().S3Bucket))
+		report.Checks["bucket"] = bucket
+		ok = ok && bucket.OK
+
+		//reported for diagnosis only, one mailbox failing to sync does
+		//not stop the others being served
+		report.Mailboxes = backend.SyncResults()
+	}
+
+	report.Status = "ok"
+	if !ok {
+		report.Status = "fail"
+	}
+	return report, ok
+}
+
+func (s *popServer) healthHandler(ready bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		report, ok := s.healthReport(ready)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		if !ok {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(report)
+	}
+}
@@ -0,0 +1,1175 @@
+package main
+
+/*
+    s3pop-server: An AWS S3 backed POP3 server
+	Copyright (C) 2018 James W Matheson
+	fractal.mango@gmail.com
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+//IMAP4rev1 front-end (RFC 3501) over the same cache as the POP3 server.
+//Each user's S3 folder is offered as INBOX. \Seen is stored as the Read
+//flag in the message metadata and \Deleted is kept for the session, like
+//POP3 DELE, until EXPUNGE or CLOSE removes the messages.
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/FractalJim/s3pop-server/backend"
+	"github.com/FractalJim/s3pop-server/mailutils"
+	"github.com/FractalJim/s3pop-server/metrics"
+)
+
+const (
+	IMAP_STATE_NOT_AUTHENTICATED = 1
+	IMAP_STATE_AUTHENTICATED     = 2
+	IMAP_STATE_SELECTED          = 3
+	IMAP_STATE_LOGOUT            = 4
+)
+
+//RFC 3501 section 5.4 requires the autologout timer to be at least 30
+//minutes, the configured idleTimeout is used if it is longer
+const imapMinIdleTimeout = 30 * 60
+
+//RFC 7162 section 4 asks servers to accept command lines of at least
+//8192 octets, UID sets from clients with large mailboxes get long
+const imapMinLineLength = 8192
+
+//imapMaxLiteral limits literals in commands, clients only need them for
+//LOGIN and SEARCH strings as messages cannot be appended
+const imapMaxLiteral = 64 * 1024
+
+//imapMaxLiterals is how many literals of the largest size fit in one
+//command, beyond the length of a command line
+const imapMaxLiterals = 4
+
+//imapSyncInterval is how often a selected mailbox is downloaded from S3
+//again while the client is idling or polling with NOOP
+const imapSyncInterval = 60 * time.Second
+
+//imapInbox is the top level of the user's S3 folder, the sub-prefixes
+//below it are the other mailboxes
+const imapInbox = "INBOX"
+
+//imapResult is a tagged response other than a plain OK, returned as an
+//error by command handlers. Any other error from a handler ends the
+//session.
+type imapResult struct {
+	status string
+	text   string
+}
+
+func (e *imapResult) Error() string {
+	return e.status + " " + e.text
+}
+
+func imapOK(text string) error {
+	return &imapResult{status: "OK", text: text}
+}
+
+func imapNo(text string) error {
+	return &imapResult{status: "NO", text: text}
+}
+
+func imapBad(text string) error {
+	return &imapResult{status: "BAD", text: text}
+}
+
+//imapMessage is a message in the selected mailbox
+type imapMessage struct {
+	data    *mailutils.MailData
+	deleted bool
+}
+
+func (m *imapMessage) flags() string {
+	flags := make([]string, 0, 2)
+	if m.data.Read {
+		flags = append(flags, `\Seen`)
+	}
+	if m.deleted {
+		flags = append(flags, `\Deleted`)
+	}
+	return imapList(append(flags, m.keywords()...))
+}
+
+//keywords are the flags set on the message by a filter, they can't be
+//changed by clients
+func (m *imapMessage) keywords() []string {
+	keywords := make([]string, 0, len(m.data.Flags))
+	for _, flag := range m.data.Flags {
+		if isKeyword(flag) {
+			keywords = append(keywords, flag)
+		}
+	}
+	return keywords
+}
+
+//hasKeyword checks for a flag set by a filter, ignoring case
+func (m *imapMessage) hasKeyword(keyword string) bool {
+	for _, flag := range m.keywords() {
+		if strings.EqualFold(flag, keyword) {
+			return true
+		}
+	}
+	return false
+}
+
+type imapSession struct {
+	conn     *bufferedConn
+	reader   *bufio.Reader
+	config   *ServerConfig
+	stopping <-chan struct{}
+	//starttls is the TLS config offered with STARTTLS, nil if it is not
+	//available or TLS has been started
+	starttls  *tls.Config
+	clientLog *slog.Logger
+	log       *slog.Logger
+
+	state    int
+	user     string
+	emailDir string
+	//folder and folderDir are the selected folder, empty for INBOX, and
+	//its cache directory
+	folder    string
+	folderDir string
+	readOnly  bool
+	messages  []*imapMessage
+	lastSync  time.Time
+	//fullAlerted is set once the client has been told the mailbox is full
+	fullAlerted bool
+}
+
+//imapCommand is a command handler and the states it may be used in
+type imapCommand struct {
+	states []int
+	run    func(s *imapSession, tag string, args []*imapArg) error
+}
+
+var anyState = []int{IMAP_STATE_NOT_AUTHENTICATED, IMAP_STATE_AUTHENTICATED, IMAP_STATE_SELECTED}
+var authenticated = []int{IMAP_STATE_AUTHENTICATED, IMAP_STATE_SELECTED}
+var selected = []int{IMAP_STATE_SELECTED}
+
+var imapCommands = map[string]*imapCommand{
+	"CAPABILITY": {anyState, (*imapSession).capability},
+	"NOOP":       {anyState, (*imapSession).noop},
+	"LOGOUT":     {anyState, (*imapSession).logout},
+	"STARTTLS":   {[]int{IMAP_STATE_NOT_AUTHENTICATED}, (*imapSession).startTLS},
+	"LOGIN":      {[]int{IMAP_STATE_NOT_AUTHENTICATED}, (*imapSession).login},
+	"AUTHENTICATE": {[]int{IMAP_STATE_NOT_AUTHENTICATED}, func(s *imapSession, tag string, args []*imapArg) error {
+		return imapNo("[CANNOT] Use LOGIN")
+	}},
+	"SELECT":      {authenticated, (*imapSession).selectCommand},
+	"EXAMINE":     {authenticated, (*imapSession).examine},
+	"CREATE":      {authenticated, (*imapSession).notPermitted},
+	"DELETE":      {authenticated, (*imapSession).notPermitted},
+	"RENAME":      {authenticated, (*imapSession).notPermitted},
+	"APPEND":      {authenticated, (*imapSession).notPermitted},
+	"SUBSCRIBE":   {authenticated, (*imapSession).subscribe},
+	"UNSUBSCRIBE": {authenticated, (*imapSession).subscribe},
+	"LIST":        {authenticated, (*imapSession).list},
+	"LSUB":        {authenticated, (*imapSession).lsub},
+	"NAMESPACE":   {authenticated, (*imapSession).namespace},
+	"STATUS":      {authenticated, (*imapSession).status},
+	"IDLE":        {authenticated, (*imapSession).idle},
+	"CHECK":       {selected, (*imapSession).noop},
+	"CLOSE":       {selected, (*imapSession).close},
+	"UNSELECT":    {selected, (*imapSession).unselect},
+	"EXPUNGE":     {selected, (*imapSession).expungeCommand},
+	"SEARCH":      {selected, (*imapSession).search},
+	"UID SEARCH":  {selected, (*imapSession).uidSearch},
+	"FETCH":       {selected, (*imapSession).fetch},
+	"UID FETCH":   {selected, (*imapSession).uidFetch},
+	"STORE":       {selected, (*imapSession).store},
+	"UID STORE":   {selected, (*imapSession).uidStore},
+	"COPY":        {selected, (*imapSession).notPermitted},
+	"UID COPY":    {selected, (*imapSession).notPermitted},
+}
+
+//handleIMAPClient runs an IMAP session. stlsConfig is non nil if the
+//client may start TLS with STARTTLS.
+func handleIMAPClient(conn net.Conn, config *ServerConfig, stlsConfig *tls.Config, stopping <-chan struct{}) {
+	defer conn.Close()
+	clientLog := slog.With("session", newSessionID(), "remote", conn.RemoteAddr().String(), "protocol", "imap")
+	started := time.Now()
+	commandCount := 0
+	clientLog.Info("session started", "local", conn.LocalAddr().String())
+	metrics.SessionsTotal.Inc()
+	metrics.SessionsActive.Inc()
+
+	buffered := newBufferedConn(&timeoutConn{Conn: conn, writeTimeout: time.Duration(config.WriteTimeout) * time.Second})
+	defer buffered.Flush()
+	s := &imapSession{
+		conn:      buffered,
+		reader:    bufio.NewReader(buffered),
+		config:    config,
+		stopping:  stopping,
+		starttls:  stlsConfig,
+		clientLog: clientLog,
+		log:       clientLog,
+		state:     IMAP_STATE_NOT_AUTHENTICATED,
+	}
+	defer func() {
+		if s.user != "" {
+			closeIMAPMailbox(s.user)
+		}
+		metrics.SessionsActive.Dec()
+		s.log.Info("session ended", "duration", time.Since(started).Round(time.Millisecond), "commands", commandCount)
+	}()
+	defer func() {
+		if r := recover(); r != nil {
+			metrics.SessionPanics.Inc()
+			s.log.Error("session panicked", "panic", r, "stack", string(debug.Stack()))
+			s.untagged("BYE [SERVERBUG] internal error")
+		}
+	}()
+	//also bounds the TLS handshake on implicit TLS listeners
+	conn.SetReadDeadline(time.Now().Add(s.idleTimeout()))
+
+	s.untagged("OK [CAPABILITY %s] S3 IMAP server ready", s.capabilities())
+	for s.state != IMAP_STATE_LOGOUT {
+		if s.reader.Buffered() == 0 {
+			err := s.conn.Flush()
+			if nil != err {
+				if !isClosed(stopping) {
+					s.log.Warn("write failed", "error", err)
+				}
+				return
+			}
+		}
+		s.conn.SetReadDeadline(time.Now().Add(s.idleTimeout()))
+		if isClosed(stopping) {
+			s.untagged("BYE Server shutting down")
+			return
+		}
+
+		line, err := readIMAPCommand(s.reader, s.conn, s.maxLineLength(), imapMaxLiteral, s.maxLineLength()+imapMaxLiterals*imapMaxLiteral)
+		if err == errLineTooLong {
+			s.untagged("BAD Command line too long")
+			continue
+		}
+		if err == errLiteralRefused {
+			tag, _, _, _ := parseIMAPCommand(line)
+			s.tagged(orUntagged(tag), imapBad("Literal too large"))
+			continue
+		}
+		if nil != err {
+			s.readFailed(err)
+			return
+		}
+
+		tag, name, args, err := parseIMAPCommand(line)
+		if tag == "" {
+			s.untagged("BAD Missing tag")
+			continue
+		}
+		commandCount++
+		s.log.Info("command", "tag", tag, "cmd", name)
+		if nil != err {
+			s.tagged(tag, imapBad("Syntax error"))
+			continue
+		}
+		command, ok := imapCommands[name]
+		if !ok {
+			s.tagged(tag, imapBad("Unknown command"))
+			continue
+		}
+		if !allowedIn(command.states, s.state) {
+			s.tagged(tag, imapBad(name+" not allowed now"))
+			continue
+		}
+		err = command.run(s, tag, args)
+		if err == errIMAPSyntax {
+			err = imapBad("Syntax error")
+		}
+		var failed *imapResult
+		if nil != err && !errors.As(err, &failed) {
+			s.readFailed(err)
+			return
+		}
+		if name == "STARTTLS" && nil == err {
+			//already answered before the handshake
+			continue
+		}
+		s.tagged(tag, err)
+		if name == "LOGOUT" {
+			return
+		}
+	}
+}
+
+//readFailed ends the session after a read error, telling the client why
+//if it is still there
+func (s *imapSession) readFailed(err error) {
+	switch {
+	case isClosed(s.stopping):
+		s.untagged("BYE Server shutting down")
+	case isTimeout(err):
+		s.untagged("BYE Autologout timer expired")
+	case err == errLiteralTooLarge:
+		s.untagged("BYE Literal too large")
+	case err != io.EOF:
+		s.log.Warn("read failed", "error", err)
+	}
+}
+
+func orUntagged(tag string) string {
+	if tag == "" {
+		return "*"
+	}
+	return tag
+}
+
+func allowedIn(states []int, state int) bool {
+	for _, allowed := range states {
+		if allowed == state {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *imapSession) idleTimeout() time.Duration {
+	timeout := s.config.IdleTimeout
+	if timeout < imapMinIdleTimeout {
+		timeout = imapMinIdleTimeout
+	}
+	return time.Duration(timeout) * time.Second
+}
+
+func (s *imapSession) maxLineLength() int {
+	if s.config.MaxLineLength < imapMinLineLength {
+		return imapMinLineLength
+	}
+	return s.config.MaxLineLength
+}
+
+func (s *imapSession) untagged(format string, args ...interface{}) {
+	fmt.Fprintf(s.conn, "* "+format+eol, args...)
+}
+
+//tagged completes a command, err nil for OK
+func (s *imapSession) tagged(tag string, err error) {
+	status, text := "OK", "completed"
+	var failed *imapResult
+	if errors.As(err, &failed) {
+		status, text = failed.status, failed.text
+	}
+	io.WriteString(s.conn, tag+" "+status+" "+text+eol)
+	if status == "OK" {
+		s.log.Debug("response", "tag", tag, "status", status, "text", text)
+	} else {
+		s.log.Info("response", "tag", tag, "status", status, "text", text)
+	}
+}
+
+func (s *imapSession) capabilities() string {
+	capabilities := []string{"IMAP4rev1", "IDLE", "NAMESPACE", "UNSELECT"}
+	if nil != s.starttls {
+		capabilities = append(capabilities, "STARTTLS")
+	}
+	return strings.Join(capabilities, " ")
+}
+
+func (s *imapSession) capability(tag string, args []*imapArg) error {
+	s.untagged("CAPABILITY %s", s.capabilities())
+	return nil
+}
+
+func (s *imapSession) noop(tag string, args []*imapArg) error {
+	if s.state == IMAP_STATE_SELECTED {
+		return s.refresh(false)
+	}
+	return nil
+}
+
+func (s *imapSession) logout(tag string, args []*imapArg) error {
+	s.untagged("BYE Logging out")
+	s.state = IMAP_STATE_LOGOUT
+	return nil
+}
+
+func (s *imapSession) startTLS(tag string, args []*imapArg) error {
+	if nil == s.starttls {
+		return imapBad("TLS not available")
+	}
+	if s.reader.Buffered() > 0 {
+		//anything sent before the handshake could have been injected
+		return imapBad("Command received after STARTTLS")
+	}
+	s.tagged(tag, nil)
+	s.conn.Flush()
+	tlsConn := tls.Server(s.conn.Conn, s.starttls)
+	err := tlsConn.Handshake()
+	if nil != err {
+		s.log.Warn("TLS handshake failed", "error", err)
+		return err
+	}
+	s.conn.upgrade(tlsConn)
+	s.reader = bufio.NewReader(s.conn)
+	s.starttls = nil
+	return nil
+}
+
+func (s *imapSession) login(tag string, args []*imapArg) error {
+	if len(args) != 2 {
+		return errIMAPSyntax
+	}
+	user, ok := args[0].astring()
+	if !ok {
+		return errIMAPSyntax
+	}
+	if !utf8.ValidString(user) {
+		return imapNo("[AUTHENTICATIONFAILED] User name is not valid UTF-8")
+	}
+	//Accept all passwords (local service only), as POP3 PASS does
+	emailDir, err := mailutils.GetEmailDir(user)
+	if nil != err {
+		return s.mailboxError(err)
+	}
+	s.user = user
+	s.emailDir = emailDir
+	openIMAPMailbox(user)
+	s.log = s.clientLog.With("user", user)
+	s.state = IMAP_STATE_AUTHENTICATED
+	return imapOK("[CAPABILITY " + s.capabilities() + "] Logged in")
+}
+
+//mailboxError logs a cache or backend failure and chooses the response
+//code for it (RFC 5530)
+func (s *imapSession) mailboxError(err error) error {
+	s.log.Error("mailbox unavailable", "error", err)
+	switch responseCode(err) {
+	case RESP_AUTH:
+		return imapNo("[AUTHENTICATIONFAILED] Invalid user name")
+	case RESP_SYS_PERM:
+		return imapNo("[UNAVAILABLE] Mailbox unavailable")
+	}
+	return imapNo("[UNAVAILABLE] Mailbox temporarily unavailable")
+}
+
+func (s *imapSession) notPermitted(tag string, args []*imapArg) error {
+	return imapNo("[CANNOT] Mailboxes and messages only come from S3")
+}
+
+//updateCacheSize reports the size of the selected folder if it is the one
+//POP3 serves, which the cache size metric follows
+func (s *imapSession) updateCacheSize(mailData []*mailutils.MailData, deletedItems map[int]struct{}) {
+	if s.folder != s.config.PopFolder {
+		return
+	}
+	count, size := getStat(mailData, deletedItems)
+	metrics.SetCacheSize(s.user, count, size)
+}
+
+//mailboxName returns the IMAP name of a folder
+func mailboxName(folder string) string {
+	if folder == "" {
+		return imapInbox
+	}
+	return encodeMailboxName(folder)
+}
+
+//folders returns the folders offered to the client. A folder called INBOX
+//in any case, and anything in it, is left out as its name would be taken
+//for the top level.
+func (s *imapSession) folders() ([]string, error) {
+	cached, err := mailutils.ListFolders(s.emailDir)
+	if nil != err {
+		return nil, err
+	}
+	folders := make([]string, 0, len(cached))
+	for _, folder := range cached {
+		top := strings.SplitN(folder, "/", 2)[0]
+		if !strings.EqualFold(top, imapInbox) {
+			folders = append(folders, folder)
+		}
+	}
+	return folders, nil
+}
+
+//mailboxArg finds the folder a command names
+func (s *imapSession) mailboxArg(arg *imapArg) (string, error) {
+	name, ok := arg.astring()
+	if !ok {
+		return "", errIMAPSyntax
+	}
+	if strings.EqualFold(name, imapInbox) {
+		return "", nil
+	}
+	folder, ok := decodeMailboxName(name)
+	if !ok {
+		return "", imapBad("Mailbox name is not valid modified UTF-7")
+	}
+	folders, err := s.folders()
+	if nil != err {
+		return "", s.mailboxError(err)
+	}
+	for _, existing := range folders {
+		if existing == folder {
+			return folder, nil
+		}
+	}
+	return "", imapNo("[NONEXISTENT] No such mailbox")
+}
+
+func (s *imapSession) subscribe(tag string, args []*imapArg) error {
+	if len(args) != 1 {
+		return errIMAPSyntax
+	}
+	_, err := s.mailboxArg(args[0])
+	return err
+}
+
+func (s *imapSession) list(tag string, args []*imapArg) error {
+	return s.listMailboxes("LIST", args)
+}
+
+//lsub lists the same mailboxes as LIST, INBOX is always subscribed
+func (s *imapSession) lsub(tag string, args []*imapArg) error {
+	return s.listMailboxes("LSUB", args)
+}
+
+func (s *imapSession) listMailboxes(command string, args []*imapArg) error {
+	if len(args) != 2 {
+		return errIMAPSyntax
+	}
+	reference, ok := args[0].astring()
+	pattern, ok2 := args[1].astring()
+	if !ok || !ok2 {
+		return errIMAPSyntax
+	}
+	if pattern == "" {
+		//asks for the hierarchy delimiter
+		s.untagged(`%s (\Noselect) "/" ""`, command)
+		return nil
+	}
+	//folders only appear in the cache once they have been downloaded
+	if err := s.sync(false); nil != err {
+		s.log.Warn("sync failed", "error", err)
+	}
+	folders, err := s.folders()
+	if nil != err {
+		return s.mailboxError(err)
+	}
+	if matchMailbox(reference+pattern, imapInbox) {
+		s.untagged(`%s (\HasNoChildren) "/" %s`, command, imapInbox)
+	}
+	for i, folder := range folders {
+		name := mailboxName(folder)
+		if !matchMailbox(reference+pattern, name) {
+			continue
+		}
+		//nested folders directly follow their parent
+		attribute := `\HasNoChildren`
+		if i+1 < len(folders) && strings.HasPrefix(folders[i+1], folder+"/") {
+			attribute = `\HasChildren`
+		}
+		if folder == s.config.SentFolder {
+			//special-use attribute (RFC 6154) so clients find it
+			attribute += ` \Sent`
+		}
+		s.untagged(`%s (%s) "/" %s`, command, attribute, imapString(name))
+	}
+	return nil
+}
+
+//matchMailbox matches a mailbox name against a LIST pattern, where * is
+//any text and % is any text without a hierarchy delimiter
+func matchMailbox(pattern string, name string) bool {
+	if pattern == "" {
+		return name == ""
+	}
+	switch pattern[0] {
+	case '*', '%':
+		for i := 0; i <= len(name); i++ {
+			if matchMailbox(pattern[1:], name[i:]) {
+				return true
+			}
+			if i < len(name) && pattern[0] == '%' && name[i] == '/' {
+				return false
+			}
+		}
+		return false
+	}
+	if name == "" || !strings.EqualFold(pattern[:1], name[:1]) {
+		return false
+	}
+	return matchMailbox(pattern[1:], name[1:])
+}
+
+func (s *imapSession) namespace(tag string, args []*imapArg) error {
+	s.untagged(`NAMESPACE (("" "/")) NIL NIL`)
+	return nil
+}
+
+//sync downloads new messages from S3 at most once every imapSyncInterval
+//unless force is set
+func (s *imapSession) sync(force bool) error {
+	if !force && time.Since(s.lastSync) < imapSyncInterval {
+		return nil
+	}
+	s.lastSync = time.Now()
+	return backend.DownloadEmails(s.config.S3Bucket, s.user, s.config.ingestOptions(s.user))
+}
+
+//loadMailbox reads the metadata of the messages cached in folderDir in UID
+//order
+func (s *imapSession) loadMailbox(folderDir string) ([]*mailutils.MailData, error) {
+	mailData, err := mailutils.ListMailData(folderDir)
+	if nil != err {
+		return nil, err
+	}
+	sort.Slice(mailData, func(i, j int) bool { return mailData[i].ID < mailData[j].ID })
+	return mailData, nil
+}
+
+func (s *imapSession) selectCommand(tag string, args []*imapArg) error {
+	return s.selectMailbox(args, false)
+}
+
+func (s *imapSession) examine(tag string, args []*imapArg) error {
+	return s.selectMailbox(args, true)
+}
+
+func (s *imapSession) selectMailbox(args []*imapArg, readOnly bool) error {
+	if len(args) != 1 {
+		return errIMAPSyntax
+	}
+	//selecting always leaves the previous mailbox, without expunging
+	s.state = IMAP_STATE_AUTHENTICATED
+	s.messages = nil
+	folder, err := s.mailboxArg(args[0])
+	if nil != err {
+		return err
+	}
+	err = s.sync(true)
+	if nil != err {
+		return s.mailboxError(err)
+	}
+	if !s.fullAlerted && mailboxFull(s.config, s.user) {
+		s.fullAlerted = true
+		s.untagged("OK [ALERT] Mailbox is full, new email will wait on the server until some is deleted")
+	}
+	folderDir, err := mailutils.GetFolderDir(s.emailDir, folder)
+	if nil != err {
+		return s.mailboxError(err)
+	}
+	mailData, err := s.loadMailbox(folderDir)
+	if nil != err {
+		return s.mailboxError(err)
+	}
+	uidValidity, err := mailutils.UIDValidity(folderDir)
+	if nil != err {
+		return s.mailboxError(err)
+	}
+	uidNext, err := backend.NextID(s.emailDir)
+	if nil != err {
+		return s.mailboxError(err)
+	}
+
+	s.folder = folder
+	s.folderDir = folderDir
+	s.readOnly = readOnly
+	flags := []string{`\Seen`, `\Deleted`}
+	inUse := make(map[string]bool)
+	for _, mailItem := range mailData {
+		message := &imapMessage{data: mailItem}
+		s.messages = append(s.messages, message)
+		for _, keyword := range message.keywords() {
+			if !inUse[strings.ToLower(keyword)] {
+				inUse[strings.ToLower(keyword)] = true
+				flags = append(flags, keyword)
+			}
+		}
+	}
+	s.untagged("FLAGS %s", imapList(flags))
+	s.untagged(`OK [PERMANENTFLAGS (\Seen)] \Deleted lasts until the session ends`)
+	s.untagged("%d EXISTS", len(s.messages))
+	s.untagged("0 RECENT")
+	for i, message := range s.messages {
+		if !message.data.Read {
+			s.untagged("OK [UNSEEN %d] First unseen message", i+1)
+			break
+		}
+	}
+	s.untagged("OK [UIDVALIDITY %d] UIDs valid", uidValidity)
+	s.untagged("OK [UIDNEXT %d] Predicted next UID", uidNext)
+	s.state = IMAP_STATE_SELECTED
+	s.updateCacheSize(mailData, nil)
+	if s.readOnly {
+		return imapOK("[READ-ONLY] EXAMINE completed")
+	}
+	return imapOK("[READ-WRITE] SELECT completed")
+}
+
+func (s *imapSession) status(tag string, args []*imapArg) error {
+	if len(args) != 2 || !args[1].isList {
+		return errIMAPSyntax
+	}
+	folder, err := s.mailboxArg(args[0])
+	if nil != err {
+		return err
+	}
+	if err := s.sync(false); nil != err {
+		s.log.Warn("sync failed", "error", err)
+	}
+	folderDir, err := mailutils.GetFolderDir(s.emailDir, folder)
+	if nil != err {
+		return s.mailboxError(err)
+	}
+	mailData, err := s.loadMailbox(folderDir)
+	if nil != err {
+		return s.mailboxError(err)
+	}
+	items := make([]string, 0, 2*len(args[1].list))
+	for _, item := range args[1].list {
+		var value int
+		switch name := strings.ToUpper(item.value); name {
+		case "MESSAGES":
+			value = len(mailData)
+		case "RECENT":
+			value = 0
+		case "UNSEEN":
+			for _, mailItem := range mailData {
+				if !mailItem.Read {
+					value++
+				}
+			}
+		case "UIDNEXT":
+			value, err = backend.NextID(s.emailDir)
+			if nil != err {
+				return s.mailboxError(err)
+			}
+		case "UIDVALIDITY":
+			uidValidity, err := mailutils.UIDValidity(folderDir)
+			if nil != err {
+				return s.mailboxError(err)
+			}
+			value = int(uidValidity)
+		default:
+			return errIMAPSyntax
+		}
+		items = append(items, strings.ToUpper(item.value), strconv.Itoa(value))
+	}
+	s.untagged("STATUS %s %s", imapString(mailboxName(folder)), imapList(items))
+	return nil
+}
+
+//refresh picks up messages downloaded or removed by other sessions,
+//telling the client with untagged EXISTS, EXPUNGE and FETCH responses
+func (s *imapSession) refresh(force bool) error {
+	if err := s.sync(force); nil != err {
+		//carry on with what is already cached
+		s.log.Warn("sync failed", "error", err)
+	}
+	mailData, err := s.loadMailbox(s.folderDir)
+	if nil != err {
+		return s.mailboxError(err)
+	}
+	byUID := make(map[int]*mailutils.MailData, len(mailData))
+	for _, mailItem := range mailData {
+		byUID[mailItem.ID] = mailItem
+	}
+
+	//highest sequence number first so the earlier numbers still hold
+	known := make(map[int]struct{}, len(s.messages))
+	for i := len(s.messages) - 1; i >= 0; i-- {
+		message := s.messages[i]
+		current, ok := byUID[message.data.ID]
+		if !ok {
+			s.untagged("%d EXPUNGE", i+1)
+			s.messages = append(s.messages[:i], s.messages[i+1:]...)
+			continue
+		}
+		known[current.ID] = struct{}{}
+		seenChanged := current.Read != message.data.Read
+		message.data = current
+		if seenChanged {
+			s.untagged("%d FETCH (FLAGS %s)", i+1, message.flags())
+		}
+	}
+	added := false
+	for _, mailItem := range mailData {
+		if _, ok := known[mailItem.ID]; !ok {
+			s.messages = append(s.messages, &imapMessage{data: mailItem})
+			added = true
+		}
+	}
+	if added {
+		s.untagged("%d EXISTS", len(s.messages))
+	}
+	return nil
+}
+
+//idle sends updates to the mailbox until the client sends DONE (RFC 2177)
+func (s *imapSession) idle(tag string, args []*imapArg) error {
+	io.WriteString(s.conn, "+ idling"+eol)
+	deadline := time.Now().Add(s.idleTimeout())
+	for {
+		if err := s.conn.Flush(); nil != err {
+			return err
+		}
+		wait := time.Until(deadline)
+		if wait > imapSyncInterval {
+			wait = imapSyncInterval
+		}
+		s.conn.SetReadDeadline(time.Now().Add(wait))
+		line, err := readLine(s.reader, s.maxLineLength())
+		if nil == err {
+			if !strings.EqualFold(strings.TrimSpace(line), "DONE") {
+				return imapBad("Expected DONE")
+			}
+			return nil
+		}
+		if !isTimeout(err) || isClosed(s.stopping) || time.Now().After(deadline) {
+			return err
+		}
+		if s.state == IMAP_STATE_SELECTED {
+			if err := s.refresh(true); nil != err {
+				return err
+			}
+		}
+	}
+}
+
+//close removes the deleted messages without telling the client and
+//leaves the mailbox
+func (s *imapSession) close(tag string, args []*imapArg) error {
+	var err error
+	if !s.readOnly {
+		err = s.expunge(true)
+	}
+	s.state = IMAP_STATE_AUTHENTICATED
+	s.messages = nil
+	return err
+}
+
+//unselect leaves the mailbox without removing anything (RFC 3691)
+func (s *imapSession) unselect(tag string, args []*imapArg) error {
+	s.state = IMAP_STATE_AUTHENTICATED
+	s.messages = nil
+	return nil
+}
+
+func (s *imapSession) expungeCommand(tag string, args []*imapArg) error {
+	if s.readOnly {
+		return imapNo("[READ-ONLY] Mailbox was opened with EXAMINE")
+	}
+	return s.expunge(false)
+}
+
+//expunge removes the messages marked \Deleted from the cache, as QUIT
+//does for messages deleted with POP3 DELE
+func (s *imapSession) expunge(silent bool) error {
+	mailData := make([]*mailutils.MailData, len(s.messages))
+	deletedItems := make(map[int]struct{})
+	for i, message := range s.messages {
+		mailData[i] = message.data
+		if message.deleted {
+			deletedItems[i] = struct{}{}
+		}
+	}
+	if len(deletedItems) == 0 {
+		return nil
+	}
+	//a POP3 session has exclusive use of the mailbox
+	if !lockMailbox(s.user) {
+		return imapNo("[INUSE] Mailbox in use by a POP3 session, try again later")
+	}
+	removed, failed := deleteItems(s.folderDir, mailData, deletedItems)
+	unlockMailbox(s.user)
+	s.log.Info("update", "deleted", removed, "failed", failed)
+
+	for i := len(s.messages) - 1; i >= 0; i-- {
+		if _, deleted := deletedItems[i]; deleted {
+			if !silent {
+				s.untagged("%d EXPUNGE", i+1)
+			}
+			s.messages = append(s.messages[:i], s.messages[i+1:]...)
+		}
+	}
+	s.updateCacheSize(mailData, deletedItems)
+	if failed > 0 {
+		s.log.Error("messages could not be deleted", "failed", failed)
+		return imapNo(fmt.Sprintf("[SERVERBUG] %d messages not removed", failed))
+	}
+	return nil
+}
+
+func (s *imapSession) largestUID() uint32 {
+	if len(s.messages) == 0 {
+		return 0
+	}
+	return uint32(s.messages[len(s.messages)-1].data.ID)
+}
+
+//matching calls match with the sequence number of each message in set,
+//which holds UIDs if byUID is set
+func (s *imapSession) matching(set seqSet, byUID bool, match func(seq int, message *imapMessage) error) error {
+	largestUID := s.largestUID()
+	for i, message := range s.messages {
+		var found bool
+		if byUID {
+			found = set.contains(uint32(message.data.ID), largestUID)
+		} else {
+			found = set.contains(uint32(i+1), uint32(len(s.messages)))
+		}
+		if !found {
+			continue
+		}
+		if err := match(i+1, message); nil != err {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *imapSession) search(tag string, args []*imapArg) error {
+	return s.searchMessages(args, false)
+}
+
+func (s *imapSession) uidSearch(tag string, args []*imapArg) error {
+	return s.searchMessages(args, true)
+}
+
+func (s *imapSession) searchMessages(args []*imapArg, byUID bool) error {
+	test, err := parseSearch(s, args)
+	if nil != err {
+		return err
+	}
+	results := make([]string, 0)
+	for i, message := range s.messages {
+		if !test(&searchContext{session: s, seq: uint32(i + 1), message: message}) {
+			continue
+		}
+		if byUID {
+			results = append(results, strconv.Itoa(message.data.ID))
+		} else {
+			results = append(results, strconv.Itoa(i+1))
+		}
+	}
+	if len(results) == 0 {
+		s.untagged("SEARCH")
+	} else {
+		s.untagged("SEARCH %s", strings.Join(results, " "))
+	}
+	return nil
+}
+
+func (s *imapSession) fetch(tag string, args []*imapArg) error {
+	return s.fetchMessages(args, false)
+}
+
+func (s *imapSession) uidFetch(tag string, args []*imapArg) error {
+	return s.fetchMessages(args, true)
+}
+
+func (s *imapSession) fetchMessages(args []*imapArg, byUID bool) error {
+	if len(args) != 2 || args[0].isList {
+		return errIMAPSyntax
+	}
+	set, err := parseSeqSet(args[0].value)
+	if nil != err {
+		return err
+	}
+	items, err := parseFetchItems(args[1])
+	if nil != err {
+		return err
+	}
+	if byUID {
+		//UID FETCH always returns the UID
+		items = append([]*fetchItem{{name: "UID"}}, items...)
+	}
+	return s.matching(set, byUID, func(seq int, message *imapMessage) error {
+		return s.fetchMessage(seq, message, items)
+	})
+}
+
+func (s *imapSession) fetchMessage(seq int, message *imapMessage, items []*fetchItem) error {
+	var raw []byte
+	var root *mimePart
+	for _, item := range items {
+		if item.needsContent() && nil == root {
+			var err error
+			raw, err = loadMessage(s.folderDir, message.data)
+			if nil != err {
+				s.log.Error("could not open email", "error", err)
+				return imapNo(fmt.Sprintf("[UNAVAILABLE] failed to open message %d", seq))
+			}
+			root = parseMIMEPart(raw, "text/plain; charset=us-ascii")
+		}
+	}
+
+	markSeen := false
+	parts := make([]string, 0, len(items))
+	seenUID := false
+	for _, item := range items {
+		switch item.name {
+		case "UID":
+			if seenUID {
+				continue
+			}
+			seenUID = true
+			parts = append(parts, "UID "+strconv.Itoa(message.data.ID))
+		case "FLAGS":
+			parts = append(parts, "FLAGS "+message.flags())
+		case "INTERNALDATE":
+			parts = append(parts, "INTERNALDATE "+imapString(internalDate(s.folderDir, message.data).Format(imapDateTimeLayout)))
+		case "RFC822.SIZE":
+			parts = append(parts, "RFC822.SIZE "+strconv.Itoa(message.data.TotalSize))
+		case "ENVELOPE":
+			parts = append(parts, "ENVELOPE "+envelope(root.fields))
+		case "BODYSTRUCTURE":
+			parts = append(parts, "BODYSTRUCTURE "+bodyStructure(root, true))
+		case "RFC822":
+			parts = append(parts, "RFC822 "+imapString(string(raw)))
+		case "RFC822.HEADER":
+			parts = append(parts, "RFC822.HEADER "+imapString(string(root.header)))
+		case "RFC822.TEXT":
+			parts = append(parts, "RFC822.TEXT "+imapString(string(root.body)))
+		default:
+			if nil == item.section {
+				//BODY without a section
+				parts = append(parts, "BODY "+bodyStructure(root, false))
+				continue
+			}
+			content := sectionContent(root, raw, item.section)
+			label := "BODY[" + item.section.text + "]"
+			if item.partial {
+				label += "<" + strconv.Itoa(item.offset) + ">"
+				content = partialContent(content, item.offset, item.count)
+			}
+			parts = append(parts, label+" "+imapString(string(content)))
+		}
+		if item.setsSeen() && !s.readOnly && !message.data.Read {
+			markSeen = true
+		}
+	}
+	if markSeen {
+		err := s.setSeen(message, true)
+		if nil != err {
+			return err
+		}
+		parts = append(parts, "FLAGS "+message.flags())
+	}
+	s.untagged("%d FETCH %s", seq, imapList(parts))
+	return nil
+}
+
+func partialContent(content []byte, offset int, count int) []byte {
+	if offset >= len(content) {
+		return nil
+	}
+	content = content[offset:]
+	if count < len(content) {
+		content = content[:count]
+	}
+	return content
+}
+
+//setSeen records \Seen as the Read flag in the message metadata, where
+//POP3 RETR also records it
+func (s *imapSession) setSeen(message *imapMessage, seen bool) error {
+	if message.data.Read == seen {
+		return nil
+	}
+	retrieved := message.data.Retrieved
+	message.data.MarkRead(seen)
+	err := message.data.Save(s.folderDir)
+	if nil != err {
+		message.data.Read, message.data.Retrieved = !seen, retrieved
+		return s.mailboxError(err)
+	}
+	return nil
+}
+
+func (s *imapSession) store(tag string, args []*imapArg) error {
+	return s.storeFlags(args, false)
+}
+
+func (s *imapSession) uidStore(tag string, args []*imapArg) error {
+	return s.storeFlags(args, true)
+}
+
+func (s *imapSession) storeFlags(args []*imapArg, byUID bool) error {
+	if len(args) != 3 || args[0].isList || args[1].isList {
+		return errIMAPSyntax
+	}
+	if s.readOnly {
+		return imapNo("[READ-ONLY] Mailbox was opened with EXAMINE")
+	}
+	set, err := parseSeqSet(args[0].value)
+	if nil != err {
+		return err
+	}
+	action := strings.ToUpper(args[1].value)
+	silent := strings.HasSuffix(action, ".SILENT")
+	action = strings.TrimSuffix(action, ".SILENT")
+	if action != "FLAGS" && action != "+FLAGS" && action != "-FLAGS" {
+		return errIMAPSyntax
+	}
+	flagArgs := []*imapArg{args[2]}
+	if args[2].isList {
+		flagArgs = args[2].list
+	}
+	//other flags are accepted and ignored as they cannot be stored, keywords
+	//set by a filter are left as they are
+	var seen, deleted bool
+	for _, flag := range flagArgs {
+		switch strings.ToLower(flag.value) {
+		case `\seen`:
+			seen = true
+		case `\deleted`:
+			deleted = true
+		}
+	}
+
+	return s.matching(set, byUID, func(seq int, message *imapMessage) error {
+		newSeen, newDeleted := message.data.Read, message.deleted
+		switch action {
+		case "FLAGS":
+			newSeen, newDeleted = seen, deleted
+		case "+FLAGS":
+			newSeen, newDeleted = newSeen || seen, newDeleted || deleted
+		case "-FLAGS":
+			newSeen, newDeleted = newSeen && !seen, newDeleted && !deleted
+		}
+		if err := s.setSeen(message, newSeen); nil != err {
+			return err
+		}
+		message.deleted = newDeleted
+		if silent {
+			return nil
+		}
+		if byUID {
+			s.untagged("%d FETCH (UID %d FLAGS %s)", seq, message.data.ID, message.flags())
+		} else {
+			s.untagged("%d FETCH (FLAGS %s)", seq, message.flags())
+		}
+		return nil
+	})
+}
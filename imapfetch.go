@@ -0,0 +1,518 @@
+package main
+
+/*
+    s3pop-server: An AWS S3 backed POP3 server
+	Copyright (C) 2018 James W Matheson
+	fractal.mango@gmail.com
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+//FETCH for the IMAP front-end: message parts, ENVELOPE and BODYSTRUCTURE
+//(RFC 3501 sections 6.4.5 and 7.4.2)
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"mime"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/FractalJim/s3pop-server/mailutils"
+)
+
+const imapDateTimeLayout = "02-Jan-2006 15:04:05 -0700"
+
+var crlf = []byte("\r\n")
+
+//fetchItem is one data item requested by FETCH
+type fetchItem struct {
+	name string
+	//section and partial are only used by BODY[] and BODY.PEEK[]
+	section *bodySection
+	partial bool
+	offset  int
+	count   int
+}
+
+//bodySection is the part of a message named in BODY[section]
+type bodySection struct {
+	text      string
+	part      []int
+	specifier string
+	fields    []string
+}
+
+//fetchMacros are the shorthands FETCH accepts in place of a list
+var fetchMacros = map[string][]string{
+	"ALL":  {"FLAGS", "INTERNALDATE", "RFC822.SIZE", "ENVELOPE"},
+	"FAST": {"FLAGS", "INTERNALDATE", "RFC822.SIZE"},
+	"FULL": {"FLAGS", "INTERNALDATE", "RFC822.SIZE", "ENVELOPE", "BODY"},
+}
+
+func parseFetchItems(arg *imapArg) ([]*fetchItem, error) {
+	var names []string
+	if arg.isList {
+		for _, item := range arg.list {
+			if item.isList {
+				return nil, errIMAPSyntax
+			}
+			names = append(names, item.value)
+		}
+	} else if macro, ok := fetchMacros[strings.ToUpper(arg.value)]; ok {
+		names = macro
+	} else {
+		names = []string{arg.value}
+	}
+
+	items := make([]*fetchItem, 0, len(names))
+	for _, name := range names {
+		item, err := parseFetchItem(name)
+		if nil != err {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+func parseFetchItem(text string) (*fetchItem, error) {
+	open := strings.IndexByte(text, '[')
+	if open < 0 {
+		name := strings.ToUpper(text)
+		switch name {
+		case "FLAGS", "UID", "INTERNALDATE", "RFC822.SIZE", "ENVELOPE", "BODY", "BODYSTRUCTURE",
+			"RFC822", "RFC822.HEADER", "RFC822.TEXT":
+			return &fetchItem{name: name}, nil
+		}
+		return nil, errIMAPSyntax
+	}
+	item := &fetchItem{name: strings.ToUpper(text[:open])}
+	if item.name != "BODY" && item.name != "BODY.PEEK" {
+		return nil, errIMAPSyntax
+	}
+	end := strings.LastIndexByte(text, ']')
+	if end < open {
+		return nil, errIMAPSyntax
+	}
+	section, err := parseBodySection(text[open+1 : end])
+	if nil != err {
+		return nil, err
+	}
+	item.section = section
+
+	partial := text[end+1:]
+	if partial != "" {
+		if !strings.HasPrefix(partial, "<") || !strings.HasSuffix(partial, ">") {
+			return nil, errIMAPSyntax
+		}
+		offset, count, ok := strings.Cut(partial[1:len(partial)-1], ".")
+		item.offset, err = strconv.Atoi(offset)
+		if nil != err || !ok {
+			return nil, errIMAPSyntax
+		}
+		item.count, err = strconv.Atoi(count)
+		if nil != err || item.offset < 0 || item.count < 0 {
+			return nil, errIMAPSyntax
+		}
+		item.partial = true
+	}
+	return item, nil
+}
+
+//parseBodySection reads a section such as 1.2.HEADER.FIELDS (FROM TO)
+func parseBodySection(text string) (*bodySection, error) {
+	section := &bodySection{text: text}
+	rest := text
+	for rest != "" && rest[0] >= '0' && rest[0] <= '9' {
+		digits, remainder, _ := strings.Cut(rest, ".")
+		number, err := strconv.Atoi(digits)
+		if nil != err || number == 0 {
+			return nil, errIMAPSyntax
+		}
+		section.part = append(section.part, number)
+		rest = remainder
+	}
+
+	specifier, fields, hasFields := strings.Cut(rest, " ")
+	section.specifier = strings.ToUpper(specifier)
+	switch section.specifier {
+	case "", "HEADER", "TEXT":
+	case "MIME":
+		if len(section.part) == 0 {
+			return nil, errIMAPSyntax
+		}
+	case "HEADER.FIELDS", "HEADER.FIELDS.NOT":
+		fields = strings.TrimSpace(fields)
+		if !hasFields || !strings.HasPrefix(fields, "(") || !strings.HasSuffix(fields, ")") {
+			return nil, errIMAPSyntax
+		}
+		for _, field := range strings.Fields(fields[1 : len(fields)-1]) {
+			section.fields = append(section.fields, strings.Trim(field, `"`))
+		}
+	default:
+		return nil, errIMAPSyntax
+	}
+	if hasFields && !strings.HasPrefix(section.specifier, "HEADER.FIELDS") {
+		return nil, errIMAPSyntax
+	}
+	return section, nil
+}
+
+//needsContent reports whether the message file has to be read
+func (item *fetchItem) needsContent() bool {
+	switch item.name {
+	case "FLAGS", "UID", "INTERNALDATE", "RFC822.SIZE":
+		return false
+	}
+	return true
+}
+
+//setsSeen reports whether fetching the item marks the message read
+func (item *fetchItem) setsSeen() bool {
+	return (item.name == "BODY" && nil != item.section) || item.name == "RFC822" || item.name == "RFC822.TEXT"
+}
+
+//loadMessage reads a cached message with CRLF line endings, as it is sent
+//by POP3 RETR and counted in MailData.TotalSize
+func loadMessage(emailDir string, mailItem *mailutils.MailData) ([]byte, error) {
+	fileData, err := os.Open(filepath.Join(emailDir, mailItem.Name))
+	if nil != err {
+		return nil, err
+	}
+	defer fileData.Close()
+
+	message := bytes.NewBuffer(make([]byte, 0, mailItem.TotalSize))
+	reader := bufio.NewReader(fileData)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			message.Write(bytes.TrimRight(line, "\r\n"))
+			message.Write(crlf)
+		}
+		if err == io.EOF {
+			return message.Bytes(), nil
+		}
+		if nil != err {
+			return nil, err
+		}
+	}
+}
+
+//internalDate is the time the message was downloaded into the cache
+func internalDate(emailDir string, mailItem *mailutils.MailData) time.Time {
+	info, err := os.Stat(filepath.Join(emailDir, mailItem.Name))
+	if nil != err {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+//mimePart is a message or one of its body parts
+type mimePart struct {
+	header    []byte
+	body      []byte
+	fields    textproto.MIMEHeader
+	mediaType string
+	subtype   string
+	params    map[string]string
+	parts     []*mimePart
+	//message is set for message/rfc822 parts
+	message *mimePart
+}
+
+func parseMIMEPart(raw []byte, defaultType string) *mimePart {
+	part := &mimePart{}
+	if bytes.HasPrefix(raw, crlf) {
+		part.header, part.body = raw[:2], raw[2:]
+	} else if split := bytes.Index(raw, []byte("\r\n\r\n")); split >= 0 {
+		part.header, part.body = raw[:split+4], raw[split+4:]
+	} else {
+		part.header = raw
+	}
+	part.fields, _ = textproto.NewReader(bufio.NewReader(bytes.NewReader(part.header))).ReadMIMEHeader()
+
+	mediaType, params, err := mime.ParseMediaType(part.fields.Get("Content-Type"))
+	if nil != err {
+		mediaType, params, _ = mime.ParseMediaType(defaultType)
+	}
+	part.mediaType, part.subtype, _ = strings.Cut(mediaType, "/")
+	part.params = params
+	if part.mediaType == "text" && params["charset"] == "" {
+		params["charset"] = "us-ascii"
+	}
+
+	switch {
+	case part.mediaType == "multipart" && params["boundary"] != "":
+		childType := "text/plain; charset=us-ascii"
+		if part.subtype == "digest" {
+			childType = "message/rfc822"
+		}
+		for _, child := range splitMultipart(part.body, params["boundary"]) {
+			part.parts = append(part.parts, parseMIMEPart(child, childType))
+		}
+	case mediaType == "message/rfc822":
+		part.message = parseMIMEPart(part.body, "text/plain; charset=us-ascii")
+	}
+	return part
+}
+
+//splitMultipart returns the body parts between the boundary delimiters,
+//the CRLF before each delimiter belongs to the delimiter (RFC 2046)
+func splitMultipart(body []byte, boundary string) [][]byte {
+	delimiter := []byte("--" + boundary)
+	var parts [][]byte
+	start := -1
+	for offset := 0; offset < len(body); {
+		lineEnd := bytes.Index(body[offset:], crlf)
+		next := offset + lineEnd + 2
+		if lineEnd < 0 {
+			lineEnd = len(body) - offset
+			next = len(body)
+		}
+		line := body[offset : offset+lineEnd]
+		if bytes.HasPrefix(line, delimiter) {
+			rest := bytes.TrimRight(line[len(delimiter):], " \t")
+			closing := bytes.Equal(rest, []byte("--"))
+			if len(rest) == 0 || closing {
+				if start >= 0 {
+					end := offset - 2
+					if end < start {
+						end = start
+					}
+					parts = append(parts, body[start:end])
+				}
+				if closing {
+					return parts
+				}
+				start = next
+			}
+		}
+		offset = next
+	}
+	if start >= 0 && start <= len(body) {
+		parts = append(parts, body[start:])
+	}
+	return parts
+}
+
+//child returns body part n (counting from 1) of a multipart or of the
+//message in a message/rfc822 part, part 1 of anything else is itself
+func (p *mimePart) child(n int) *mimePart {
+	target := p
+	if nil != target.message {
+		target = target.message
+	}
+	if len(target.parts) > 0 {
+		if n < 1 || n > len(target.parts) {
+			return nil
+		}
+		return target.parts[n-1]
+	}
+	if n == 1 {
+		return target
+	}
+	return nil
+}
+
+//sectionContent returns the text of a body section, empty if the section
+//does not exist
+func sectionContent(root *mimePart, raw []byte, section *bodySection) []byte {
+	part := root
+	for _, n := range section.part {
+		part = part.child(n)
+		if nil == part {
+			return nil
+		}
+	}
+	if len(section.part) == 0 && section.specifier == "" {
+		return raw
+	}
+
+	message := part
+	if len(section.part) > 0 {
+		switch section.specifier {
+		case "":
+			return part.body
+		case "MIME":
+			return part.header
+		}
+		//HEADER and TEXT of a part only apply to message/rfc822 parts
+		message = part.message
+		if nil == message {
+			return nil
+		}
+	}
+	switch section.specifier {
+	case "HEADER":
+		return message.header
+	case "TEXT":
+		return message.body
+	case "HEADER.FIELDS":
+		return filterHeader(message.header, section.fields, true)
+	case "HEADER.FIELDS.NOT":
+		return filterHeader(message.header, section.fields, false)
+	}
+	return nil
+}
+
+//filterHeader keeps the header fields named in fields, or the ones not
+//named when keep is false, followed by the blank line
+func filterHeader(header []byte, fields []string, keep bool) []byte {
+	wanted := make(map[string]struct{}, len(fields))
+	for _, field := range fields {
+		wanted[strings.ToLower(field)] = struct{}{}
+	}
+	var filtered bytes.Buffer
+	including := false
+	for _, line := range bytes.SplitAfter(header, crlf) {
+		if len(line) == 0 || bytes.Equal(line, crlf) {
+			continue
+		}
+		if line[0] != ' ' && line[0] != '\t' {
+			name, _, _ := bytes.Cut(line, []byte(":"))
+			_, named := wanted[strings.ToLower(strings.TrimSpace(string(name)))]
+			including = named == keep
+		}
+		if including {
+			filtered.Write(line)
+		}
+	}
+	filtered.Write(crlf)
+	return filtered.Bytes()
+}
+
+//envelope formats the ENVELOPE of a message
+func envelope(fields textproto.MIMEHeader) string {
+	from := addressList(fields.Get("From"))
+	sender := addressList(fields.Get("Sender"))
+	if sender == "NIL" {
+		sender = from
+	}
+	replyTo := addressList(fields.Get("Reply-To"))
+	if replyTo == "NIL" {
+		replyTo = from
+	}
+	return imapList([]string{
+		imapNString(fields.Get("Date")),
+		imapNString(fields.Get("Subject")),
+		from,
+		sender,
+		replyTo,
+		addressList(fields.Get("To")),
+		addressList(fields.Get("Cc")),
+		addressList(fields.Get("Bcc")),
+		imapNString(fields.Get("In-Reply-To")),
+		imapNString(fields.Get("Message-Id")),
+	})
+}
+
+func addressList(value string) string {
+	if value == "" {
+		return "NIL"
+	}
+	addresses, err := mail.ParseAddressList(value)
+	if nil != err || len(addresses) == 0 {
+		return "NIL"
+	}
+	formatted := make([]string, 0, len(addresses))
+	for _, address := range addresses {
+		mailbox, host := address.Address, ""
+		at := strings.LastIndexByte(mailbox, '@')
+		if at >= 0 {
+			mailbox, host = mailbox[:at], mailbox[at+1:]
+		}
+		//net/mail decodes encoded-words, put them back for clients
+		//that have not enabled UTF-8
+		name := address.Name
+		if !mailutils.IsASCII(name) {
+			name = mime.QEncoding.Encode("utf-8", name)
+		}
+		formatted = append(formatted, imapList([]string{imapNString(name), "NIL", imapNString(mailbox), imapNString(host)}))
+	}
+	return imapList(formatted)
+}
+
+//bodyStructure formats BODY, or BODYSTRUCTURE with the extension data
+//when extended is set
+func bodyStructure(part *mimePart, extended bool) string {
+	if len(part.parts) > 0 {
+		var structure strings.Builder
+		structure.WriteString("(")
+		for _, child := range part.parts {
+			structure.WriteString(bodyStructure(child, extended))
+		}
+		structure.WriteString(" " + imapString(strings.ToUpper(part.subtype)))
+		if extended {
+			structure.WriteString(" " + paramList(part.params) + " " + disposition(part) + " NIL NIL")
+		}
+		structure.WriteString(")")
+		return structure.String()
+	}
+
+	encoding := strings.ToUpper(part.fields.Get("Content-Transfer-Encoding"))
+	if encoding == "" {
+		encoding = "7BIT"
+	}
+	fields := []string{
+		imapString(strings.ToUpper(part.mediaType)),
+		imapString(strings.ToUpper(part.subtype)),
+		paramList(part.params),
+		imapNString(part.fields.Get("Content-Id")),
+		imapNString(part.fields.Get("Content-Description")),
+		imapString(encoding),
+		strconv.Itoa(len(part.body)),
+	}
+	lines := strconv.Itoa(bytes.Count(part.body, crlf))
+	if nil != part.message {
+		fields = append(fields, envelope(part.message.fields), bodyStructure(part.message, extended), lines)
+	} else if part.mediaType == "text" {
+		fields = append(fields, lines)
+	}
+	if extended {
+		fields = append(fields, "NIL", disposition(part), "NIL", "NIL")
+	}
+	return imapList(fields)
+}
+
+func paramList(params map[string]string) string {
+	if len(params) == 0 {
+		return "NIL"
+	}
+	names := make([]string, 0, len(params))
+	for name := range params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	list := make([]string, 0, 2*len(names))
+	for _, name := range names {
+		list = append(list, imapString(strings.ToUpper(name)), imapString(params[name]))
+	}
+	return imapList(list)
+}
+
+func disposition(part *mimePart) string {
+	value, params, err := mime.ParseMediaType(part.fields.Get("Content-Disposition"))
+	if nil != err {
+		return "NIL"
+	}
+	return imapList([]string{imapString(strings.ToUpper(value)), paramList(params)})
+}
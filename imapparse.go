@@ -0,0 +1,446 @@
+package main
+
+/*
+    s3pop-server: An AWS S3 backed POP3 server
+	Copyright (C) 2018 James W Matheson
+	fractal.mango@gmail.com
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+//Reading and parsing IMAP commands (RFC 3501 section 9) and quoting
+//strings for responses
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/FractalJim/s3pop-server/mailutils"
+)
+
+var errIMAPSyntax = errors.New("syntax error")
+
+//errLiteralRefused is returned for a synchronising literal that is too
+//large, the client has not sent it so the session can carry on
+var errLiteralRefused = errors.New("literal too large")
+
+//errLiteralTooLarge is returned for a non-synchronising literal that is
+//too large, it is already on its way so the session has to end
+var errLiteralTooLarge = errors.New("literal too large")
+
+//imapArg is one argument of a command: an atom, a string or a
+//parenthesised list
+type imapArg struct {
+	value  string
+	list   []*imapArg
+	isList bool
+	//isString is set for quoted strings and literals, which are never NIL
+	isString bool
+}
+
+//readIMAPCommand reads a command line along with any literals in it,
+//asking the client for each synchronising literal with a continuation
+//request. The command is returned as sent, literals included. Each line
+//is limited to maxLength, each literal to maxLiteral and the whole
+//command to maxCommand.
+func readIMAPCommand(reader *bufio.Reader, conn *bufferedConn, maxLength int, maxLiteral int, maxCommand int) (string, error) {
+	var command strings.Builder
+	for {
+		lineLimit := maxLength
+		if remaining := maxCommand - command.Len(); remaining < lineLimit {
+			lineLimit = remaining
+		}
+		line, err := readLine(reader, lineLimit)
+		if nil != err {
+			return command.String(), err
+		}
+		command.WriteString(line)
+		size, synchronising, ok := literalSize(line)
+		if !ok {
+			return command.String(), nil
+		}
+		if size > maxLiteral || size > maxCommand-command.Len() {
+			if synchronising {
+				return command.String(), errLiteralRefused
+			}
+			return command.String(), errLiteralTooLarge
+		}
+		if synchronising {
+			io.WriteString(conn, "+ Ready for literal data"+eol)
+			conn.Flush()
+		}
+		literal := make([]byte, size)
+		_, err = io.ReadFull(reader, literal)
+		if nil != err {
+			return command.String(), err
+		}
+		command.Write(literal)
+	}
+}
+
+//literalSize finds the {size} or {size+} that announces a literal at the
+//end of a line
+func literalSize(line string) (size int, synchronising bool, ok bool) {
+	line = strings.TrimRight(line, "\r\n")
+	if !strings.HasSuffix(line, "}") {
+		return 0, false, false
+	}
+	open := strings.LastIndexByte(line, '{')
+	if open < 0 {
+		return 0, false, false
+	}
+	digits := line[open+1 : len(line)-1]
+	synchronising = !strings.HasSuffix(digits, "+")
+	size, err := strconv.Atoi(strings.TrimSuffix(digits, "+"))
+	if nil != err || size < 0 {
+		return 0, false, false
+	}
+	return size, synchronising, true
+}
+
+//imapParser splits a command read by readIMAPCommand into arguments
+type imapParser struct {
+	input string
+	pos   int
+}
+
+//parseIMAPCommand returns the tag, the upper case command name and the
+//arguments of a command. UID commands are named with both words, such as
+//"UID FETCH". The tag is returned if it could be read even when the rest
+//of the command is malformed.
+func parseIMAPCommand(line string) (tag string, command string, args []*imapArg, err error) {
+	parser := &imapParser{input: strings.TrimRight(line, "\r\n")}
+	tag = parser.atom()
+	if tag == "" || strings.ContainsAny(tag, "+\"{") || !parser.space() {
+		return "", "", nil, errIMAPSyntax
+	}
+	command = strings.ToUpper(parser.atom())
+	if command == "" {
+		return tag, "", nil, errIMAPSyntax
+	}
+	if command == "UID" {
+		if !parser.space() {
+			return tag, "", nil, errIMAPSyntax
+		}
+		command += " " + strings.ToUpper(parser.atom())
+	}
+	for !parser.atEnd() {
+		if !parser.space() {
+			return tag, command, nil, errIMAPSyntax
+		}
+		arg, err := parser.arg()
+		if nil != err {
+			return tag, command, nil, err
+		}
+		args = append(args, arg)
+	}
+	return tag, command, args, nil
+}
+
+func (p *imapParser) atEnd() bool {
+	return p.pos >= len(p.input)
+}
+
+func (p *imapParser) space() bool {
+	if p.atEnd() || p.input[p.pos] != ' ' {
+		return false
+	}
+	p.pos++
+	return true
+}
+
+//atom reads up to the next delimiter. A section in brackets, such as
+//BODY[HEADER.FIELDS (FROM TO)], is read as part of the atom.
+func (p *imapParser) atom() string {
+	start := p.pos
+	for !p.atEnd() {
+		switch p.input[p.pos] {
+		case ' ', '(', ')', '\r', '\n':
+			return p.input[start:p.pos]
+		case '[':
+			end := strings.IndexByte(p.input[p.pos:], ']')
+			if end < 0 {
+				p.pos = len(p.input)
+				return p.input[start:]
+			}
+			p.pos += end + 1
+		default:
+			p.pos++
+		}
+	}
+	return p.input[start:p.pos]
+}
+
+func (p *imapParser) arg() (*imapArg, error) {
+	if p.atEnd() {
+		return nil, errIMAPSyntax
+	}
+	switch p.input[p.pos] {
+	case '(':
+		p.pos++
+		list := &imapArg{isList: true}
+		for {
+			if p.atEnd() {
+				return nil, errIMAPSyntax
+			}
+			if p.input[p.pos] == ')' {
+				p.pos++
+				return list, nil
+			}
+			if len(list.list) > 0 && !p.space() {
+				return nil, errIMAPSyntax
+			}
+			item, err := p.arg()
+			if nil != err {
+				return nil, err
+			}
+			list.list = append(list.list, item)
+		}
+	case '"':
+		return p.quoted()
+	case '{':
+		return p.literal()
+	}
+	value := p.atom()
+	if value == "" {
+		return nil, errIMAPSyntax
+	}
+	return &imapArg{value: value}, nil
+}
+
+func (p *imapParser) quoted() (*imapArg, error) {
+	var value strings.Builder
+	p.pos++
+	for !p.atEnd() {
+		c := p.input[p.pos]
+		p.pos++
+		switch c {
+		case '"':
+			return &imapArg{value: value.String(), isString: true}, nil
+		case '\\':
+			if p.atEnd() {
+				return nil, errIMAPSyntax
+			}
+			value.WriteByte(p.input[p.pos])
+			p.pos++
+		case '\r', '\n':
+			return nil, errIMAPSyntax
+		default:
+			value.WriteByte(c)
+		}
+	}
+	return nil, errIMAPSyntax
+}
+
+func (p *imapParser) literal() (*imapArg, error) {
+	end := strings.Index(p.input[p.pos:], "}\r\n")
+	if end < 0 {
+		return nil, errIMAPSyntax
+	}
+	size, err := strconv.Atoi(strings.TrimSuffix(p.input[p.pos+1:p.pos+end], "+"))
+	if nil != err || size < 0 {
+		return nil, errIMAPSyntax
+	}
+	p.pos += end + 3
+	if p.pos+size > len(p.input) {
+		return nil, errIMAPSyntax
+	}
+	value := p.input[p.pos : p.pos+size]
+	p.pos += size
+	return &imapArg{value: value, isString: true}, nil
+}
+
+//astring returns the value of an atom or string argument
+func (arg *imapArg) astring() (string, bool) {
+	if arg.isList {
+		return "", false
+	}
+	return arg.value, true
+}
+
+//seqRange is a range from a sequence set, zero stands for "*"
+type seqRange struct {
+	start uint32
+	end   uint32
+}
+
+type seqSet []seqRange
+
+func parseSeqSet(text string) (seqSet, error) {
+	set := make(seqSet, 0)
+	for _, item := range strings.Split(text, ",") {
+		first, last, isRange := strings.Cut(item, ":")
+		start, err := parseSeqNumber(first)
+		if nil != err {
+			return nil, err
+		}
+		end := start
+		if isRange {
+			end, err = parseSeqNumber(last)
+			if nil != err {
+				return nil, err
+			}
+		}
+		set = append(set, seqRange{start: start, end: end})
+	}
+	return set, nil
+}
+
+func parseSeqNumber(text string) (uint32, error) {
+	if text == "*" {
+		return 0, nil
+	}
+	number, err := strconv.ParseUint(text, 10, 32)
+	if nil != err || number == 0 {
+		return 0, errIMAPSyntax
+	}
+	return uint32(number), nil
+}
+
+//contains reports whether n is in the set, largest is the value of "*"
+func (set seqSet) contains(n uint32, largest uint32) bool {
+	for _, r := range set {
+		start, end := r.start, r.end
+		if start == 0 {
+			start = largest
+		}
+		if end == 0 {
+			end = largest
+		}
+		if start > end {
+			start, end = end, start
+		}
+		if n >= start && n <= end {
+			return true
+		}
+	}
+	return false
+}
+
+//imapString formats text as a quoted string, or as a literal if it cannot
+//be quoted
+func imapString(text string) string {
+	if len(text) > 1024 || strings.ContainsAny(text, "\r\n\x00") || !mailutils.IsASCII(text) {
+		return "{" + strconv.Itoa(len(text)) + "}" + eol + text
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(text) + `"`
+}
+
+//imapNString is imapString with NIL for an empty value
+func imapNString(text string) string {
+	if text == "" {
+		return "NIL"
+	}
+	return imapString(text)
+}
+
+//imapList formats items as a parenthesised list
+func imapList(items []string) string {
+	return "(" + strings.Join(items, " ") + ")"
+}
+
+//isKeyword checks a flag set by a filter can be shown to clients, either
+//one of the system flags a filter may set or a keyword atom (RFC 3501
+//section 9, flag-keyword)
+func isKeyword(flag string) bool {
+	switch strings.ToLower(flag) {
+	case `\answered`, `\flagged`, `\draft`:
+		return true
+	}
+	if flag == "" {
+		return false
+	}
+	for i := 0; i < len(flag); i++ {
+		c := flag[i]
+		if c <= ' ' || c >= 0x7f || strings.IndexByte(`(){%*"\]`, c) >= 0 {
+			return false
+		}
+	}
+	return true
+}
+
+//mailboxBase64 is the base64 variant used by modified UTF-7, with , in
+//place of / and no padding
+var mailboxBase64 = base64.NewEncoding("ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+,").WithPadding(base64.NoPadding)
+
+//encodeMailboxName converts a folder name to the modified UTF-7 form IMAP
+//uses for mailbox names (RFC 3501 section 5.1.3)
+func encodeMailboxName(name string) string {
+	var encoded strings.Builder
+	var pending []rune
+	flush := func() {
+		if len(pending) == 0 {
+			return
+		}
+		units := utf16.Encode(pending)
+		raw := make([]byte, 0, 2*len(units))
+		for _, unit := range units {
+			raw = append(raw, byte(unit>>8), byte(unit))
+		}
+		encoded.WriteString("&" + mailboxBase64.EncodeToString(raw) + "-")
+		pending = pending[:0]
+	}
+	for _, r := range name {
+		if r >= 0x20 && r <= 0x7e {
+			flush()
+			if r == '&' {
+				encoded.WriteString("&-")
+			} else {
+				encoded.WriteRune(r)
+			}
+			continue
+		}
+		pending = append(pending, r)
+	}
+	flush()
+	return encoded.String()
+}
+
+//decodeMailboxName converts a modified UTF-7 mailbox name from a client
+//back to UTF-8
+func decodeMailboxName(name string) (string, bool) {
+	var decoded strings.Builder
+	for {
+		start := strings.IndexByte(name, '&')
+		if start < 0 {
+			decoded.WriteString(name)
+			return decoded.String(), true
+		}
+		decoded.WriteString(name[:start])
+		end := strings.IndexByte(name[start:], '-')
+		if end < 0 {
+			return "", false
+		}
+		shifted := name[start+1 : start+end]
+		name = name[start+end+1:]
+		if shifted == "" {
+			decoded.WriteByte('&')
+			continue
+		}
+		raw, err := mailboxBase64.DecodeString(shifted)
+		if nil != err || len(raw)%2 != 0 {
+			return "", false
+		}
+		units := make([]uint16, 0, len(raw)/2)
+		for i := 0; i < len(raw); i += 2 {
+			units = append(units, uint16(raw[i])<<8|uint16(raw[i+1]))
+		}
+		decoded.WriteString(string(utf16.Decode(units)))
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+/*
+    s3pop-server: An AWS S3 backed POP3 server
+	Copyright (C) 2018 James W Matheson
+	fractal.mango@gmail.com
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+
+import (
+	"bufio"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+//discardConn stands in for the client, continuation requests sent to it
+//are dropped
+type discardConn struct {
+	net.Conn
+}
+
+func (discardConn) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func TestReadIMAPCommandLimits(t *testing.T) {
+	literal := strings.Repeat("x", 100)
+	tests := []struct {
+		name    string
+		input   string
+		command string
+		err     error
+	}{
+		{"plain", "a NOOP\r\n", "a NOOP\r\n", nil},
+		{"literal", "a LOGIN {3}\r\nbob {3+}\r\npwd\r\n", "a LOGIN {3}\r\nbob {3+}\r\npwd\r\n", nil},
+		{"line too long", "a " + strings.Repeat("X", 300) + "\r\nb NOOP\r\n", "", errLineTooLong},
+		{"literal too large", "a LOGIN {101}\r\n", "a LOGIN {101}\r\n", errLiteralRefused},
+		{"non-synchronising literal too large", "a LOGIN {101+}\r\n", "a LOGIN {101+}\r\n", errLiteralTooLarge},
+		{"too many literals", "a SEARCH" + strings.Repeat(" TEXT {100+}\r\n"+literal, 5) + "\r\n", "", errLiteralTooLarge},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reader := bufio.NewReader(strings.NewReader(test.input))
+			command, err := readIMAPCommand(reader, newBufferedConn(discardConn{}), 256, 100, 256+200)
+			if err != test.err {
+				t.Fatalf("err = %v, want %v", err, test.err)
+			}
+			if nil == err && command != test.command {
+				t.Errorf("command = %q, want %q", command, test.command)
+			}
+			if err == errLiteralRefused && command != test.command {
+				t.Errorf("command = %q, want %q", command, test.command)
+			}
+		})
+	}
+}
+
+//formatArgs writes arguments back out with strings quoted, so parsed
+//commands can be compared as text
+func formatArgs(args []*imapArg) string {
+	items := make([]string, 0, len(args))
+	for _, arg := range args {
+		switch {
+		case arg.isList:
+			items = append(items, "("+formatArgs(arg.list)+")")
+		case arg.isString:
+			items = append(items, strconv.Quote(arg.value))
+		default:
+			items = append(items, arg.value)
+		}
+	}
+	return strings.Join(items, " ")
+}
+
+func TestParseIMAPCommand(t *testing.T) {
+	tests := []struct {
+		name    string
+		line    string
+		tag     string
+		command string
+		args    string
+		err     bool
+	}{
+		{"no arguments", "a1 noop\r\n", "a1", "NOOP", "", false},
+		{"quoted string", `a2 LOGIN bob "pass word"`, "a2", "LOGIN", `bob "pass word"`, false},
+		{"escapes", `a3 LOGIN bob "a\"b\\c"`, "a3", "LOGIN", `bob "a\"b\\c"`, false},
+		{"empty string", `a4 LOGIN "" ""`, "a4", "LOGIN", `"" ""`, false},
+		{"literals", "a5 LOGIN {3}\r\nbob {2+}\r\npw\r\n", "a5", "LOGIN", `"bob" "pw"`, false},
+		{"uid command", "a6 uid fetch 1:* (FLAGS BODY.PEEK[HEADER.FIELDS (FROM TO)])", "a6", "UID FETCH", "1:* (FLAGS BODY.PEEK[HEADER.FIELDS (FROM TO)])", false},
+		{"nested lists", "a7 SEARCH (OR (SEEN) (FLAGGED)) ()", "a7", "SEARCH", "(OR (SEEN) (FLAGGED)) ()", false},
+		{"no tag", "NOOP", "", "", "", true},
+		{"bad tag", "+ NOOP", "", "", "", true},
+		{"no command", "a8 ", "a8", "", "", true},
+		{"uid alone", "a9 UID", "a9", "", "", true},
+		{"double space", "b1 NOOP  x", "b1", "NOOP", "", true},
+		{"unterminated string", `b2 LOGIN "bob`, "b2", "LOGIN", "", true},
+		{"unterminated list", "b3 FETCH 1 (FLAGS", "b3", "FETCH", "", true},
+		{"list without spaces", "b4 FETCH 1 (FLAGS(UID))", "b4", "FETCH", "", true},
+		{"short literal", "b5 LOGIN {5}\r\nbob", "b5", "LOGIN", "", true},
+		{"bad literal size", "b6 LOGIN {x}\r\nbob", "b6", "LOGIN", "", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tag, command, args, err := parseIMAPCommand(test.line)
+			if (nil != err) != test.err {
+				t.Fatalf("err = %v, want error %v", err, test.err)
+			}
+			if tag != test.tag || command != test.command {
+				t.Errorf("tag, command = %q, %q, want %q, %q", tag, command, test.tag, test.command)
+			}
+			if formatted := formatArgs(args); formatted != test.args {
+				t.Errorf("args = %s, want %s", formatted, test.args)
+			}
+		})
+	}
+}
+
+func TestParseSeqSet(t *testing.T) {
+	tests := []struct {
+		text string
+		set  seqSet
+		err  bool
+	}{
+		{"1", seqSet{{1, 1}}, false},
+		{"*", seqSet{{0, 0}}, false},
+		{"1:*", seqSet{{1, 0}}, false},
+		{"2,4:6,*:3", seqSet{{2, 2}, {4, 6}, {0, 3}}, false},
+		{"4294967295", seqSet{{4294967295, 4294967295}}, false},
+		{"", nil, true},
+		{"0", nil, true},
+		{"1:", nil, true},
+		{"1,", nil, true},
+		{"a", nil, true},
+		{"-1", nil, true},
+		{"1:2:3", nil, true},
+		{"4294967296", nil, true},
+	}
+	for _, test := range tests {
+		set, err := parseSeqSet(test.text)
+		if (nil != err) != test.err {
+			t.Errorf("parseSeqSet(%q) err = %v, want error %v", test.text, err, test.err)
+			continue
+		}
+		if !reflect.DeepEqual(set, test.set) {
+			t.Errorf("parseSeqSet(%q) = %v, want %v", test.text, set, test.set)
+		}
+	}
+}
+
+func TestSeqSetContains(t *testing.T) {
+	tests := []struct {
+		text    string
+		largest uint32
+		in      []uint32
+		out     []uint32
+	}{
+		{"2,4:6", 10, []uint32{2, 4, 5, 6}, []uint32{1, 3, 7}},
+		{"6:4", 10, []uint32{4, 5, 6}, []uint32{3, 7}},
+		{"*", 7, []uint32{7}, []uint32{6, 8}},
+		{"5:*", 7, []uint32{5, 6, 7}, []uint32{4, 8}},
+		//a range past the largest value still matches the largest
+		{"9:*", 7, []uint32{7, 8, 9}, []uint32{6, 10}},
+		{"*", 0, nil, []uint32{1}},
+	}
+	for _, test := range tests {
+		set, err := parseSeqSet(test.text)
+		if nil != err {
+			t.Fatalf("parseSeqSet(%q): %v", test.text, err)
+		}
+		for _, n := range test.in {
+			if !set.contains(n, test.largest) {
+				t.Errorf("%q with * = %d does not contain %d", test.text, test.largest, n)
+			}
+		}
+		for _, n := range test.out {
+			if set.contains(n, test.largest) {
+				t.Errorf("%q with * = %d contains %d", test.text, test.largest, n)
+			}
+		}
+	}
+}
+
+func TestMailboxNames(t *testing.T) {
+	tests := []struct {
+		name    string
+		encoded string
+	}{
+		{"INBOX", "INBOX"},
+		{"Tom & Jerry", "Tom &- Jerry"},
+		{"Entwürfe", "Entw&APw-rfe"},
+		{"~peter/mail/台北/日本語", "~peter/mail/&U,BTFw-/&ZeVnLIqe-"},
+	}
+	for _, test := range tests {
+		if encoded := encodeMailboxName(test.name); encoded != test.encoded {
+			t.Errorf("encodeMailboxName(%q) = %q, want %q", test.name, encoded, test.encoded)
+		}
+		decoded, ok := decodeMailboxName(test.encoded)
+		if !ok || decoded != test.name {
+			t.Errorf("decodeMailboxName(%q) = %q, %v, want %q", test.encoded, decoded, ok, test.name)
+		}
+	}
+	for _, bad := range []string{"&U,BTFw", "&!!-"} {
+		if _, ok := decodeMailboxName(bad); ok {
+			t.Errorf("decodeMailboxName(%q) accepted a malformed name", bad)
+		}
+	}
+}
+
+func TestIsKeyword(t *testing.T) {
+	for _, flag := range []string{`\Answered`, `\flagged`, `\Draft`, "$Junk", "Work"} {
+		if !isKeyword(flag) {
+			t.Errorf("isKeyword(%q) = false", flag)
+		}
+	}
+	for _, flag := range []string{"", `\Seen`, `\Deleted`, `\Recent`, "two words", "a(b", "a]b", "100%", "café"} {
+		if isKeyword(flag) {
+			t.Errorf("isKeyword(%q) = true", flag)
+		}
+	}
+}
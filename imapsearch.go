@@ -0,0 +1,337 @@
+package main
+
+/*
+    s3pop-server: An AWS S3 backed POP3 server
+	Copyright (C) 2018 James W Matheson
+	fractal.mango@gmail.com
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+//SEARCH for the IMAP front-end (RFC 3501 section 6.4.4)
+
+import (
+	"bytes"
+	"mime"
+	"net/mail"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const imapDateLayout = "2-Jan-2006"
+
+//searchContext is the message a search is being tested against, the
+//message file is only read if a key needs it
+type searchContext struct {
+	session *imapSession
+	seq     uint32
+	message *imapMessage
+	raw     []byte
+	root    *mimePart
+	loaded  bool
+}
+
+func (c *searchContext) content() *mimePart {
+	if !c.loaded {
+		c.loaded = true
+		raw, err := loadMessage(c.session.emailDir, c.message.data)
+		if nil != err {
+			c.session.log.Warn("could not read message for search", "uid", c.message.data.ID, "error", err)
+			raw = nil
+		}
+		c.raw = raw
+		c.root = parseMIMEPart(raw, "text/plain; charset=us-ascii")
+	}
+	return c.root
+}
+
+func (c *searchContext) headerContains(field string, text string) bool {
+	for _, value := range c.content().fields.Values(field) {
+		if containsFold(value, text) {
+			return true
+		}
+		decoded, err := new(mime.WordDecoder).DecodeHeader(value)
+		if nil == err && containsFold(decoded, text) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *searchContext) sentDate() time.Time {
+	sent, err := mail.ParseDate(c.content().fields.Get("Date"))
+	if nil != err {
+		return time.Time{}
+	}
+	return sent
+}
+
+func containsFold(value string, text string) bool {
+	return strings.Contains(strings.ToLower(value), strings.ToLower(text))
+}
+
+//searchTest reports whether a message matches a search key
+type searchTest func(c *searchContext) bool
+
+//searchParser turns the arguments of SEARCH into a test
+type searchParser struct {
+	args    []*imapArg
+	pos     int
+	session *imapSession
+}
+
+//parseSearch parses the search keys, all of which must match
+func parseSearch(session *imapSession, args []*imapArg) (searchTest, error) {
+	parser := &searchParser{args: args, session: session}
+	if len(args) >= 2 && strings.EqualFold(args[0].value, "CHARSET") && !args[0].isList {
+		charset := strings.ToUpper(args[1].value)
+		if charset != "US-ASCII" && charset != "UTF-8" {
+			return nil, imapNo("[BADCHARSET (US-ASCII UTF-8)] Unsupported charset")
+		}
+		parser.pos = 2
+	}
+	var tests []searchTest
+	for parser.pos < len(parser.args) {
+		test, err := parser.key()
+		if nil != err {
+			return nil, err
+		}
+		tests = append(tests, test)
+	}
+	if len(tests) == 0 {
+		return nil, errIMAPSyntax
+	}
+	return allOf(tests), nil
+}
+
+func allOf(tests []searchTest) searchTest {
+	return func(c *searchContext) bool {
+		for _, test := range tests {
+			if !test(c) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+func (p *searchParser) next() (*imapArg, error) {
+	if p.pos >= len(p.args) {
+		return nil, errIMAPSyntax
+	}
+	arg := p.args[p.pos]
+	p.pos++
+	return arg, nil
+}
+
+func (p *searchParser) text() (string, error) {
+	arg, err := p.next()
+	if nil != err {
+		return "", err
+	}
+	text, ok := arg.astring()
+	if !ok {
+		return "", errIMAPSyntax
+	}
+	return text, nil
+}
+
+func (p *searchParser) date() (time.Time, error) {
+	text, err := p.text()
+	if nil != err {
+		return time.Time{}, err
+	}
+	date, err := time.Parse(imapDateLayout, text)
+	if nil != err {
+		return time.Time{}, errIMAPSyntax
+	}
+	return date, nil
+}
+
+func (p *searchParser) number() (int, error) {
+	text, err := p.text()
+	if nil != err {
+		return 0, err
+	}
+	number, err := strconv.Atoi(text)
+	if nil != err || number < 0 {
+		return 0, errIMAPSyntax
+	}
+	return number, nil
+}
+
+//flagTests are the keys that only look at flags. Messages never have
+//\Recent set, and only have \Answered, \Flagged or \Draft when a filter
+//set them.
+var flagTests = map[string]searchTest{
+	"ALL":        func(c *searchContext) bool { return true },
+	"SEEN":       func(c *searchContext) bool { return c.message.data.Read },
+	"UNSEEN":     func(c *searchContext) bool { return !c.message.data.Read },
+	"DELETED":    func(c *searchContext) bool { return c.message.deleted },
+	"UNDELETED":  func(c *searchContext) bool { return !c.message.deleted },
+	"ANSWERED":   func(c *searchContext) bool { return c.message.hasKeyword(`\Answered`) },
+	"UNANSWERED": func(c *searchContext) bool { return !c.message.hasKeyword(`\Answered`) },
+	"FLAGGED":    func(c *searchContext) bool { return c.message.hasKeyword(`\Flagged`) },
+	"UNFLAGGED":  func(c *searchContext) bool { return !c.message.hasKeyword(`\Flagged`) },
+	"DRAFT":      func(c *searchContext) bool { return c.message.hasKeyword(`\Draft`) },
+	"UNDRAFT":    func(c *searchContext) bool { return !c.message.hasKeyword(`\Draft`) },
+	"RECENT":     func(c *searchContext) bool { return false },
+	"NEW":        func(c *searchContext) bool { return false },
+	"OLD":        func(c *searchContext) bool { return true },
+}
+
+//headerKeys are the keys that search a header field
+var headerKeys = map[string]string{
+	"FROM": "From", "TO": "To", "CC": "Cc", "BCC": "Bcc", "SUBJECT": "Subject",
+}
+
+func (p *searchParser) key() (searchTest, error) {
+	arg, err := p.next()
+	if nil != err {
+		return nil, err
+	}
+	if arg.isList {
+		tests := make([]searchTest, 0, len(arg.list))
+		inner := &searchParser{args: arg.list, session: p.session}
+		for inner.pos < len(inner.args) {
+			test, err := inner.key()
+			if nil != err {
+				return nil, err
+			}
+			tests = append(tests, test)
+		}
+		return allOf(tests), nil
+	}
+
+	name := strings.ToUpper(arg.value)
+	if test, ok := flagTests[name]; ok {
+		return test, nil
+	}
+	if field, ok := headerKeys[name]; ok {
+		text, err := p.text()
+		if nil != err {
+			return nil, err
+		}
+		return func(c *searchContext) bool { return c.headerContains(field, text) }, nil
+	}
+
+	switch name {
+	case "NOT":
+		test, err := p.key()
+		if nil != err {
+			return nil, err
+		}
+		return func(c *searchContext) bool { return !test(c) }, nil
+	case "OR":
+		first, err := p.key()
+		if nil != err {
+			return nil, err
+		}
+		second, err := p.key()
+		if nil != err {
+			return nil, err
+		}
+		return func(c *searchContext) bool { return first(c) || second(c) }, nil
+	case "HEADER":
+		field, err := p.text()
+		if nil != err {
+			return nil, err
+		}
+		text, err := p.text()
+		if nil != err {
+			return nil, err
+		}
+		return func(c *searchContext) bool { return c.headerContains(field, text) }, nil
+	case "BODY", "TEXT":
+		text, err := p.text()
+		if nil != err {
+			return nil, err
+		}
+		needle := []byte(strings.ToLower(text))
+		return func(c *searchContext) bool {
+			searched := c.content().body
+			if name == "TEXT" {
+				searched = c.raw
+			}
+			return bytes.Contains(bytes.ToLower(searched), needle)
+		}, nil
+	case "KEYWORD", "UNKEYWORD":
+		//keywords are only set by filters
+		keyword, err := p.text()
+		if nil != err {
+			return nil, err
+		}
+		return func(c *searchContext) bool {
+			return c.message.hasKeyword(keyword) == (name == "KEYWORD")
+		}, nil
+	case "BEFORE", "ON", "SINCE", "SENTBEFORE", "SENTON", "SENTSINCE":
+		date, err := p.date()
+		if nil != err {
+			return nil, err
+		}
+		return dateTest(name, date), nil
+	case "LARGER", "SMALLER":
+		size, err := p.number()
+		if nil != err {
+			return nil, err
+		}
+		if name == "LARGER" {
+			return func(c *searchContext) bool { return c.message.data.TotalSize > size }, nil
+		}
+		return func(c *searchContext) bool { return c.message.data.TotalSize < size }, nil
+	case "UID":
+		text, err := p.text()
+		if nil != err {
+			return nil, err
+		}
+		set, err := parseSeqSet(text)
+		if nil != err {
+			return nil, err
+		}
+		largest := p.session.largestUID()
+		return func(c *searchContext) bool { return set.contains(uint32(c.message.data.ID), largest) }, nil
+	}
+
+	set, err := parseSeqSet(arg.value)
+	if nil != err {
+		return nil, err
+	}
+	largest := uint32(len(p.session.messages))
+	return func(c *searchContext) bool { return set.contains(c.seq, largest) }, nil
+}
+
+//dateTest compares dates ignoring the time of day, the internal date for
+//BEFORE, ON and SINCE and the Date header for the SENT keys
+func dateTest(name string, date time.Time) searchTest {
+	return func(c *searchContext) bool {
+		var when time.Time
+		if strings.HasPrefix(name, "SENT") {
+			when = c.sentDate()
+			if when.IsZero() {
+				return false
+			}
+		} else {
+			when = internalDate(c.session.emailDir, c.message.data)
+		}
+		day := time.Date(when.Year(), when.Month(), when.Day(), 0, 0, 0, 0, time.UTC)
+		switch strings.TrimPrefix(name, "SENT") {
+		case "BEFORE":
+			return day.Before(date)
+		case "ON":
+			return day.Equal(date)
+		}
+		return !day.Before(date)
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+/*
+    s3pop-server: An AWS S3 backed POP3 server
+	Copyright (C) 2018 James W Matheson
+	fractal.mango@gmail.com
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/FractalJim/s3pop-server/mailutils"
+)
+
+const searchEmail = "From: Alice <alice@example.com>\r\n" +
+	"To: bob@example.com\r\n" +
+	"Subject: =?UTF-8?Q?Gr=C3=BC=C3=9Fe?= from the lake\r\n" +
+	"Date: Tue, 14 Mar 2023 09:30:00 +0000\r\n" +
+	"X-Project: Heron\r\n" +
+	"\r\n" +
+	"The boat is ready.\r\n"
+
+//searchSession is a selected mailbox of three messages with UIDs 3, 7
+//and 9, the second read and flagged and the third deleted
+func searchSession() *imapSession {
+	return &imapSession{messages: []*imapMessage{
+		{data: &mailutils.MailData{ID: 3, TotalSize: 100}},
+		{data: &mailutils.MailData{ID: 7, TotalSize: 2000, Read: true, Flags: []string{`\Flagged`, "$Work"}}},
+		{data: &mailutils.MailData{ID: 9, TotalSize: 500}, deleted: true},
+	}}
+}
+
+//search returns the sequence numbers of the messages matching a SEARCH
+//command's arguments, every message having the same content
+func search(t *testing.T, keys string) ([]uint32, error) {
+	_, _, args, err := parseIMAPCommand(strings.TrimSpace("a SEARCH " + keys))
+	if nil != err {
+		t.Fatalf("parseIMAPCommand(%q): %v", keys, err)
+	}
+	session := searchSession()
+	test, err := parseSearch(session, args)
+	if nil != err {
+		return nil, err
+	}
+	var matched []uint32
+	for i, message := range session.messages {
+		raw := []byte(searchEmail)
+		c := &searchContext{session: session, seq: uint32(i + 1), message: message,
+			raw: raw, root: parseMIMEPart(raw, "text/plain; charset=us-ascii"), loaded: true}
+		if test(c) {
+			matched = append(matched, c.seq)
+		}
+	}
+	return matched, nil
+}
+
+func TestSearchKeys(t *testing.T) {
+	tests := []struct {
+		keys    string
+		matched string
+	}{
+		{"ALL", "1 2 3"},
+		{"SEEN", "2"},
+		{"UNSEEN", "1 3"},
+		{"DELETED", "3"},
+		{"UNDELETED", "1 2"},
+		{"FLAGGED", "2"},
+		{"UNFLAGGED", "1 3"},
+		{"ANSWERED", ""},
+		{"RECENT", ""},
+		{"OLD", "1 2 3"},
+		{"KEYWORD $work", "2"},
+		{"UNKEYWORD $Work", "1 3"},
+		{"2:3", "2 3"},
+		{"*", "3"},
+		{"UID 7:*", "2 3"},
+		{"UID 4:6", ""},
+		{"LARGER 100", "2 3"},
+		{"SMALLER 500", "1"},
+		{"FROM ALICE", "1 2 3"},
+		{"TO carol", ""},
+		{`SUBJECT "grüße"`, "1 2 3"},
+		{"SUBJECT lake", "1 2 3"},
+		{"HEADER X-Project heron", "1 2 3"},
+		{"HEADER X-Missing heron", ""},
+		{"BODY boat", "1 2 3"},
+		{"BODY Heron", ""},
+		{"TEXT Heron", "1 2 3"},
+		{"SENTON 14-Mar-2023", "1 2 3"},
+		{"SENTSINCE 15-Mar-2023", ""},
+		{"SENTBEFORE 15-Mar-2023", "1 2 3"},
+		{"NOT SEEN", "1 3"},
+		{"OR SEEN DELETED", "2 3"},
+		{"OR (SEEN FLAGGED) 1", "1 2"},
+		{"UNSEEN UNDELETED", "1"},
+		{"CHARSET UTF-8 SEEN", "2"},
+		{"seen not deleted", "2"},
+	}
+	for _, test := range tests {
+		t.Run(test.keys, func(t *testing.T) {
+			matched, err := search(t, test.keys)
+			if nil != err {
+				t.Fatalf("parseSearch: %v", err)
+			}
+			seqs := make([]string, 0, len(matched))
+			for _, seq := range matched {
+				seqs = append(seqs, strconv.Itoa(int(seq)))
+			}
+			if text := strings.Join(seqs, " "); text != test.matched {
+				t.Errorf("matched %q, want %q", text, test.matched)
+			}
+		})
+	}
+}
+
+func TestSearchErrors(t *testing.T) {
+	for _, keys := range []string{
+		"",
+		"FROM",
+		"NOT",
+		"OR SEEN",
+		"LARGER x",
+		"LARGER -1",
+		"SINCE 2023-03-14",
+		"UID 0",
+		"BOGUS",
+		"(SEEN FROM)",
+		"CHARSET KOI8-R SEEN",
+	} {
+		if _, err := search(t, keys); nil == err {
+			t.Errorf("SEARCH %s was accepted", keys)
+		}
+	}
+}
@@ -0,0 +1,359 @@
+package main
+
+/*
+    s3pop-server: An AWS S3 backed POP3 server
+	Copyright (C) 2018 James W Matheson
+	fractal.mango@gmail.com
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+//Importing email from mbox files, Maildirs and .eml files
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/FractalJim/s3pop-server/backend"
+	"github.com/FractalJim/s3pop-server/mailutils"
+)
+
+const (
+	IMPORT_AUTO    = "auto"
+	IMPORT_MBOX    = "mbox"
+	IMPORT_MAILDIR = "maildir"
+	IMPORT_EML     = "eml"
+)
+
+//importMessage is one email read from the source, folder being relative
+//to the folder imported into
+type importMessage struct {
+	folder  string
+	content []byte
+	flags   []string
+	//origin says where the email came from in error messages
+	origin string
+}
+
+func importCommand(args []string) int {
+	flags := newFlagSet("import")
+	format := flags.String("format", IMPORT_AUTO, "mbox, maildir, eml or auto to tell from the source")
+	folder := flags.String("folder", "", "import into this folder instead of the top level")
+	dryRun := flags.Bool("dry-run", false, "count the email that would be imported")
+	if !parseArgs(flags, args, 2, 2) {
+		return EXIT_USAGE
+	}
+	mailbox, source := flags.Arg(0), flags.Arg(1)
+	if !mailutils.ValidFolder(*folder) {
+		fmt.Fprintf(os.Stderr, "Folder %q is not a usable folder name\n", *folder)
+		return EXIT_USAGE
+	}
+	if *format == IMPORT_AUTO {
+		*format = detectImportFormat(source)
+	}
+	var read func(string, func(*importMessage) error) error
+	switch *format {
+	case IMPORT_MBOX:
+		read = readMbox
+	case IMPORT_MAILDIR:
+		read = readMaildirs
+	case IMPORT_EML:
+		read = readEmlDir
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown format %s, use %s, %s or %s\n", *format, IMPORT_MBOX, IMPORT_MAILDIR, IMPORT_EML)
+		return EXIT_USAGE
+	}
+	config := loadConfig()
+
+	//email already in S3 is cached first so it is not imported twice
+	err := backend.DownloadEmails(config.S3Bucket, mailbox, config.ingestOptions(mailbox))
+	if nil != err {
+		fmt.Fprintf(os.Stderr, "Could not download emails: %s\n", err.Error())
+		return EXIT_FAILURE
+	}
+	importer, err := backend.NewImporter(config.S3Bucket, mailbox, *dryRun)
+	if nil != err {
+		fmt.Fprintf(os.Stderr, "Error.. %s\n", err.Error())
+		return EXIT_FAILURE
+	}
+	defer importer.Close()
+
+	imported, duplicates, failed := 0, 0, 0
+	err = read(source, func(message *importMessage) error {
+		target := path.Join(*folder, message.folder)
+		if !mailutils.ValidFolder(target) {
+			fmt.Fprintf(os.Stderr, "Skipping %s: %q is not a usable folder name\n", message.origin, target)
+			failed++
+			return nil
+		}
+		added, err := importer.Import(target, message.content, message.flags, *format)
+		if nil != err {
+			if backend.IsPermanent(err) {
+				//every other upload would fail the same way
+				return err
+			}
+			fmt.Fprintf(os.Stderr, "Could not import %s: %s\n", message.origin, err.Error())
+			failed++
+		} else if added {
+			imported++
+		} else {
+			duplicates++
+		}
+		return nil
+	})
+	if nil != err {
+		fmt.Fprintf(os.Stderr, "Error.. %s\n", err.Error())
+		failed++
+	}
+	if *dryRun {
+		fmt.Printf("%d messages would be imported, %d already in %s\n", imported, duplicates, mailbox)
+	} else {
+		fmt.Printf("%d messages imported, %d already in %s, %d failed\n", imported, duplicates, mailbox, failed)
+	}
+	if failed > 0 {
+		return EXIT_FAILURE
+	}
+	return EXIT_OK
+}
+
+//detectImportFormat tells a Maildir, which has a cur directory, from a
+//directory of .eml files and a file, taken to be an mbox
+func detectImportFormat(source string) string {
+	info, err := os.Stat(source)
+	if nil != err || !info.IsDir() {
+		return IMPORT_MBOX
+	}
+	if info, err := os.Stat(filepath.Join(source, "cur")); nil == err && info.IsDir() {
+		return IMPORT_MAILDIR
+	}
+	return IMPORT_EML
+}
+
+//crlfLines converts line endings to CRLF as email arrives from SES
+func crlfLines(content []byte) []byte {
+	content = bytes.ReplaceAll(content, []byte("\r\n"), []byte("\n"))
+	if len(content) > 0 && content[len(content)-1] != '\n' {
+		content = append(content, '\n')
+	}
+	return bytes.ReplaceAll(content, []byte("\n"), []byte("\r\n"))
+}
+
+//readMbox reads an mbox file, taking it to be mboxrd so one > is removed
+//from quoted From lines. The flags are read from the Status, X-Status and
+//X-Keywords headers, which are then dropped.
+func readMbox(source string, each func(*importMessage) error) error {
+	file, err := os.Open(source)
+	if nil != err {
+		return err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	var message bytes.Buffer
+	count := 0
+	flush := func() error {
+		if count == 0 {
+			return nil
+		}
+		//the blank line before the next From line belongs to the mbox
+		content := bytes.TrimSuffix(message.Bytes(), []byte("\n"))
+		content, flags := mboxFlags(content)
+		message.Reset()
+		return each(&importMessage{
+			content: crlfLines(content),
+			flags:   flags,
+			origin:  fmt.Sprintf("%s message %d", source, count),
+		})
+	}
+	previousBlank := true
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			line = bytes.TrimSuffix(bytes.TrimSuffix(line, []byte("\n")), []byte("\r"))
+			if previousBlank && bytes.HasPrefix(line, []byte("From ")) {
+				if err := flush(); nil != err {
+					return err
+				}
+				count++
+			} else if count > 0 {
+				if unquoted := bytes.TrimLeft(line, ">"); len(unquoted) < len(line) && bytes.HasPrefix(unquoted, []byte("From ")) {
+					line = line[1:]
+				}
+				message.Write(line)
+				message.WriteString("\n")
+			}
+			previousBlank = len(line) == 0
+		}
+		if nil != err {
+			break
+		}
+	}
+	if count == 0 {
+		return fmt.Errorf("%s is not an mbox file", source)
+	}
+	return flush()
+}
+
+//mboxFlags reads the flags from the mbox status headers and removes them
+func mboxFlags(content []byte) ([]byte, []string) {
+	headerEnd := bytes.Index(content, []byte("\n\n"))
+	if headerEnd < 0 {
+		headerEnd = len(content)
+	}
+	flags := make([]string, 0)
+	var kept bytes.Buffer
+	var name string
+	for _, line := range strings.SplitAfter(string(content[:headerEnd]), "\n") {
+		if line != "" && line[0] != ' ' && line[0] != '\t' {
+			name, _, _ = strings.Cut(line, ":")
+			name = strings.ToLower(name)
+		}
+		_, value, _ := strings.Cut(line, ":")
+		value = strings.TrimSpace(value)
+		switch name {
+		case "status":
+			if strings.Contains(value, "R") {
+				flags = append(flags, `\Seen`)
+			}
+		case "x-status":
+			for letter, flag := range map[string]string{"A": `\Answered`, "F": `\Flagged`, "T": `\Draft`} {
+				if strings.Contains(value, letter) {
+					flags = append(flags, flag)
+				}
+			}
+		case "x-keywords":
+			for _, keyword := range strings.FieldsFunc(value, func(r rune) bool { return r == ' ' || r == ',' }) {
+				if isKeyword(keyword) {
+					flags = append(flags, keyword)
+				}
+			}
+		default:
+			kept.WriteString(line)
+		}
+	}
+	sort.Strings(flags)
+	kept.Write(content[headerEnd:])
+	return kept.Bytes(), flags
+}
+
+//readMaildirs reads a Maildir++ tree, the top level and each .folder in
+//it, with flags from the file names and dovecot-keywords
+func readMaildirs(source string, each func(*importMessage) error) error {
+	entries, err := ioutil.ReadDir(source)
+	if nil != err {
+		return err
+	}
+	err = readMaildir(source, "", each)
+	if nil != err {
+		return err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.IsDir() || !strings.HasPrefix(name, ".") || name == "." || name == ".." {
+			continue
+		}
+		folder := strings.ReplaceAll(strings.TrimPrefix(name, "."), ".", "/")
+		err = readMaildir(filepath.Join(source, name), folder, each)
+		if nil != err {
+			return err
+		}
+	}
+	return nil
+}
+
+func readMaildir(dir string, folder string, each func(*importMessage) error) error {
+	keywords := make(map[byte]string)
+	if list, err := ioutil.ReadFile(filepath.Join(dir, "dovecot-keywords")); nil == err {
+		for _, line := range strings.Split(string(list), "\n") {
+			var index int
+			var keyword string
+			if _, err := fmt.Sscanf(line, "%d %s", &index, &keyword); nil == err && index >= 0 && index < 26 {
+				keywords[byte('a'+index)] = keyword
+			}
+		}
+	}
+	for _, sub := range []string{"cur", "new"} {
+		files, err := ioutil.ReadDir(filepath.Join(dir, sub))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if nil != err {
+			return err
+		}
+		for _, file := range files {
+			if file.IsDir() || strings.HasPrefix(file.Name(), ".") {
+				continue
+			}
+			filename := filepath.Join(dir, sub, file.Name())
+			content, err := ioutil.ReadFile(filename)
+			if nil != err {
+				return err
+			}
+			flags := make([]string, 0)
+			if _, info, ok := strings.Cut(file.Name(), ":2,"); ok {
+				for i := 0; i < len(info); i++ {
+					switch letter := info[i]; letter {
+					case 'S':
+						flags = append(flags, `\Seen`)
+					case 'R':
+						flags = append(flags, `\Answered`)
+					case 'F':
+						flags = append(flags, `\Flagged`)
+					case 'D':
+						flags = append(flags, `\Draft`)
+					default:
+						if keyword, ok := keywords[letter]; ok && isKeyword(keyword) {
+							flags = append(flags, keyword)
+						}
+					}
+				}
+			}
+			err = each(&importMessage{folder: folder, content: crlfLines(content), flags: flags, origin: filename})
+			if nil != err {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+//readEmlDir reads the .eml files in a directory, they have no flags
+func readEmlDir(source string, each func(*importMessage) error) error {
+	files, err := ioutil.ReadDir(source)
+	if nil != err {
+		return err
+	}
+	for _, file := range files {
+		if file.IsDir() || !strings.EqualFold(filepath.Ext(file.Name()), ".eml") {
+			continue
+		}
+		filename := filepath.Join(source, file.Name())
+		content, err := ioutil.ReadFile(filename)
+		if nil != err {
+			return err
+		}
+		err = each(&importMessage{content: crlfLines(content), origin: filename})
+		if nil != err {
+			return err
+		}
+	}
+	return nil
+}
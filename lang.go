@@ -0,0 +1,97 @@
+package main
+
+/*
+    s3pop-server: An AWS S3 backed POP3 server
+	Copyright (C) 2018 James W Matheson
+	fractal.mango@gmail.com
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+import (
+	"strings"
+)
+
+//language is a message catalogue for the LANG command (RFC 6856 section
+//4). Messages are looked up by their English text, anything missing from
+//a catalogue is sent in English.
+type language struct {
+	tag string
+	//name is the name of the language in that language, shown by LANG
+	name     string
+	messages map[string]string
+}
+
+func (l *language) text(msg string) string {
+	translated, ok := l.messages[msg]
+	if !ok {
+		return msg
+	}
+	return translated
+}
+
+var english = &language{tag: "en", name: "English"}
+
+var german = &language{tag: "de", name: "Deutsch", messages: map[string]string{
+	"%d messages (%d octets)":           "%d Nachrichten (%d Oktette)",
+	"%d messages not removed":           "%d Nachrichten nicht entfernt",
+	"%d octets":                         "%d Oktette",
+	"Autologout timer expired":          "Automatische Abmeldung wegen Inaktivität",
+	"Begin TLS negotiation":             "TLS-Aushandlung beginnt",
+	"Capability list follows":           "Liste der Fähigkeiten folgt",
+	"Command line too long":             "Befehlszeile zu lang",
+	"Command received after STLS":       "Befehl nach STLS empfangen",
+	"Goodbye":                           "Auf Wiedersehen",
+	"Invalid user name":                 "Ungültiger Benutzername",
+	"Language changed":                  "Sprache geändert",
+	"Language listing follows":          "Liste der Sprachen folgt",
+	"Logged in too recently":            "Letzte Anmeldung zu kurz her",
+	"Mailbox in use by another session": "Postfach wird von einer anderen Sitzung verwendet",
+	"Mailbox temporarily unavailable":   "Postfach vorübergehend nicht verfügbar",
+	"Mailbox unavailable":               "Postfach nicht verfügbar",
+	"No user name":                      "Kein Benutzername",
+	"USER first":                        "Zuerst USER senden",
+	"UTF8 enabled":                      "UTF8 aktiviert",
+	"Unrecognised Command":              "Unbekannter Befehl",
+	"User name is not valid UTF-8":      "Benutzername ist kein gültiges UTF-8",
+	"User signed in":                    "Benutzer angemeldet",
+	"User signed in, mailbox full":      "Benutzer angemeldet, Postfach voll",
+	"failed to open email %s":           "E-Mail %s konnte nicht geöffnet werden",
+	"internal error":                    "interner Fehler",
+	"invalid language":                  "ungültige Sprache",
+	"message %d deleted":                "Nachricht %d gelöscht",
+	"message already deleted":           "Nachricht bereits gelöscht",
+	"message deleted":                   "Nachricht gelöscht",
+	"no line argument supplied":         "keine Zeilenanzahl angegeben",
+	"no message selected":               "keine Nachricht ausgewählt",
+	"no such message":                   "Nachricht nicht vorhanden",
+}}
+
+//languages are listed by LANG in this order, the first is the default
+var languages = []*language{english, german}
+
+//findLanguage chooses a language for the argument to LANG, "*" selects the
+//default and a tag with a region such as de-AT falls back to the language
+func findLanguage(tag string) *language {
+	if tag == "*" {
+		return languages[0]
+	}
+	primary, _, _ := strings.Cut(tag, "-")
+	for _, lang := range languages {
+		if strings.EqualFold(lang.tag, tag) || strings.EqualFold(lang.tag, primary) {
+			return lang
+		}
+	}
+	return nil
+}
@@ -0,0 +1,469 @@
+package main
+
+/*
+    s3pop-server: An AWS S3 backed POP3 server
+	Copyright (C) 2018 James W Matheson
+	fractal.mango@gmail.com
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/FractalJim/s3pop-server/metrics"
+)
+
+//exit statuses returned by main
+const (
+	EXIT_OK           = 0
+	EXIT_STARTUP      = 1
+	EXIT_DRAIN_FAILED = 2
+	EXIT_FAILURE      = 3
+)
+
+//maxAcceptDelay is the longest wait before accepting again after an error
+const maxAcceptDelay = time.Second
+
+//popServer owns the listening sockets and keeps track of open sessions so
+//that they can be drained when the process is asked to stop
+type popServer struct {
+	mu        sync.Mutex
+	config    *ServerConfig
+	listeners map[string]*popListener
+	//activated holds the addresses of listeners on sockets passed in by
+	//systemd, which are never closed or rebound
+	activated map[string]bool
+	admin     *adminServer
+	sessions  map[net.Conn]struct{}
+	//open session count for each client address
+	sessionsByHost map[string]int
+	draining       bool
+	//closed when draining starts so sessions stop waiting for commands
+	stopping chan struct{}
+	wg       sync.WaitGroup
+}
+
+func newPopServer(config *ServerConfig) *popServer {
+	metrics.SetMailboxes(config.namedMailboxes())
+	return &popServer{
+		config:         config,
+		listeners:      make(map[string]*popListener),
+		activated:      make(map[string]bool),
+		sessions:       make(map[net.Conn]struct{}),
+		sessionsByHost: make(map[string]int),
+		stopping:       make(chan struct{}),
+	}
+}
+
+func (s *popServer) currentConfig() *ServerConfig {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.config
+}
+
+//listen opens the listening sockets. Sockets passed in by systemd socket
+//activation are used for the listeners they match, any other configured
+//listeners are bound as usual.
+func (s *popServer) listen() ([]*popListener, error) {
+	config := s.currentConfig()
+	sockets, err := systemdListeners()
+	if nil != err {
+		return nil, err
+	}
+	opened := make([]*popListener, 0, len(config.Listeners))
+	covered := make(map[string]bool, len(sockets))
+	for _, socket := range sockets {
+		listenerConfig, err := listenerFor(socket.Addr(), config.Listeners)
+		if nil != err {
+			return opened, err
+		}
+		settings, err := newListenerSettings(listenerConfig)
+		if nil != err {
+			return opened, err
+		}
+		listener := &popListener{Listener: socket, settings: settings}
+		s.addListener(socket.Addr().String(), listener)
+		s.mu.Lock()
+		s.activated[socket.Addr().String()] = true
+		s.mu.Unlock()
+		covered[listenerConfig.addr()] = true
+		opened = append(opened, listener)
+		slog.Info("listening on socket from systemd", "address", socket.Addr().String())
+	}
+	if len(sockets) > 0 {
+		for _, listenerConfig := range config.Listeners {
+			if !covered[listenerConfig.addr()] {
+				slog.Warn("no socket from systemd for listener, binding it", "address", listenerConfig.addr())
+			}
+		}
+	}
+	bound, err := s.openListeners(uncoveredListeners(config.Listeners, covered))
+	return append(opened, bound...), err
+}
+
+//uncoveredListeners returns the configured listeners that are not served
+//by a socket from systemd
+func uncoveredListeners(configs []ListenerConfig, covered map[string]bool) []ListenerConfig {
+	uncovered := make([]ListenerConfig, 0, len(configs))
+	for _, listenerConfig := range configs {
+		if !covered[listenerConfig.addr()] {
+			uncovered = append(uncovered, listenerConfig)
+		}
+	}
+	return uncovered
+}
+
+//openListeners binds any configured listeners that are not already open
+//and updates the settings of those that are
+func (s *popServer) openListeners(configs []ListenerConfig) ([]*popListener, error) {
+	opened := make([]*popListener, 0, len(configs))
+	for _, listenerConfig := range configs {
+		settings, err := newListenerSettings(listenerConfig)
+		if nil != err {
+			return opened, err
+		}
+		addr := listenerConfig.addr()
+		if existing := s.getListener(addr); nil != existing {
+			existing.update(settings)
+			continue
+		}
+		socket, err := net.Listen("tcp", addr)
+		if nil != err {
+			return opened, err
+		}
+		listener := &popListener{Listener: socket, settings: settings}
+		s.addListener(addr, listener)
+		opened = append(opened, listener)
+		slog.Info("listening", "address", addr, "tls", listenerConfig.TLS)
+	}
+	return opened, nil
+}
+
+func (s *popServer) getListener(addr string) *popListener {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.listeners[addr]
+}
+
+func (s *popServer) addListener(addr string, listener *popListener) {
+	s.mu.Lock()
+	s.listeners[addr] = listener
+	s.mu.Unlock()
+}
+
+func (s *popServer) closeListeners(listeners []*popListener) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, listener := range listeners {
+		listener.Close()
+		for addr, open := range s.listeners {
+			if open == listener {
+				delete(s.listeners, addr)
+			}
+		}
+	}
+}
+
+func (s *popServer) serveAll(listeners []*popListener) {
+	for _, listener := range listeners {
+		go s.serve(listener)
+	}
+}
+
+//serve accepts connections on the given listener until it is closed.
+//Other accept errors, such as running out of file descriptors, are
+//retried after a short delay as net/http does.
+func (s *popServer) serve(listener *popListener) {
+	var delay time.Duration
+	for {
+		conn, raw, settings, err := listener.accept()
+		if err != nil {
+			if s.isDraining() {
+				return
+			}
+			if errors.Is(err, net.ErrClosed) {
+				listener.fail(err)
+				return
+			}
+			if !isTimeout(err) {
+				//reported by /readyz until a connection is accepted again
+				listener.fail(err)
+				if delay == 0 {
+					delay = 5 * time.Millisecond
+				} else if delay *= 2; delay > maxAcceptDelay {
+					delay = maxAcceptDelay
+				}
+				slog.Error("accept failed", "listener", listener.Addr().String(), "error", err.Error(), "retry", delay.String())
+				time.Sleep(delay)
+			}
+			continue
+		}
+		if delay != 0 {
+			delay = 0
+			listener.fail(nil)
+		}
+		config := s.currentConfig()
+		err = s.track(raw, config)
+		if err == errDraining {
+			raw.Close()
+			return
+		}
+		if nil != err {
+			go rejectClient(conn, config, settings.config.Protocol, err)
+			continue
+		}
+		// run as goroutine
+		go func() {
+			defer s.untrack(raw)
+			switch settings.config.Protocol {
+			case PROTOCOL_IMAP:
+				handleIMAPClient(conn, config, settings.stlsConfig(), s.stopping)
+			case PROTOCOL_SMTP:
+				handleSMTPClient(conn, config, settings.stlsConfig(), s.stopping)
+			default:
+				handleClient(conn, config, settings.stlsConfig(), s.stopping)
+			}
+		}()
+	}
+}
+
+//rejectReasons labels the metric for each reason a session is refused
+var rejectReasons = map[error]string{
+	errTooManySessions:      "max_sessions",
+	errTooManySessionsForIP: "max_sessions_per_ip",
+}
+
+//rejectClient tells a client over the session limits to try later
+func rejectClient(conn net.Conn, config *ServerConfig, protocol string, reason error) {
+	defer conn.Close()
+	log := slog.With("remote", conn.RemoteAddr().String())
+	log.Warn("connection refused", "reason", reason.Error())
+	metrics.SessionsRejected.WithLabelValues(rejectReasons[reason]).Inc()
+	conn.SetDeadline(time.Now().Add(time.Duration(config.WriteTimeout) * time.Second))
+	switch protocol {
+	case PROTOCOL_IMAP:
+		fmt.Fprintf(conn, "* BYE [UNAVAILABLE] %s, try again later"+eol, reason.Error())
+		return
+	case PROTOCOL_SMTP:
+		fmt.Fprintf(conn, "421 4.7.0 %s, try again later"+eol, reason.Error())
+		return
+	}
+	writeCodedErrResponse(conn, RESP_SYS_TEMP, "%s, try again later", log, reason.Error())
+}
+
+func (s *popServer) isDraining() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.draining
+}
+
+//track registers a new session, refusing it if the server is draining or
+//the global or per address session limits have been reached
+func (s *popServer) track(conn net.Conn, config *ServerConfig) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.draining {
+		return errDraining
+	}
+	host := remoteHost(conn)
+	if config.MaxSessions > 0 && len(s.sessions) >= config.MaxSessions {
+		return errTooManySessions
+	}
+	if config.MaxSessionsPerIP > 0 && s.sessionsByHost[host] >= config.MaxSessionsPerIP {
+		return errTooManySessionsForIP
+	}
+	s.sessions[conn] = struct{}{}
+	s.sessionsByHost[host]++
+	s.wg.Add(1)
+	return nil
+}
+
+func (s *popServer) untrack(conn net.Conn) {
+	host := remoteHost(conn)
+	s.mu.Lock()
+	delete(s.sessions, conn)
+	s.sessionsByHost[host]--
+	if s.sessionsByHost[host] <= 0 {
+		delete(s.sessionsByHost, host)
+	}
+	s.mu.Unlock()
+	s.wg.Done()
+}
+
+//reload re-reads the configuration file. New sessions pick up the new
+//configuration, listeners are opened and closed to match it and the
+//settings of listeners left open are updated in place.
+func (s *popServer) reload() error {
+	config, err := readConfig()
+	if nil != err {
+		return err
+	}
+	err = setupLogging(config.Logging)
+	if nil != err {
+		return err
+	}
+	metrics.SetMailboxes(config.namedMailboxes())
+	s.mu.Lock()
+	oldConfig := s.config
+	s.config = config
+	current := make(map[string]*popListener, len(s.listeners))
+	for addr, listener := range s.listeners {
+		current[addr] = listener
+	}
+	activated := make(map[string]bool, len(s.activated))
+	for addr := range s.activated {
+		activated[addr] = true
+	}
+	s.mu.Unlock()
+
+	if config.AdminAddress != oldConfig.AdminAddress {
+		s.admin.stop()
+		s.admin = nil
+		if config.AdminAddress != "" {
+			s.admin, err = startAdminServer(config.AdminAddress, s)
+			if nil != err {
+				return err
+			}
+		}
+	}
+
+	//sockets from systemd can't be rebound, only their settings can change
+	covered := make(map[string]bool, len(activated))
+	for addr := range activated {
+		listener := current[addr]
+		listenerConfig, err := listenerFor(listener.Addr(), config.Listeners)
+		if nil != err {
+			return err
+		}
+		settings, err := newListenerSettings(listenerConfig)
+		if nil != err {
+			return err
+		}
+		listener.update(settings)
+		covered[listenerConfig.addr()] = true
+	}
+
+	opened, err := s.openListeners(uncoveredListeners(config.Listeners, covered))
+	s.serveAll(opened)
+	if nil != err {
+		return err
+	}
+	wanted := make(map[string]struct{}, len(config.Listeners))
+	for _, listenerConfig := range config.Listeners {
+		wanted[listenerConfig.addr()] = struct{}{}
+	}
+	removed := make([]*popListener, 0)
+	for addr, listener := range current {
+		if _, ok := wanted[addr]; !ok && !activated[addr] {
+			removed = append(removed, listener)
+			slog.Info("stopped listening", "address", addr)
+		}
+	}
+	s.closeListeners(removed)
+	return nil
+}
+
+//drain stops accepting new connections and waits for open sessions to
+//finish. Sessions idle waiting for a command are interrupted, sessions
+//part way through a command (including the UPDATE state after QUIT) are
+//allowed to complete. Returns false if sessions remained after the timeout.
+func (s *popServer) drain(timeout time.Duration) bool {
+	s.mu.Lock()
+	s.draining = true
+	close(s.stopping)
+	for _, listener := range s.listeners {
+		listener.Close()
+	}
+	for conn := range s.sessions {
+		//unblocks any pending read, the session then ends without
+		//entering the UPDATE state as required by RFC 1939
+		conn.SetReadDeadline(time.Now())
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		s.mu.Lock()
+		for conn := range s.sessions {
+			conn.Close()
+		}
+		s.mu.Unlock()
+		return false
+	}
+}
+
+//run serves until SIGINT or SIGTERM is received, reloading the
+//configuration on SIGHUP. Returns the exit status for the process.
+func (s *popServer) run(listeners []*popListener) int {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(signals)
+
+	s.serveAll(listeners)
+	config := s.currentConfig()
+	if config.AdminAddress != "" {
+		var err error
+		s.admin, err = startAdminServer(config.AdminAddress, s)
+		if nil != err {
+			slog.Error("could not start admin listener", "error", err)
+		}
+	}
+	defer func() { s.admin.stop() }()
+	sdNotify("READY=1")
+	stopWatchdog := startWatchdog(s.healthy)
+	defer stopWatchdog()
+	stopJanitor := startJanitor(s.currentConfig)
+	defer stopJanitor()
+
+	for sig := range signals {
+		if sig == syscall.SIGHUP {
+			sdNotify("RELOADING=1")
+			err := s.reload()
+			if nil != err {
+				slog.Error("config reload failed", "error", err)
+			} else {
+				slog.Info("config reloaded")
+			}
+			sdNotify("READY=1")
+			continue
+		}
+		slog.Info("shutting down", "signal", sig.String())
+		break
+	}
+
+	sdNotify("STOPPING=1")
+	timeout := time.Duration(s.currentConfig().ShutdownTimeout) * time.Second
+	if !s.drain(timeout) {
+		slog.Error("sessions still open after shutdown timeout, closed forcibly", "timeout", timeout)
+		return EXIT_DRAIN_FAILED
+	}
+	slog.Info("server stopped")
+	return EXIT_OK
+}
@@ -0,0 +1,113 @@
+package main
+
+/*
+    s3pop-server: An AWS S3 backed POP3 server
+	Copyright (C) 2018 James W Matheson
+	fractal.mango@gmail.com
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"time"
+)
+
+//RFC 1939 section 3 requires the autologout timer to be at least 10 minutes
+const defaultIdleTimeout = 600
+const minIdleTimeout = 600
+const defaultWriteTimeout = 60
+const defaultMaxSessions = 100
+const defaultMaxSessionsPerIP = 10
+
+//RFC 2449 allows 255 octets for a command line including the CRLF, a
+//little more is accepted for clients that send long UIDL arguments
+const defaultMaxLineLength = 512
+
+//defaultMaxMessageSize is the SES limit for SendRawEmail
+const defaultMaxMessageSize = 10 * 1024 * 1024
+
+var errLineTooLong = errors.New("line too long")
+var errTooManySessions = errors.New("too many sessions")
+var errDraining = errors.New("server shutting down")
+var errTooManySessionsForIP = errors.New("too many sessions from your address")
+
+//timeoutConn sets a write deadline before every write so a client that
+//stops reading cannot block the session forever
+type timeoutConn struct {
+	net.Conn
+	writeTimeout time.Duration
+}
+
+func (c *timeoutConn) Write(b []byte) (int, error) {
+	if c.writeTimeout > 0 {
+		c.Conn.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+	}
+	return c.Conn.Write(b)
+}
+
+//readLine reads a line of at most maxLength bytes including the line
+//ending. Longer lines are read to the end and discarded, errLineTooLong is
+//returned so the caller can reject the command and carry on.
+func readLine(reader *bufio.Reader, maxLength int) (string, error) {
+	line := make([]byte, 0, 64)
+	tooLong := false
+	for {
+		fragment, err := reader.ReadSlice('\n')
+		if !tooLong {
+			if len(line)+len(fragment) > maxLength {
+				tooLong = true
+				line = line[:0]
+			} else {
+				line = append(line, fragment...)
+			}
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if nil != err {
+			return string(line), err
+		}
+		if tooLong {
+			return "", errLineTooLong
+		}
+		return string(line), nil
+	}
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+//remoteHost returns the address of the client without the port, used to
+//count sessions per client
+func remoteHost(conn net.Conn) string {
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if nil != err {
+		return conn.RemoteAddr().String()
+	}
+	return host
+}
+
+func isClosed(stopping <-chan struct{}) bool {
+	select {
+	case <-stopping:
+		return true
+	default:
+		return false
+	}
+}
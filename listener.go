@@ -0,0 +1,255 @@
+package main
+
+/*
+    s3pop-server: An AWS S3 backed POP3 server
+	Copyright (C) 2018 James W Matheson
+	fractal.mango@gmail.com
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/FractalJim/s3pop-server/metrics"
+)
+
+const defaultBindAddress = "127.0.0.1"
+
+//TLS modes for a listener
+const (
+	TLS_NONE     = "none"
+	TLS_IMPLICIT = "implicit" //POP3S, TLS from the first byte (RFC 8314)
+	TLS_STLS     = "stls"     //plain text upgraded with STLS or STARTTLS (RFC 2595, RFC 3207)
+)
+
+//Protocols a listener can serve
+const (
+	PROTOCOL_POP3 = "pop3"
+	PROTOCOL_IMAP = "imap"
+	PROTOCOL_SMTP = "smtp" //message submission (RFC 6409) relayed to SES
+)
+
+type ListenerConfig struct {
+	Address        string   `json:"address" yaml:"address" toml:"address"`
+	Port           int      `json:"port" yaml:"port" toml:"port"`
+	Protocol       string   `json:"protocol" yaml:"protocol" toml:"protocol"`
+	TLS            string   `json:"tls" yaml:"tls" toml:"tls"`
+	CertFile       string   `json:"certFile" yaml:"certFile" toml:"certFile"`
+	KeyFile        string   `json:"keyFile" yaml:"keyFile" toml:"keyFile"`
+	AllowedClients []string `json:"allowedClients" yaml:"allowedClients" toml:"allowedClients"`
+}
+
+//addr returns the host:port the listener binds to
+func (l *ListenerConfig) addr() string {
+	return net.JoinHostPort(l.Address, strconv.Itoa(l.Port))
+}
+
+func (l *ListenerConfig) validate() error {
+	if l.Port <= 0 || l.Port > 65535 {
+		return fmt.Errorf("port %d is out of range", l.Port)
+	}
+	ip := net.ParseIP(l.Address)
+	if nil == ip {
+		return fmt.Errorf("address %q is not an IP address", l.Address)
+	}
+	switch l.Protocol {
+	case PROTOCOL_POP3, PROTOCOL_IMAP:
+	case PROTOCOL_SMTP:
+		//any password is accepted and mail is sent with the server's SES
+		//account, so only local clients may send
+		if !ip.IsLoopback() {
+			return fmt.Errorf("%s listeners accept any password so must use a loopback address, not %s", PROTOCOL_SMTP, l.Address)
+		}
+	default:
+		return fmt.Errorf("protocol must be one of %s, %s or %s", PROTOCOL_POP3, PROTOCOL_IMAP, PROTOCOL_SMTP)
+	}
+	switch l.TLS {
+	case TLS_NONE:
+	case TLS_IMPLICIT, TLS_STLS:
+		if l.CertFile == "" || l.KeyFile == "" {
+			return fmt.Errorf("tls %s needs certFile and keyFile", l.TLS)
+		}
+	default:
+		return fmt.Errorf("tls must be one of %s, %s or %s", TLS_NONE, TLS_IMPLICIT, TLS_STLS)
+	}
+	_, err := parseAllowedClients(l.AllowedClients)
+	return err
+}
+
+//parseAllowedClients converts the allowedClients setting to networks,
+//single addresses are accepted as well as CIDR ranges
+func parseAllowedClients(allowed []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(allowed))
+	for _, entry := range allowed {
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if nil == ip {
+				return nil, fmt.Errorf("allowed client %q is not an IP address or CIDR range", entry)
+			}
+			bits := 8 * net.IPv6len
+			if nil != ip.To4() {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if nil != err {
+			return nil, fmt.Errorf("allowed client %q is not an IP address or CIDR range", entry)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+//listenerSettings is the part of a listener's config that can change on
+//reload without rebinding the socket
+type listenerSettings struct {
+	config    ListenerConfig
+	tlsConfig *tls.Config
+	allowed   []*net.IPNet
+}
+
+func newListenerSettings(config ListenerConfig) (*listenerSettings, error) {
+	allowed, err := parseAllowedClients(config.AllowedClients)
+	if nil != err {
+		return nil, err
+	}
+	settings := &listenerSettings{config: config, allowed: allowed}
+	if config.TLS != TLS_NONE {
+		cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+		if nil != err {
+			return nil, err
+		}
+		settings.tlsConfig = &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS12,
+		}
+	}
+	return settings, nil
+}
+
+//allows reports whether a client at addr may connect, an empty allow list
+//lets everyone in
+func (settings *listenerSettings) allows(addr net.Addr) bool {
+	if len(settings.allowed) == 0 {
+		return true
+	}
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, network := range settings.allowed {
+		if network.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+//stlsConfig returns the TLS config to offer with STLS or STARTTLS, nil if
+//it is not available on this listener
+func (settings *listenerSettings) stlsConfig() *tls.Config {
+	if settings.config.TLS == TLS_STLS {
+		return settings.tlsConfig
+	}
+	return nil
+}
+
+//popListener is a listening socket with the settings it was opened with
+type popListener struct {
+	net.Listener
+	mu       sync.Mutex
+	settings *listenerSettings
+	//failed is set if the listener stopped accepting connections other
+	//than by being closed
+	failed error
+}
+
+func (l *popListener) fail(err error) {
+	l.mu.Lock()
+	l.failed = err
+	l.mu.Unlock()
+}
+
+func (l *popListener) failure() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.failed
+}
+
+func (l *popListener) currentSettings() *listenerSettings {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.settings
+}
+
+func (l *popListener) update(settings *listenerSettings) {
+	l.mu.Lock()
+	l.settings = settings
+	l.mu.Unlock()
+}
+
+//accept waits for a client that is allowed to connect, returning the
+//connection as a TLS connection for implicit TLS listeners. The raw
+//connection is also returned for connection tracking.
+func (l *popListener) accept() (conn net.Conn, raw net.Conn, settings *listenerSettings, err error) {
+	for {
+		raw, err = l.Accept()
+		if nil != err {
+			return nil, nil, nil, err
+		}
+		settings = l.currentSettings()
+		if !settings.allows(raw.RemoteAddr()) {
+			//refused before the greeting so nothing is revealed to the client
+			slog.Warn("connection from address not allowed", "remote", raw.RemoteAddr().String(), "listener", l.Addr().String())
+			metrics.SessionsRejected.WithLabelValues("not_allowed").Inc()
+			raw.Close()
+			continue
+		}
+		conn = raw
+		if settings.config.TLS == TLS_IMPLICIT {
+			conn = tls.Server(raw, settings.tlsConfig)
+		}
+		return conn, raw, settings, nil
+	}
+}
+
+//listenerFor finds the configured listener matching the address and port
+//of a socket passed in by systemd. A socket bound to every address only
+//matches a listener configured for every address.
+func listenerFor(addr net.Addr, configs []ListenerConfig) (ListenerConfig, error) {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return ListenerConfig{}, fmt.Errorf("socket %s from systemd is not a TCP socket", addr.String())
+	}
+	for _, config := range configs {
+		if config.Port != tcpAddr.Port {
+			continue
+		}
+		ip := net.ParseIP(config.Address)
+		if ip.Equal(tcpAddr.IP) || (ip.IsUnspecified() && tcpAddr.IP.IsUnspecified()) {
+			return config, nil
+		}
+	}
+	return ListenerConfig{}, fmt.Errorf("socket %s from systemd does not match a configured listener", addr.String())
+}
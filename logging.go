@@ -0,0 +1,214 @@
+package main
+
+/*
+    s3pop-server: An AWS S3 backed POP3 server
+	Copyright (C) 2018 James W Matheson
+	fractal.mango@gmail.com
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+)
+
+const (
+	LOG_FORMAT_TEXT = "text"
+	LOG_FORMAT_JSON = "json"
+)
+
+//redacted replaces the arguments of commands that carry credentials
+const redacted = "[redacted]"
+
+type LoggingConfig struct {
+	Level  string `json:"level" yaml:"level" toml:"level"`
+	Format string `json:"format" yaml:"format" toml:"format"`
+	//AccessLog receives connection and command records below warning
+	//level, ErrorLog receives warnings and errors. Each is stdout, stderr
+	//or the path of a file to append to.
+	AccessLog string `json:"accessLog" yaml:"accessLog" toml:"accessLog"`
+	ErrorLog  string `json:"errorLog" yaml:"errorLog" toml:"errorLog"`
+}
+
+func (l *LoggingConfig) applyDefaults() {
+	if l.Level == "" {
+		l.Level = "info"
+	}
+	if l.Format == "" {
+		l.Format = LOG_FORMAT_TEXT
+	}
+	if l.AccessLog == "" {
+		l.AccessLog = "stdout"
+	}
+	if l.ErrorLog == "" {
+		l.ErrorLog = "stderr"
+	}
+}
+
+func (l *LoggingConfig) validate() error {
+	var level slog.Level
+	err := level.UnmarshalText([]byte(l.Level))
+	if nil != err {
+		return fmt.Errorf("logging level %q is not one of debug, info, warn or error", l.Level)
+	}
+	if l.Format != LOG_FORMAT_TEXT && l.Format != LOG_FORMAT_JSON {
+		return fmt.Errorf("logging format must be %s or %s", LOG_FORMAT_TEXT, LOG_FORMAT_JSON)
+	}
+	return nil
+}
+
+//splitHandler sends records below warning level to the access stream and
+//the rest to the error stream
+type splitHandler struct {
+	access slog.Handler
+	errors slog.Handler
+}
+
+func (h *splitHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	if level >= slog.LevelWarn {
+		return h.errors.Enabled(ctx, level)
+	}
+	return h.access.Enabled(ctx, level)
+}
+
+func (h *splitHandler) Handle(ctx context.Context, record slog.Record) error {
+	if record.Level >= slog.LevelWarn {
+		return h.errors.Handle(ctx, record)
+	}
+	return h.access.Handle(ctx, record)
+}
+
+func (h *splitHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &splitHandler{access: h.access.WithAttrs(attrs), errors: h.errors.WithAttrs(attrs)}
+}
+
+func (h *splitHandler) WithGroup(name string) slog.Handler {
+	return &splitHandler{access: h.access.WithGroup(name), errors: h.errors.WithGroup(name)}
+}
+
+//logStream is a writer whose destination can be swapped, so loggers held
+//by open sessions follow the log files when the config is reloaded
+type logStream struct {
+	mu     sync.Mutex
+	out    io.Writer
+	closer io.Closer
+}
+
+func (l *logStream) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.out.Write(p)
+}
+
+//swap points the stream at a new destination, closing the previous one if
+//it was a file
+func (l *logStream) swap(out io.Writer, closer io.Closer) {
+	l.mu.Lock()
+	previous := l.closer
+	l.out = out
+	l.closer = closer
+	l.mu.Unlock()
+	if nil != previous && previous != closer {
+		previous.Close()
+	}
+}
+
+var accessStream = &logStream{out: os.Stdout}
+var errorStream = &logStream{out: os.Stderr}
+var logLevel = new(slog.LevelVar)
+
+//setupLogging replaces the default logger with one built from the config.
+//Files are reopened each time, so reloading the config after rotating the
+//log files starts new ones.
+func setupLogging(config LoggingConfig) error {
+	var level slog.Level
+	err := level.UnmarshalText([]byte(config.Level))
+	if nil != err {
+		return err
+	}
+	access, accessCloser, err := openLogStream(config.AccessLog)
+	if nil != err {
+		return err
+	}
+	errorOut, errorCloser := access, accessCloser
+	if config.ErrorLog != config.AccessLog {
+		errorOut, errorCloser, err = openLogStream(config.ErrorLog)
+		if nil != err {
+			if nil != accessCloser {
+				accessCloser.Close()
+			}
+			return err
+		}
+	}
+	logLevel.Set(level)
+	accessStream.swap(access, accessCloser)
+	errorStream.swap(errorOut, errorCloser)
+
+	options := &slog.HandlerOptions{Level: logLevel}
+	newHandler := func(out io.Writer) slog.Handler {
+		if config.Format == LOG_FORMAT_JSON {
+			return slog.NewJSONHandler(out, options)
+		}
+		return slog.NewTextHandler(out, options)
+	}
+	slog.SetDefault(slog.New(&splitHandler{access: newHandler(accessStream), errors: newHandler(errorStream)}))
+	return nil
+}
+
+func openLogStream(target string) (io.Writer, io.Closer, error) {
+	switch strings.ToLower(target) {
+	case "stdout":
+		return os.Stdout, nil, nil
+	case "stderr":
+		return os.Stderr, nil, nil
+	}
+	logFile, err := os.OpenFile(target, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if nil != err {
+		return nil, nil, err
+	}
+	return logFile, logFile, nil
+}
+
+//newSessionID returns a short random identifier used to correlate the log
+//records of one session
+func newSessionID() string {
+	id := make([]byte, 6)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+//redactArgs hides credentials so they never reach the logs
+func redactArgs(cmd string, args []string) []string {
+	switch strings.ToUpper(cmd) {
+	case "PASS":
+		if len(args) > 0 {
+			return []string{redacted}
+		}
+	case "APOP", "AUTH":
+		//the user name or mechanism is useful, the digest or initial
+		//response is not
+		if len(args) > 1 {
+			return []string{args[0], redacted}
+		}
+	}
+	return args
+}
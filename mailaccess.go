@@ -20,33 +20,31 @@ package main
 */
 
 import (
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"io"
+	"log/slog"
 	"net"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/FractalJim/s3pop-server/backend"
 	"github.com/FractalJim/s3pop-server/mailutils"
 )
 
-func getMessageData(emailDir string) []*mailutils.MailData {
-	var emailMetafiles []string
-	filepath.Walk(emailDir, func(path string, info os.FileInfo, _ error) error {
-		if !info.IsDir() {
-			if filepath.Ext(path) == ".json" {
-				emailMetafiles = append(emailMetafiles, filepath.Base(path))
-			}
-		}
-		return nil
-	})
-
-	var result = make([]*mailutils.MailData, 0)
-	for _, mailItem := range emailMetafiles {
-		itemDetails := mailutils.LoadMailData(emailDir, mailItem)
-		result = append(result, itemDetails)
+//messageIndex converts a message number argument to an index into
+//mailData, ok is false when there is no such message
+func messageIndex(msgId string, mailData []*mailutils.MailData) (id int, ok bool) {
+	id, err := strconv.Atoi(msgId)
+	if nil != err || id < 1 || id > len(mailData) {
+		return 0, false
 	}
-	return result
+	return id - 1, true
 }
 
 func getStat(mailData []*mailutils.MailData, deletedItems map[int]struct{}) (count int, size int) {
@@ -62,6 +60,124 @@ func getStat(mailData []*mailutils.MailData, deletedItems map[int]struct{}) (cou
 	return
 }
 
+//knownCommands are the commands counted individually in the metrics,
+//anything else a client sends is counted as UNKNOWN
+var knownCommands = map[string]struct{}{
+	"USER": {}, "PASS": {}, "APOP": {}, "AUTH": {}, "STAT": {}, "LIST": {},
+	"RETR": {}, "DELE": {}, "NOOP": {}, "RSET": {}, "QUIT": {}, "TOP": {},
+	"UIDL": {}, "CAPA": {}, "STLS": {}, "UTF8": {}, "LANG": {},
+}
+
+//Response codes sent in brackets at the start of -ERR responses so
+//clients can tell failures apart (RFC 2449 section 8, RFC 3206)
+const (
+	RESP_IN_USE      = "IN-USE"
+	RESP_LOGIN_DELAY = "LOGIN-DELAY"
+	RESP_SYS_TEMP    = "SYS/TEMP"
+	RESP_SYS_PERM    = "SYS/PERM"
+	RESP_AUTH        = "AUTH"
+)
+
+//mailboxLocks holds the mailboxes that have a POP3 session open, RFC 1939
+//requires a session to have exclusive access to its maildrop. IMAP
+//sessions share a mailbox and are counted, they only remove email while
+//no POP3 session has it.
+var mailboxLocks = struct {
+	sync.Mutex
+	held map[string]struct{}
+	imap map[string]int
+}{held: make(map[string]struct{}), imap: make(map[string]int)}
+
+//lockMailbox returns false if another session already has the mailbox
+func lockMailbox(mailbox string) bool {
+	mailboxLocks.Lock()
+	defer mailboxLocks.Unlock()
+	if _, held := mailboxLocks.held[mailbox]; held {
+		return false
+	}
+	mailboxLocks.held[mailbox] = struct{}{}
+	return true
+}
+
+func unlockMailbox(mailbox string) {
+	mailboxLocks.Lock()
+	delete(mailboxLocks.held, mailbox)
+	mailboxLocks.Unlock()
+}
+
+//lockIdleMailbox is lockMailbox for a mailbox no IMAP session is logged
+//in to either
+func lockIdleMailbox(mailbox string) bool {
+	mailboxLocks.Lock()
+	defer mailboxLocks.Unlock()
+	if mailboxLocks.imap[mailbox] > 0 {
+		return false
+	}
+	if _, held := mailboxLocks.held[mailbox]; held {
+		return false
+	}
+	mailboxLocks.held[mailbox] = struct{}{}
+	return true
+}
+
+//openIMAPMailbox counts an IMAP session logged in to the mailbox
+func openIMAPMailbox(mailbox string) {
+	mailboxLocks.Lock()
+	mailboxLocks.imap[mailbox]++
+	mailboxLocks.Unlock()
+}
+
+func closeIMAPMailbox(mailbox string) {
+	mailboxLocks.Lock()
+	mailboxLocks.imap[mailbox]--
+	if mailboxLocks.imap[mailbox] <= 0 {
+		delete(mailboxLocks.imap, mailbox)
+	}
+	mailboxLocks.Unlock()
+}
+
+//lastLogins holds when each mailbox last signed in over POP3, only as
+//long as it delays the next login
+var lastLogins = struct {
+	sync.Mutex
+	at map[string]time.Time
+}{at: make(map[string]time.Time)}
+
+//loginAllowed records a login to the mailbox, returning false without
+//recording it if the last login was less than delay ago
+func loginAllowed(mailbox string, delay time.Duration, now time.Time) bool {
+	if delay <= 0 {
+		return true
+	}
+	lastLogins.Lock()
+	defer lastLogins.Unlock()
+	if last, ok := lastLogins.at[mailbox]; ok && now.Sub(last) < delay {
+		return false
+	}
+	for name, last := range lastLogins.at {
+		if now.Sub(last) >= delay {
+			delete(lastLogins.at, name)
+		}
+	}
+	lastLogins.at[mailbox] = now
+	return true
+}
+
+//getCapabilities lists the capabilities reported by CAPA (RFC 2449),
+//mailbox is empty before the client has logged in
+func getCapabilities(stlsConfig *tls.Config, config *ServerConfig, mailbox string) []string {
+	//UTF8 USER: user names may be UTF-8 whether or not UTF8 was sent
+	capabilities := []string{"TOP", "UIDL", "USER", "RESP-CODES", "AUTH-RESP-CODE", "PIPELINING", "UTF8 USER", "LANG"}
+	capabilities = append(capabilities, "EXPIRE "+expirePolicy(config, mailbox))
+	if config.LoginDelay > 0 {
+		capabilities = append(capabilities, "LOGIN-DELAY "+strconv.Itoa(config.LoginDelay))
+	}
+	if nil != stlsConfig {
+		capabilities = append(capabilities, "STLS")
+	}
+	return capabilities
+}
+
 func getCommand(line string) (string, []string) {
 	line = strings.Trim(line, "\r \n")
 	cmd := strings.Split(line, " ")
@@ -74,17 +190,85 @@ func getSafeArg(args []string, argIndex int) (string, error) {
 	return "", errors.New("Index out of range")
 }
 
-func writeOKResponse(conn net.Conn, msg string, log bool, args ...interface{}) {
+func writeOKResponse(conn net.Conn, msg string, log *slog.Logger, args ...interface{}) {
 	fmt.Fprintf(conn, "+OK "+msg+eol, args...)
-	if log {
-		fmt.Printf("+OK "+msg, args...)
-	}
+	log.Debug("response", "status", "+OK", "text", fmt.Sprintf(msg, args...))
 }
 
-func writeErrResponse(conn net.Conn, msg string, log bool, args ...interface{}) {
+func writeErrResponse(conn net.Conn, msg string, log *slog.Logger, args ...interface{}) {
 	fmt.Fprintf(conn, "-ERR "+msg+eol, args...)
-	if log {
-		fmt.Printf("-ERR "+msg, args...)
+	log.Info("response", "status", "-ERR", "text", fmt.Sprintf(msg, args...))
+}
+
+//writeMultilineLine writes one line of a multi-line response, byte
+//stuffing lines that start with the termination octet (RFC 1939 section 3)
+func writeMultilineLine(conn net.Conn, line string) {
+	if strings.HasPrefix(line, ".") {
+		io.WriteString(conn, ".")
+	}
+	io.WriteString(conn, line+eol)
+}
+
+//writeMessageLine writes a line of a message for RETR or TOP, header
+//lines are down-converted to ASCII when downgrade is set
+func writeMessageLine(conn net.Conn, line string, inHeaders bool, downgrade bool) {
+	if inHeaders && downgrade {
+		line = mailutils.DowngradeHeader(line)
+	}
+	writeMultilineLine(conn, line)
+}
+
+//retrSize returns the octets RETR sends for a message, which differ from
+//the cached size when its headers are downgraded
+func retrSize(fullFilePath string, message *mailutils.MailData, downgrade bool) (int, error) {
+	if !downgrade {
+		return message.TotalSize, nil
+	}
+	file, err := os.Open(fullFilePath)
+	if nil != err {
+		return 0, err
+	}
+	defer file.Close()
+	size := 0
+	err = mailutils.ReadLines(file, func(line string) bool {
+		if line == "" {
+			return false
+		}
+		size += len(mailutils.DowngradeHeader(line)) + len(eol)
+		return true
+	})
+	return size + message.TotalSize - message.HeaderSize, err
+}
+
+//writeCodedErrResponse writes a negative response with a response code
+func writeCodedErrResponse(conn net.Conn, code string, msg string, log *slog.Logger, args ...interface{}) {
+	writeErrResponse(conn, "["+code+"] "+msg, log, args...)
+}
+
+//responseCode chooses the response code for an error from the local
+//cache or the backend
+func responseCode(err error) string {
+	switch {
+	case errors.Is(err, mailutils.ErrInvalidMailbox):
+		return RESP_AUTH
+	case errors.Is(err, mailutils.ErrCorruptMetadata), errors.Is(err, mailutils.ErrCorruptIndex), backend.IsPermanent(err):
+		return RESP_SYS_PERM
+	}
+	return RESP_SYS_TEMP
+}
+
+//writeMailboxError reports a mailbox that cannot be opened. Only this
+//session is affected, the response code tells the client whether trying
+//again later may help.
+func writeMailboxError(conn net.Conn, err error, lang *language, log *slog.Logger) {
+	log.Error("mailbox unavailable", "error", err)
+	switch code := responseCode(err); code {
+	case RESP_AUTH:
+		writeCodedErrResponse(conn, code, lang.text("Invalid user name"), log)
+	case RESP_SYS_PERM:
+		writeCodedErrResponse(conn, code, lang.text("Mailbox unavailable"), log)
+	default:
+		writeCodedErrResponse(conn, code, lang.text("Mailbox temporarily unavailable"), log)
 	}
 }
 
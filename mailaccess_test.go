@@ -0,0 +1,82 @@
+package main
+
+/*
+    s3pop-server: An AWS S3 backed POP3 server
+	Copyright (C) 2018 James W Matheson
+	fractal.mango@gmail.com
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/FractalJim/s3pop-server/mailutils"
+)
+
+func TestMessageIndex(t *testing.T) {
+	mailData := []*mailutils.MailData{{ID: 1}, {ID: 2}, {ID: 3}}
+	tests := []struct {
+		arg string
+		id  int
+		ok  bool
+	}{
+		{"1", 0, true},
+		{"3", 2, true},
+		{"4", 0, false},
+		{"0", 0, false},
+		{"-1", 0, false},
+		{"x", 0, false},
+		{"", 0, false},
+		{"99999999999999999999", 0, false},
+	}
+	for _, test := range tests {
+		id, ok := messageIndex(test.arg, mailData)
+		if id != test.id || ok != test.ok {
+			t.Errorf("messageIndex(%q) = %d, %t, want %d, %t", test.arg, id, ok, test.id, test.ok)
+		}
+	}
+}
+
+func TestRetrSize(t *testing.T) {
+	headers := []string{"From: \"Jürgen\" <j@example.com>", "Subject: Grüße"}
+	body := []string{"", "text"}
+	content := strings.Join(append(headers, body...), eol) + eol
+	filename := filepath.Join(t.TempDir(), "email")
+	err := os.WriteFile(filename, []byte(content), 0600)
+	if nil != err {
+		t.Fatal(err)
+	}
+	message := &mailutils.MailData{HeaderSize: len(strings.Join(headers, eol) + eol), TotalSize: len(content)}
+
+	size, err := retrSize(filename, message, false)
+	if nil != err || size != len(content) {
+		t.Errorf("retrSize without downgrade = %d, %v, want %d", size, err, len(content))
+	}
+	downgraded := 0
+	for _, line := range append(headers, body...) {
+		if strings.HasPrefix(line, "From:") || strings.HasPrefix(line, "Subject:") {
+			line = mailutils.DowngradeHeader(line)
+		}
+		downgraded += len(line) + len(eol)
+	}
+	size, err = retrSize(filename, message, true)
+	if nil != err || size != downgraded {
+		t.Errorf("retrSize with downgrade = %d, %v, want %d", size, err, downgraded)
+	}
+}
@@ -0,0 +1,63 @@
+package mailutils
+
+/*
+    s3pop-server: An AWS S3 backed POP3 server
+	Copyright (C) 2018 James W Matheson
+	fractal.mango@gmail.com
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+import (
+	"errors"
+)
+
+//Kinds of cache failure, test for them with errors.Is
+var (
+	//ErrCacheUnavailable means the local cache directory or one of its
+	//files could not be created, read or written
+	ErrCacheUnavailable = errors.New("mail cache unavailable")
+	//ErrCorruptMetadata means a message's .json sidecar could not be parsed
+	ErrCorruptMetadata = errors.New("corrupt message metadata")
+	//ErrCorruptIndex means the index of seen messages could not be parsed
+	ErrCorruptIndex = errors.New("corrupt message index")
+	//ErrInvalidMailbox means a mailbox name cannot be used as a directory
+	ErrInvalidMailbox = errors.New("invalid mailbox name")
+)
+
+//CacheError wraps an underlying error with the kind of failure and the
+//file it happened on
+type CacheError struct {
+	Kind error
+	Path string
+	Err  error
+}
+
+func (e *CacheError) Error() string {
+	if nil == e.Err {
+		return e.Kind.Error() + ": " + e.Path
+	}
+	return e.Kind.Error() + ": " + e.Path + ": " + e.Err.Error()
+}
+
+func (e *CacheError) Unwrap() []error {
+	if nil == e.Err {
+		return []error{e.Kind}
+	}
+	return []error{e.Kind, e.Err}
+}
+
+func NewCacheError(kind error, path string, err error) error {
+	return &CacheError{Kind: kind, Path: path, Err: err}
+}
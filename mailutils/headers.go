@@ -0,0 +1,85 @@
+package mailutils
+
+/*
+    s3pop-server: An AWS S3 backed POP3 server
+	Copyright (C) 2018 James W Matheson
+	fractal.mango@gmail.com
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+import (
+	"mime"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+//quotedString matches a quoted display name in an address header
+var quotedString = regexp.MustCompile(`"[^"]*"`)
+
+//DowngradeHeader rewrites a header line containing UTF-8 as plain ASCII
+//for clients that have not enabled UTF8 mode (RFC 6856 section 3), the
+//text is replaced with RFC 2047 encoded-words. Addresses in angle
+//brackets are left alone as encoded-words are not allowed in them.
+func DowngradeHeader(line string) string {
+	if IsASCII(line) {
+		return line
+	}
+	name, value := "", line
+	colon := strings.IndexByte(line, ':')
+	if colon > 0 && line[0] != ' ' && line[0] != '\t' {
+		name, value = line[:colon+1], line[colon+1:]
+	}
+
+	//a quoted display name becomes a single encoded-word, which keeps any
+	//commas in it from being read as address separators
+	value = quotedString.ReplaceAllStringFunc(value, func(quoted string) string {
+		if IsASCII(quoted) {
+			return quoted
+		}
+		return mime.BEncoding.Encode("utf-8", strings.Trim(quoted, `"`))
+	})
+
+	//runs of words with 8-bit characters are encoded together so the
+	//spaces between them are kept
+	words := strings.Split(value, " ")
+	downgraded := make([]string, 0, len(words))
+	run := make([]string, 0)
+	for _, word := range words {
+		if !IsASCII(word) && !strings.HasPrefix(word, "<") {
+			run = append(run, word)
+			continue
+		}
+		if len(run) > 0 {
+			downgraded = append(downgraded, mime.BEncoding.Encode("utf-8", strings.Join(run, " ")))
+			run = run[:0]
+		}
+		downgraded = append(downgraded, word)
+	}
+	if len(run) > 0 {
+		downgraded = append(downgraded, mime.BEncoding.Encode("utf-8", strings.Join(run, " ")))
+	}
+	return name + strings.Join(downgraded, " ")
+}
+
+//IsASCII reports whether text is all 7-bit characters
+func IsASCII(text string) bool {
+	for i := 0; i < len(text); i++ {
+		if text[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
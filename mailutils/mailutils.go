@@ -20,12 +20,17 @@ package mailutils
 */
 
 import (
+	"bufio"
 	"encoding/json"
+	"errors"
+	"io"
 	"io/ioutil"
-	"log"
 	"os"
 	"os/user"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type MailData struct {
@@ -35,56 +40,306 @@ type MailData struct {
 	TotalSize   int    `json:"totalSize"`
 	Read        bool   `json:"read"`
 	Name        string `json:"name"`
+	//Folder is the S3 sub-prefix the email was found under, empty for
+	//the top level of the mailbox
+	Folder string `json:"folder,omitempty"`
+	//Key is the S3 object the email was downloaded from relative to the
+	//mailbox, which differs from Folder and Name once a filter has filed
+	//it. Empty for email cached before it was recorded.
+	Key string `json:"key,omitempty"`
+	//Retrieved is when the email was first read, nil while it is unread
+	//and for email read before it was recorded
+	Retrieved *time.Time `json:"retrieved,omitempty"`
+	//Flags are IMAP keywords and flags other than \Seen set by a filter
+	Flags []string `json:"flags,omitempty"`
+	//Verdicts are the checks SES made when the email arrived, nil if it
+	//did not record any
+	Verdicts *Verdicts `json:"verdicts,omitempty"`
 }
 
-func (m *MailData) Save(emailDir string) {
+//MarkRead sets the read flag, recording when the email was first read
+func (m *MailData) MarkRead(read bool) {
+	if read && !m.Read {
+		now := time.Now().UTC()
+		m.Retrieved = &now
+	} else if !read {
+		m.Retrieved = nil
+	}
+	m.Read = read
+}
+
+//ObjectKey is the S3 object the email came from relative to the mailbox
+func (m *MailData) ObjectKey() string {
+	if m.Key != "" {
+		return m.Key
+	}
+	if m.Folder == "" {
+		return m.Name
+	}
+	return m.Folder + "/" + m.Name
+}
+
+//Save writes the metadata sidecar for an email. The file is written
+//under a temporary name and renamed into place so an interrupted write
+//never leaves a truncated sidecar behind.
+func (m *MailData) Save(emailDir string) error {
 	jsonData, err := json.Marshal(&m)
-	checkError(err)
+	if nil != err {
+		return err
+	}
 
 	metadataFilename := filepath.Join(emailDir, m.Name+".json")
-	metadataFile, err := os.Create(metadataFilename)
-	checkError(err)
+	tempFilename := metadataFilename + ".tmp"
+	metadataFile, err := os.Create(tempFilename)
+	if nil != err {
+		return NewCacheError(ErrCacheUnavailable, tempFilename, err)
+	}
 	defer metadataFile.Close()
 
-	metadataFile.Write(jsonData)
+	_, err = metadataFile.Write(jsonData)
+	if nil == err {
+		err = metadataFile.Sync()
+	}
+	if nil == err {
+		err = metadataFile.Close()
+	}
+	if nil == err {
+		err = os.Rename(tempFilename, metadataFilename)
+	}
+	if nil != err {
+		os.Remove(tempFilename)
+		return NewCacheError(ErrCacheUnavailable, metadataFilename, err)
+	}
+	return nil
 }
 
-func LoadMailData(emailDir string, filename string) (m *MailData) {
+func LoadMailData(emailDir string, filename string) (*MailData, error) {
 	if filepath.Ext(filename) != ".json" {
 		filename += ".json"
 	}
 	metadataFilename := filepath.Join(emailDir, filename)
 	jsonData, err := ioutil.ReadFile(metadataFilename)
-	checkError(err)
+	if nil != err {
+		return nil, NewCacheError(ErrCacheUnavailable, metadataFilename, err)
+	}
 
-	m = &MailData{Read: false}
+	m := &MailData{Read: false}
 	err = json.Unmarshal(jsonData, m)
-	checkError(err)
-	return
+	if nil != err {
+		return nil, NewCacheError(ErrCorruptMetadata, metadataFilename, err)
+	}
+	return m, nil
+}
+
+//ListMailData loads the metadata of the messages in one folder of the
+//cache, the folders nested inside it are left out
+func ListMailData(emailDir string) ([]*MailData, error) {
+	var emailMetafiles []string
+	err := filepath.Walk(emailDir, func(path string, info os.FileInfo, err error) error {
+		if nil != err {
+			return err
+		}
+		if info.IsDir() && path != emailDir {
+			return filepath.SkipDir
+		}
+		if !info.IsDir() {
+			if filepath.Ext(path) == ".json" {
+				emailMetafiles = append(emailMetafiles, filepath.Base(path))
+			}
+		}
+		return nil
+	})
+	if nil != err {
+		return nil, NewCacheError(ErrCacheUnavailable, emailDir, err)
+	}
+
+	var result = make([]*MailData, 0)
+	for _, mailItem := range emailMetafiles {
+		itemDetails, err := LoadMailData(emailDir, mailItem)
+		if nil != err {
+			return nil, err
+		}
+		result = append(result, itemDetails)
+	}
+	return result, nil
 }
 
-func GetEmailDir(emailUser string) string {
-	var userInfo *user.User
+//ListMailboxes returns the names of the mailboxes with a local cache
+func ListMailboxes() ([]string, error) {
 	userInfo, err := user.Current()
-	checkError(err)
+	if nil != err {
+		return nil, err
+	}
+	entries, err := ioutil.ReadDir(filepath.Join(userInfo.HomeDir, ".email"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if nil != err {
+		return nil, err
+	}
+	mailboxes := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() {
+			mailboxes = append(mailboxes, entry.Name())
+		}
+	}
+	return mailboxes, nil
+}
+
+//GetEmailDir returns the cache directory for a mailbox, creating it if
+//it does not exist yet
+func GetEmailDir(emailUser string) (string, error) {
+	if !ValidName(emailUser) {
+		return "", NewCacheError(ErrInvalidMailbox, emailUser, nil)
+	}
+	userInfo, err := user.Current()
+	if nil != err {
+		return "", NewCacheError(ErrCacheUnavailable, "~", err)
+	}
 
 	dirName := filepath.Join(userInfo.HomeDir, ".email")
 	_, err = os.Stat(dirName)
 	if nil != err {
 		err = os.Mkdir(dirName, 0700)
-		checkError(err)
+		if nil != err {
+			return "", NewCacheError(ErrCacheUnavailable, dirName, err)
+		}
 	}
 	emailPath := filepath.Join(dirName, emailUser)
 	_, err = os.Stat(emailPath)
 	if nil != err {
 		err = os.Mkdir(emailPath, 0700)
-		checkError(err)
+		if nil != err {
+			return "", NewCacheError(ErrCacheUnavailable, emailPath, err)
+		}
 	}
-	return emailPath
+	return emailPath, nil
+}
+
+//ReadLines calls each with every line of r, without its line ending,
+//until each returns false. Unlike bufio.Scanner there is no limit on the
+//length of a line, email can have very long lines of base64 or HTML.
+func ReadLines(r io.Reader, each func(line string) bool) error {
+	reader := bufio.NewReader(r)
+	for {
+		line, err := reader.ReadString('\n')
+		if len(line) > 0 {
+			line = strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")
+			if !each(line) {
+				return nil
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if nil != err {
+			return err
+		}
+	}
+}
+
+//ValidName reports whether name can be used as a mailbox, folder or file
+//name in the cache without escaping its directory
+func ValidName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, `/\`)
 }
 
-func checkError(err error) {
-	if err != nil {
-		log.Fatal(err)
+//ValidFolder reports whether folder is a usable folder path, with / between
+//the levels of a nested folder. The empty folder is the top level.
+func ValidFolder(folder string) bool {
+	if folder == "" {
+		return true
+	}
+	for _, name := range strings.Split(folder, "/") {
+		if !ValidName(name) {
+			return false
+		}
+	}
+	return true
+}
+
+//GetFolderDir returns the cache directory for a folder of the mailbox
+//cached in emailDir, creating it if it does not exist yet
+func GetFolderDir(emailDir, folder string) (string, error) {
+	if !ValidFolder(folder) {
+		return "", NewCacheError(ErrInvalidMailbox, folder, nil)
+	}
+	if folder == "" {
+		return emailDir, nil
+	}
+	folderDir := filepath.Join(emailDir, filepath.FromSlash(folder))
+	err := os.MkdirAll(folderDir, 0700)
+	if nil != err {
+		return "", NewCacheError(ErrCacheUnavailable, folderDir, err)
+	}
+	return folderDir, nil
+}
+
+//ListFolders returns the folders cached under emailDir in sorted order,
+//nested folders following their parent. The top level is not included.
+func ListFolders(emailDir string) ([]string, error) {
+	folders := make([]string, 0)
+	err := filepath.Walk(emailDir, func(path string, info os.FileInfo, err error) error {
+		if nil != err {
+			return err
+		}
+		if !info.IsDir() || path == emailDir {
+			return nil
+		}
+		folder, err := filepath.Rel(emailDir, path)
+		if nil != err {
+			return err
+		}
+		folders = append(folders, filepath.ToSlash(folder))
+		return nil
+	})
+	if nil != err {
+		return nil, NewCacheError(ErrCacheUnavailable, emailDir, err)
+	}
+	return folders, nil
+}
+
+//uidValidityFileName holds the IMAP UIDVALIDITY of a mailbox's cache, a
+//new value is chosen whenever the cache is recreated so clients do not
+//confuse the ids of new messages with ones they saw before
+const uidValidityFileName = "_uidvalidity.txt"
+
+//UIDValidity returns the UIDVALIDITY for the cache in emailDir
+func UIDValidity(emailDir string) (uint32, error) {
+	filename := filepath.Join(emailDir, uidValidityFileName)
+	data, err := ioutil.ReadFile(filename)
+	if nil == err {
+		validity, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 32)
+		if nil != err {
+			return 0, NewCacheError(ErrCorruptIndex, filename, err)
+		}
+		return uint32(validity), nil
+	}
+	if !os.IsNotExist(err) {
+		return 0, NewCacheError(ErrCacheUnavailable, filename, err)
+	}
+	validity := uint32(time.Now().Unix())
+	return validity, writeUIDValidity(filename, validity)
+}
+
+//ResetUIDValidity chooses a new UIDVALIDITY for the cache in emailDir,
+//for when the ids of the messages already in it have changed
+func ResetUIDValidity(emailDir string) error {
+	old, err := UIDValidity(emailDir)
+	if nil != err && !errors.Is(err, ErrCorruptIndex) {
+		return err
+	}
+	validity := uint32(time.Now().Unix())
+	if validity <= old {
+		validity = old + 1
+	}
+	return writeUIDValidity(filepath.Join(emailDir, uidValidityFileName), validity)
+}
+
+func writeUIDValidity(filename string, validity uint32) error {
+	err := ioutil.WriteFile(filename, []byte(strconv.FormatUint(uint64(validity), 10)+"\n"), 0600)
+	if nil != err {
+		return NewCacheError(ErrCacheUnavailable, filename, err)
 	}
+	return nil
 }
@@ -0,0 +1,151 @@
+package mailutils
+
+/*
+    s3pop-server: An AWS S3 backed POP3 server
+	Copyright (C) 2018 James W Matheson
+	fractal.mango@gmail.com
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+import (
+	"strings"
+)
+
+//sesAuthServID identifies the Authentication-Results header added by SES
+const sesAuthServID = "amazonses.com"
+
+//Verdicts are the results of the checks SES ran on an incoming email, as
+//recorded in the headers it added. Checks that were not run are empty.
+type Verdicts struct {
+	Spam  string `json:"spam,omitempty"`
+	Virus string `json:"virus,omitempty"`
+	SPF   string `json:"spf,omitempty"`
+	DKIM  string `json:"dkim,omitempty"`
+	DMARC string `json:"dmarc,omitempty"`
+}
+
+//Failed returns the names of the checks the email failed
+func (v *Verdicts) Failed() []string {
+	failed := make([]string, 0)
+	if nil == v {
+		return failed
+	}
+	checks := []struct{ name, result string }{
+		{"spam", v.Spam}, {"virus", v.Virus}, {"spf", v.SPF}, {"dkim", v.DKIM}, {"dmarc", v.DMARC},
+	}
+	for _, check := range checks {
+		if check.result == "fail" {
+			failed = append(failed, check.name)
+		}
+	}
+	return failed
+}
+
+//ParseVerdicts reads the SES verdicts from the header lines of an email,
+//nil if there are none. SES puts its headers at the top, so only the first
+//of each is used and reading stops at the first header SES did not add,
+//as a sender could add verdict headers of its own below it.
+func ParseVerdicts(headers []string) *Verdicts {
+	verdicts := &Verdicts{}
+	found := false
+	set := func(field *string, value string) {
+		if *field == "" && value != "" {
+			*field = strings.ToLower(value)
+			found = true
+		}
+	}
+	seen := make(map[string]bool)
+	for _, header := range unfoldHeaders(headers) {
+		name, value, ok := strings.Cut(header, ":")
+		if !ok {
+			break
+		}
+		name = strings.ToLower(strings.TrimSpace(name))
+		value = strings.TrimSpace(value)
+		if !sesHeader(name, value, seen) {
+			break
+		}
+		switch name {
+		case "x-ses-spam-verdict":
+			set(&verdicts.Spam, value)
+		case "x-ses-virus-verdict":
+			set(&verdicts.Virus, value)
+		case "received-spf":
+			set(&verdicts.SPF, firstWord(value))
+		case "authentication-results":
+			results := strings.Split(value, ";")
+			for _, result := range results[1:] {
+				method, outcome, ok := strings.Cut(firstWord(strings.TrimSpace(result)), "=")
+				if !ok {
+					continue
+				}
+				switch strings.ToLower(method) {
+				case "spf":
+					set(&verdicts.SPF, outcome)
+				case "dkim":
+					set(&verdicts.DKIM, outcome)
+				case "dmarc":
+					set(&verdicts.DMARC, outcome)
+				}
+			}
+		}
+	}
+	if !found {
+		return nil
+	}
+	return verdicts
+}
+
+//sesHeader reports whether a header can be one SES added above the email's
+//own: its Return-Path and Received, which it adds once each, and its
+//verdict headers. seen records the headers already passed.
+func sesHeader(name string, value string, seen map[string]bool) bool {
+	switch {
+	case name == "return-path", name == "received":
+		if seen[name] {
+			return false
+		}
+		seen[name] = true
+		return true
+	case name == "authentication-results":
+		authServID, _, _ := strings.Cut(value, ";")
+		return strings.EqualFold(strings.TrimSpace(authServID), sesAuthServID)
+	case name == "received-spf", strings.HasPrefix(name, "x-ses-"):
+		return true
+	}
+	return false
+}
+
+//unfoldHeaders joins the continuation lines of folded headers onto the
+//line they continue
+func unfoldHeaders(headers []string) []string {
+	unfolded := make([]string, 0, len(headers))
+	for _, line := range headers {
+		if len(unfolded) > 0 && (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) {
+			unfolded[len(unfolded)-1] += " " + strings.TrimSpace(line)
+			continue
+		}
+		unfolded = append(unfolded, line)
+	}
+	return unfolded
+}
+
+func firstWord(text string) string {
+	fields := strings.Fields(text)
+	if len(fields) == 0 {
+		return ""
+	}
+	return fields[0]
+}
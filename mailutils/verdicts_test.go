@@ -0,0 +1,78 @@
+package mailutils
+
+/*
+    s3pop-server: An AWS S3 backed POP3 server
+	Copyright (C) 2018 James W Matheson
+	fractal.mango@gmail.com
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestParseVerdicts(t *testing.T) {
+	sample, err := os.ReadFile("../backend/testdata/test_email")
+	if nil != err {
+		t.Fatal(err)
+	}
+	header, _, _ := strings.Cut(strings.ReplaceAll(string(sample), "\r\n", "\n"), "\n\n")
+	tests := []struct {
+		name    string
+		headers []string
+		want    *Verdicts
+	}{
+		{"ses", strings.Split(header, "\n"), &Verdicts{Spam: "pass", Virus: "pass", SPF: "pass", DKIM: "pass"}},
+		{"no verdicts", []string{"From: a@example.com", "Subject: hi"}, nil},
+		{"first of each", []string{
+			"Return-Path: <a@example.com>",
+			"X-SES-Spam-Verdict: FAIL",
+			"X-SES-Spam-Verdict: PASS",
+		}, &Verdicts{Spam: "fail"}},
+		{"sender headers below ses", []string{
+			"Return-Path: <a@example.com>",
+			"Received: from mx by inbound-smtp.us-east-1.amazonaws.com",
+			"X-SES-Spam-Verdict: PASS",
+			"Received: by sender.example.com",
+			"X-SES-Virus-Verdict: PASS",
+			"Authentication-Results: amazonses.com; dkim=pass",
+		}, &Verdicts{Spam: "pass"}},
+		{"sender headers only", []string{
+			"From: a@example.com",
+			"X-SES-Spam-Verdict: PASS",
+			"X-SES-Virus-Verdict: PASS",
+		}, nil},
+		{"other authserv-id", []string{
+			"Authentication-Results: example.com; dkim=pass",
+			"X-SES-Spam-Verdict: PASS",
+		}, nil},
+		{"folded", []string{
+			"Authentication-Results: amazonses.com;",
+			" spf=fail smtp.mailfrom=a@example.com;",
+			" dkim=pass; dmarc=fail",
+		}, &Verdicts{SPF: "fail", DKIM: "pass", DMARC: "fail"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := ParseVerdicts(test.headers)
+			if (nil == got) != (nil == test.want) || (nil != got && *got != *test.want) {
+				t.Errorf("got %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
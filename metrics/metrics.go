@@ -0,0 +1,216 @@
+package metrics
+
+/*
+    s3pop-server: An AWS S3 backed POP3 server
+	Copyright (C) 2018 James W Matheson
+	fractal.mango@gmail.com
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+//Prometheus collectors shared by the server and the backend. They are
+//registered with the default registry and are always updated, whether or
+//not the metrics endpoint is enabled.
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const namespace = "s3pop"
+
+//OtherMailbox labels counters for mailboxes not named in the config, as
+//any client can log in with a made up mailbox name
+const OtherMailbox = "other"
+
+var (
+	mailboxesMu sync.Mutex
+	mailboxes   = make(map[string]struct{})
+)
+
+var SessionsActive = promauto.NewGauge(prometheus.GaugeOpts{
+	Namespace: namespace,
+	Name:      "sessions_active",
+	Help:      "Number of POP3 sessions currently open.",
+})
+
+var SessionsTotal = promauto.NewCounter(prometheus.CounterOpts{
+	Namespace: namespace,
+	Name:      "sessions_total",
+	Help:      "Number of POP3 sessions started.",
+})
+
+var SessionsRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace,
+	Name:      "sessions_rejected_total",
+	Help:      "Connections refused before a session started, by reason.",
+}, []string{"reason"})
+
+var Commands = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace,
+	Name:      "commands_total",
+	Help:      "POP3 commands processed, by command and result.",
+}, []string{"command", "result"})
+
+var BytesSent = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace,
+	Name:      "sent_bytes_total",
+	Help:      "Bytes of message data sent to clients, by command.",
+}, []string{"command"})
+
+var AuthFailures = promauto.NewCounter(prometheus.CounterOpts{
+	Namespace: namespace,
+	Name:      "auth_failures_total",
+	Help:      "Failed USER, PASS and AUTH attempts.",
+})
+
+var SessionPanics = promauto.NewCounter(prometheus.CounterOpts{
+	Namespace: namespace,
+	Name:      "session_panics_total",
+	Help:      "Sessions ended by an internal error.",
+})
+
+var S3RequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: namespace,
+	Name:      "s3_request_duration_seconds",
+	Help:      "Latency of S3 requests, by operation.",
+	Buckets:   prometheus.ExponentialBuckets(0.01, 2, 12),
+}, []string{"operation"})
+
+var S3Errors = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace,
+	Name:      "s3_errors_total",
+	Help:      "Failed S3 requests, by operation.",
+}, []string{"operation"})
+
+var SESRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: namespace,
+	Name:      "ses_request_duration_seconds",
+	Help:      "Latency of SES requests, by operation.",
+	Buckets:   prometheus.ExponentialBuckets(0.01, 2, 12),
+}, []string{"operation"})
+
+var SESErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace,
+	Name:      "ses_errors_total",
+	Help:      "Failed SES requests, by operation.",
+}, []string{"operation"})
+
+var MessagesSubmitted = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace,
+	Name:      "messages_submitted_total",
+	Help:      "Messages received by the SMTP submission listener, by result.",
+}, []string{"result"})
+
+var MessagesExpired = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace,
+	Name:      "messages_expired_total",
+	Help:      "Messages removed or archived by the retention policies, by action.",
+}, []string{"action"})
+
+var QuotaUsedBytes = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: namespace,
+	Name:      "quota_used_bytes",
+	Help:      "Octets of email cached for a mailbox with a quota, in all folders, by mailbox.",
+}, []string{"mailbox"})
+
+var QuotaLimitBytes = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: namespace,
+	Name:      "quota_limit_bytes",
+	Help:      "Quota of a mailbox in octets, by mailbox.",
+}, []string{"mailbox"})
+
+var SyncErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace,
+	Name:      "sync_errors_total",
+	Help:      "Failed mailbox downloads from S3, by mailbox (other for mailboxes not in the config).",
+}, []string{"mailbox"})
+
+var LastSyncSuccess = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: namespace,
+	Name:      "last_sync_success_timestamp_seconds",
+	Help:      "Unix time of the last successful download from S3, by mailbox.",
+}, []string{"mailbox"})
+
+var CacheMessages = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: namespace,
+	Name:      "cache_messages",
+	Help:      "Messages in the local cache, by mailbox.",
+}, []string{"mailbox"})
+
+var CacheBytes = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: namespace,
+	Name:      "cache_bytes",
+	Help:      "Size of the messages in the local cache in octets, by mailbox.",
+}, []string{"mailbox"})
+
+//ObserveS3 records the latency of an S3 request started at start and
+//counts it as an error if err is not nil
+func ObserveS3(operation string, start time.Time, err error) {
+	S3RequestDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+	if nil != err {
+		S3Errors.WithLabelValues(operation).Inc()
+	}
+}
+
+//ObserveSES records the latency of an SES request started at start and
+//counts it as an error if err is not nil
+func ObserveSES(operation string, start time.Time, err error) {
+	SESRequestDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+	if nil != err {
+		SESErrors.WithLabelValues(operation).Inc()
+	}
+}
+
+//SetMailboxes names the mailboxes given their own label, replacing those
+//named before
+func SetMailboxes(names []string) {
+	known := make(map[string]struct{}, len(names))
+	for _, name := range names {
+		known[name] = struct{}{}
+	}
+	mailboxesMu.Lock()
+	mailboxes = known
+	mailboxesMu.Unlock()
+}
+
+//KnownMailbox says whether a mailbox was named by SetMailboxes. Gauges
+//are only set for known mailboxes.
+func KnownMailbox(mailbox string) bool {
+	mailboxesMu.Lock()
+	defer mailboxesMu.Unlock()
+	_, ok := mailboxes[mailbox]
+	return ok
+}
+
+//MailboxLabel returns the label counters use for a mailbox, OtherMailbox
+//for those not named by SetMailboxes
+func MailboxLabel(mailbox string) string {
+	if KnownMailbox(mailbox) {
+		return mailbox
+	}
+	return OtherMailbox
+}
+
+//SetCacheSize records the size of a known mailbox's local cache
+func SetCacheSize(mailbox string, messages int, octets int) {
+	if !KnownMailbox(mailbox) {
+		return
+	}
+	CacheMessages.WithLabelValues(mailbox).Set(float64(messages))
+	CacheBytes.WithLabelValues(mailbox).Set(float64(octets))
+}
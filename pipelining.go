@@ -0,0 +1,57 @@
+package main
+
+/*
+    s3pop-server: An AWS S3 backed POP3 server
+	Copyright (C) 2018 James W Matheson
+	fractal.mango@gmail.com
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+import (
+	"bufio"
+	"net"
+)
+
+//responseBufferSize is large enough to batch the responses to a burst of
+//pipelined commands, longer responses are written as the buffer fills
+const responseBufferSize = 32 * 1024
+
+//bufferedConn collects responses so that pipelined commands (RFC 2449
+//PIPELINING) are answered with a few large writes rather than one write
+//per line. Flush must be called before waiting for the next command.
+type bufferedConn struct {
+	net.Conn
+	writer *bufio.Writer
+}
+
+func newBufferedConn(conn net.Conn) *bufferedConn {
+	return &bufferedConn{Conn: conn, writer: bufio.NewWriterSize(conn, responseBufferSize)}
+}
+
+func (c *bufferedConn) Write(b []byte) (int, error) {
+	return c.writer.Write(b)
+}
+
+func (c *bufferedConn) Flush() error {
+	return c.writer.Flush()
+}
+
+//upgrade sends anything still buffered then switches to conn, used once
+//STLS has negotiated TLS
+func (c *bufferedConn) upgrade(conn net.Conn) {
+	c.writer.Flush()
+	c.Conn = conn
+	c.writer.Reset(conn)
+}
@@ -0,0 +1,71 @@
+package main
+
+/*
+    s3pop-server: An AWS S3 backed POP3 server
+	Copyright (C) 2018 James W Matheson
+	fractal.mango@gmail.com
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+
+	"github.com/FractalJim/s3pop-server/backend"
+)
+
+//mailboxFull reports whether a mailbox with a quota is full. Over its
+//quota a mailbox is read-only: new email waits in S3 and nothing is added
+//to it until some is deleted.
+func mailboxFull(config *ServerConfig, mailbox string) bool {
+	quota, ok := config.Quotas[mailbox]
+	if !ok {
+		return false
+	}
+	usage, err := backend.CheckQuota(mailbox, &quota)
+	if nil != err {
+		slog.Warn("could not check quota", "mailbox", mailbox, "error", err)
+		return false
+	}
+	return usage.Full
+}
+
+//quotaReport is served at /quota, the usage of each mailbox with a quota
+type quotaReport struct {
+	Mailboxes map[string]backend.QuotaUsage `json:"mailboxes"`
+	Errors    map[string]string             `json:"errors,omitempty"`
+}
+
+func (s *popServer) quotaHandler(w http.ResponseWriter, r *http.Request) {
+	config := s.currentConfig()
+	report := &quotaReport{Mailboxes: make(map[string]backend.QuotaUsage)}
+	for mailbox, quota := range config.Quotas {
+		usage, err := backend.CheckQuota(mailbox, &quota)
+		if nil != err {
+			if nil == report.Errors {
+				report.Errors = make(map[string]string)
+			}
+			report.Errors[mailbox] = err.Error()
+			continue
+		}
+		report.Mailboxes[mailbox] = usage
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(report)
+}
@@ -0,0 +1,129 @@
+package main
+
+/*
+    s3pop-server: An AWS S3 backed POP3 server
+	Copyright (C) 2018 James W Matheson
+	fractal.mango@gmail.com
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/FractalJim/s3pop-server/backend"
+)
+
+//retentionInterval is how often the janitor applies the retention
+//policies while the server runs
+const retentionInterval = time.Hour
+
+//startJanitor applies the retention policies every retentionInterval,
+//starting shortly after the server starts
+func startJanitor(currentConfig func() *ServerConfig) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		timer := time.NewTimer(time.Minute)
+		defer timer.Stop()
+		for {
+			select {
+			case <-timer.C:
+				expireMailboxes(currentConfig())
+				timer.Reset(retentionInterval)
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+//expireMailboxes applies the retention policy of each mailbox that has
+//one. A mailbox with a POP3 or IMAP session open is left until the next
+//run so messages don't disappear from under the session.
+func expireMailboxes(config *ServerConfig) {
+	mailboxes := make([]string, 0, len(config.Retention))
+	for mailbox := range config.Retention {
+		mailboxes = append(mailboxes, mailbox)
+	}
+	sort.Strings(mailboxes)
+	for _, mailbox := range mailboxes {
+		if !lockIdleMailbox(mailbox) {
+			slog.Info("mailbox in use, expiry postponed", "mailbox", mailbox)
+			continue
+		}
+		policy := config.Retention[mailbox]
+		result, err := backend.ExpireEmails(config.S3Bucket, mailbox, &policy, time.Now())
+		unlockMailbox(mailbox)
+		if nil != err {
+			slog.Error("expiry failed", "mailbox", mailbox, "error", err)
+			continue
+		}
+		if result.Deleted+result.Archived+result.Failed > 0 {
+			slog.Info("expired email", "mailbox", mailbox, "deleted", result.Deleted, "archived", result.Archived, "failed", result.Failed)
+		}
+	}
+}
+
+//expirePolicy is the value of the EXPIRE capability (RFC 2449 section
+//6.7), the days read messages are kept. Before login it is the shortest
+//of any mailbox followed by USER, as it varies between mailboxes.
+func expirePolicy(config *ServerConfig, mailbox string) string {
+	if mailbox != "" {
+		policy, ok := config.Retention[mailbox]
+		if !ok || policy.RetrievedDays == 0 {
+			return "NEVER"
+		}
+		return strconv.Itoa(policy.RetrievedDays)
+	}
+	shortest := 0
+	for _, policy := range config.Retention {
+		if policy.RetrievedDays > 0 && (shortest == 0 || policy.RetrievedDays < shortest) {
+			shortest = policy.RetrievedDays
+		}
+	}
+	if shortest == 0 {
+		return "NEVER"
+	}
+	return strconv.Itoa(shortest) + " USER"
+}
+
+func expireCommand(args []string) int {
+	flags := newFlagSet("expire")
+	if !parseArgs(flags, args, 1, 1) {
+		return EXIT_USAGE
+	}
+	config := loadConfig()
+	mailbox := flags.Arg(0)
+	policy, ok := config.Retention[mailbox]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "No retention policy for %s\n", mailbox)
+		return EXIT_FAILURE
+	}
+	result, err := backend.ExpireEmails(config.S3Bucket, mailbox, &policy, time.Now())
+	if nil != err {
+		fmt.Fprintf(os.Stderr, "Could not expire emails: %s\n", err.Error())
+		return EXIT_FAILURE
+	}
+	fmt.Printf("%d messages deleted, %d archived, %d failed\n", result.Deleted, result.Archived, result.Failed)
+	if result.Failed > 0 {
+		return EXIT_FAILURE
+	}
+	return EXIT_OK
+}
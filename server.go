@@ -22,17 +22,21 @@ package main
 
 import (
 	"bufio"
-	"encoding/json"
+	"crypto/tls"
 	"fmt"
-	"io/ioutil"
-	"log"
+	"io"
+	"log/slog"
 	"net"
 	"os"
 	"path/filepath"
+	"runtime/debug"
 	"strconv"
+	"time"
+	"unicode/utf8"
 
 	"github.com/FractalJim/s3pop-server/backend"
 	"github.com/FractalJim/s3pop-server/mailutils"
+	"github.com/FractalJim/s3pop-server/metrics"
 )
 
 const (
@@ -43,130 +47,255 @@ const (
 
 const eol = "\r\n"
 const multilineTerminator = ".\r\n"
-const defaultport = 5110
-
-type ServerConfig struct {
-	Port     int    `json:"port"`
-	S3Bucket string `json:"s3Bucket`
-}
 
 func main() {
-	config := loadConfig()
-
-	listener, err := net.Listen("tcp", ":"+strconv.Itoa(config.Port))
-
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error.. %s", err.Error())
-	}
-	fmt.Println("Server started.")
-	fmt.Println("Listening on port: " + strconv.Itoa(config.Port))
-	for {
-		conn, err := listener.Accept()
-		if err != nil {
-			continue
-		}
-		// run as goroutine
-		go handleClient(conn, config)
-	}
-
+	os.Exit(runCommand(os.Args[1:]))
 }
 
-func loadConfig() (config *ServerConfig) {
-	configFilename := "server-config.json"
-	config = new(ServerConfig)
-	config.Port = defaultport
-	jsonData, err := ioutil.ReadFile(configFilename)
-	if nil != err {
-		log.Fatal("No server-config.json found")
-	} else {
-		err = json.Unmarshal(jsonData, config)
-		if nil != err {
-			log.Fatal("Config file is not valid JSON")
-		}
-	}
-	return
-}
-
-func handleClient(conn net.Conn, config *ServerConfig) {
+//handleClient runs a POP3 session. stlsConfig is non nil if the client
+//may upgrade the connection with STLS. The session ends without entering
+//the UPDATE state once stopping is closed.
+func handleClient(conn net.Conn, config *ServerConfig, stlsConfig *tls.Config, stopping <-chan struct{}) {
 	defer conn.Close()
+	clientLog := slog.With("session", newSessionID(), "remote", conn.RemoteAddr().String())
+	sessionLog := clientLog
+	started := time.Now()
+	commandCount := 0
+	sessionLog.Info("session started", "local", conn.LocalAddr().String())
+	metrics.SessionsTotal.Inc()
+	metrics.SessionsActive.Inc()
+	var lastCmd string
+	//response text language, chosen with LANG
+	var lang = languages[0]
+	idleTimeout := time.Duration(config.IdleTimeout) * time.Second
+	buffered := newBufferedConn(&timeoutConn{Conn: conn, writeTimeout: time.Duration(config.WriteTimeout) * time.Second})
+	defer buffered.Flush()
+	metered := &meteredConn{Conn: buffered}
+	conn = metered
+	defer func() {
+		if lastCmd != "" {
+			recordCommand(lastCmd, metered)
+		}
+		metrics.SessionsActive.Dec()
+		sessionLog.Info("session ended", "duration", time.Since(started).Round(time.Millisecond), "commands", commandCount)
+	}()
+	//a bug in one session must not take down the server, recover and end
+	//just this session. Deferred after the cleanup above so it runs first.
+	defer func() {
+		if r := recover(); r != nil {
+			metrics.SessionPanics.Inc()
+			sessionLog.Error("session panicked", "panic", r, "command", lastCmd, "stack", string(debug.Stack()))
+			writeCodedErrResponse(conn, RESP_SYS_PERM, lang.text("internal error"), sessionLog)
+		}
+	}()
+	//also bounds the TLS handshake on implicit TLS listeners
+	conn.SetReadDeadline(time.Now().Add(idleTimeout))
 
 	var state = STATE_UNAUTHORIZED
 	var emailDir string
 	var emailBucket = config.S3Bucket
 	var deletedItems map[int]struct{}
 	var mailData []*mailutils.MailData
+	//set by the UTF8 command (RFC 6856)
+	var utf8Mode bool
+	//set once USER has locked a mailbox
+	var lockedMailbox string
+	defer func() {
+		if lockedMailbox != "" {
+			unlockMailbox(lockedMailbox)
+		}
+	}()
 	reader := bufio.NewReader(conn)
 
-	fmt.Fprintf(conn, "+OK S3 POP3 server: powered by Go"+eol)
+	io.WriteString(conn, "+OK S3 POP3 server: powered by Go"+eol)
+	metered.reset()
 
 	for {
+		if lastCmd != "" {
+			recordCommand(lastCmd, metered)
+			lastCmd = ""
+		}
+		//answer a pipelined batch of commands in one go, the responses
+		//are sent once there are no more commands waiting to be read
+		if reader.Buffered() == 0 {
+			err := buffered.Flush()
+			if nil != err {
+				if !isClosed(stopping) {
+					sessionLog.Warn("write failed", "error", err)
+				}
+				return
+			}
+		}
+
+		//RFC 1939 autologout timer, set before checking stopping so a
+		//drain that starts after the check still interrupts the read
+		conn.SetReadDeadline(time.Now().Add(idleTimeout))
+		if isClosed(stopping) {
+			return
+		}
+
 		// Reads a line from the client
-		raw_line, err := reader.ReadString('\n')
+		raw_line, err := readLine(reader, config.MaxLineLength)
+		if err == errLineTooLong {
+			writeErrResponse(conn, lang.text("Command line too long"), sessionLog)
+			continue
+		}
 		if err != nil {
-			fmt.Println("Error!!" + err.Error())
+			if isTimeout(err) && !isClosed(stopping) {
+				writeErrResponse(conn, lang.text("Autologout timer expired"), sessionLog)
+			} else if err != io.EOF && !isClosed(stopping) {
+				sessionLog.Warn("read failed", "error", err)
+			}
 			return
 		}
 
 		// Parses the command
 		cmd, args := getCommand(raw_line)
+		downgrade := config.DowngradeHeaders && !utf8Mode
+
+		commandCount++
+		lastCmd = cmd
+		sessionLog.Info("command", "cmd", cmd, "args", redactArgs(cmd, args))
+		if cmd == "CAPA" {
+			writeOKResponse(conn, lang.text("Capability list follows"), sessionLog)
+			loggedIn := ""
+			if state == STATE_TRANSACTION {
+				loggedIn = lockedMailbox
+			}
+			for _, capability := range getCapabilities(stlsConfig, config, loggedIn) {
+				io.WriteString(conn, capability+eol)
+			}
+			io.WriteString(conn, multilineTerminator)
 
-		fmt.Println("Recieved Command: " + cmd)
-		err = nil
-		argNum := 0
-		var arg string
-		for err == nil {
-			arg, err = getSafeArg(args, argNum)
-			if nil == err {
-				fmt.Printf("Argument %d: %s\n", argNum, arg)
+		} else if cmd == "STLS" && state == STATE_UNAUTHORIZED && nil != stlsConfig {
+			if reader.Buffered() > 0 {
+				//anything sent before the handshake could have been injected
+				writeErrResponse(conn, lang.text("Command received after STLS"), sessionLog)
+				return
 			}
-			argNum++
-		}
-		fmt.Println("")
-		if cmd == "USER" && state == STATE_UNAUTHORIZED {
+			writeOKResponse(conn, lang.text("Begin TLS negotiation"), sessionLog)
+			buffered.Flush()
+			tlsConn := tls.Server(buffered.Conn, stlsConfig)
+			err = tlsConn.Handshake()
+			if nil != err {
+				sessionLog.Warn("TLS handshake failed", "error", err)
+				return
+			}
+			buffered.upgrade(tlsConn)
+			reader = bufio.NewReader(conn)
+			//TLS cannot be started twice
+			stlsConfig = nil
+
+		} else if cmd == "LANG" && state != STATE_UPDATE {
+			tag, err := getSafeArg(args, 0)
+			if nil != err {
+				writeOKResponse(conn, lang.text("Language listing follows"), sessionLog)
+				for _, available := range languages {
+					io.WriteString(conn, available.tag+" "+available.name+eol)
+				}
+				io.WriteString(conn, multilineTerminator)
+				continue
+			}
+			selected := findLanguage(tag)
+			if nil == selected {
+				writeErrResponse(conn, lang.text("invalid language"), sessionLog)
+				continue
+			}
+			lang = selected
+			writeOKResponse(conn, "%s "+lang.text("Language changed"), sessionLog, lang.tag)
+
+		} else if cmd == "UTF8" && state == STATE_UNAUTHORIZED {
+			utf8Mode = true
+			writeOKResponse(conn, lang.text("UTF8 enabled"), sessionLog)
+
+		} else if cmd == "USER" && state == STATE_UNAUTHORIZED {
 			//User name is name of folder in bucket in S3
 			userName, err := getSafeArg(args, 0)
 			if nil != err {
-				writeErrResponse(conn, "No user name", false)
+				writeErrResponse(conn, lang.text("No user name"), sessionLog)
+				continue
+			}
+			if !utf8.ValidString(userName) {
+				writeCodedErrResponse(conn, RESP_AUTH, lang.text("User name is not valid UTF-8"), sessionLog)
 				continue
 			}
-			emailDir = mailutils.GetEmailDir(userName)
-			err = backend.DownloadEmails(emailBucket, userName)
+			if lockedMailbox != "" {
+				//a second USER replaces the first
+				unlockMailbox(lockedMailbox)
+				lockedMailbox = ""
+				mailData = nil
+			}
+			sessionLog = clientLog.With("user", userName)
+			emailDir, err = mailutils.GetEmailDir(userName)
+			if nil == err {
+				emailDir, err = mailutils.GetFolderDir(emailDir, config.PopFolder)
+			}
 			if nil != err {
-				writeErrResponse(conn, "Could not download emails: %s", false, err)
+				writeMailboxError(conn, err, lang, sessionLog)
+				continue
+			}
+			if !lockMailbox(userName) {
+				writeCodedErrResponse(conn, RESP_IN_USE, lang.text("Mailbox in use by another session"), sessionLog)
 				continue
 			}
-			mailData = getMessageData(emailDir)
-			writeOKResponse(conn, "", true)
+			lockedMailbox = userName
+			err = backend.DownloadEmails(emailBucket, userName, config.ingestOptions(userName))
+			if nil == err {
+				mailData, err = mailutils.ListMailData(emailDir)
+			}
+			if nil != err {
+				writeMailboxError(conn, err, lang, sessionLog.With("bucket", emailBucket))
+				unlockMailbox(lockedMailbox)
+				lockedMailbox = ""
+				continue
+			}
+			count, size := getStat(mailData, nil)
+			metrics.SetCacheSize(userName, count, size)
+			writeOKResponse(conn, "", sessionLog)
 
 		} else if cmd == "PASS" && state == STATE_UNAUTHORIZED {
+			if lockedMailbox == "" {
+				writeErrResponse(conn, lang.text("USER first"), sessionLog)
+				continue
+			}
 			//Accept all passwords (local servoce only)
-			writeOKResponse(conn, "User signed in", true)
+			if !loginAllowed(lockedMailbox, time.Duration(config.LoginDelay)*time.Second, time.Now()) {
+				writeCodedErrResponse(conn, RESP_LOGIN_DELAY, lang.text("Logged in too recently"), sessionLog)
+				unlockMailbox(lockedMailbox)
+				lockedMailbox = ""
+				mailData = nil
+				continue
+			}
+			if mailboxFull(config, lockedMailbox) {
+				writeOKResponse(conn, lang.text("User signed in, mailbox full"), sessionLog)
+			} else {
+				writeOKResponse(conn, lang.text("User signed in"), sessionLog)
+			}
 			deletedItems = make(map[int]struct{})
 			state = STATE_TRANSACTION
 
 		} else if cmd == "STAT" && state == STATE_TRANSACTION {
 			count, size := getStat(mailData, deletedItems)
-			writeOKResponse(conn, strconv.Itoa(count)+" "+strconv.Itoa(size), true)
+			writeOKResponse(conn, "%d %d", sessionLog, count, size)
 
 		} else if cmd == "LIST" && state == STATE_TRANSACTION {
 			msgId, err := getSafeArg(args, 0)
 			if err == nil {
 				var id int
-				id, _ = strconv.Atoi(msgId)
-				id--
-				if len(mailData) <= id {
-					writeErrResponse(conn, "no such message", false)
+				var ok bool
+				if id, ok = messageIndex(msgId, mailData); !ok {
+					writeErrResponse(conn, lang.text("no such message"), sessionLog)
 					continue
 				} else {
 					if _, toDel := deletedItems[id]; toDel {
-						writeErrResponse(conn, "message deleted", false)
+						writeErrResponse(conn, lang.text("message deleted"), sessionLog)
 						continue
 					}
-					writeOKResponse(conn, "%d %d", false, id+1, mailData[id].TotalSize)
+					writeOKResponse(conn, "%d %d", sessionLog, id+1, mailData[id].TotalSize)
 				}
 			} else {
 				count, size := getStat(mailData, deletedItems)
-				writeOKResponse(conn, "%d messages (%d octets)", false, count, size)
+				writeOKResponse(conn, lang.text("%d messages (%d octets)"), sessionLog, count, size)
 
 				for itemId, mailItem := range mailData {
 					if _, toDel := deletedItems[itemId]; toDel {
@@ -174,7 +303,7 @@ func handleClient(conn net.Conn, config *ServerConfig) {
 					}
 					fmt.Fprintf(conn, "%d %d\r\n", itemId+1, mailItem.TotalSize)
 				}
-				fmt.Fprintf(conn, multilineTerminator)
+				io.WriteString(conn, multilineTerminator)
 			}
 
 		} else if cmd == "UIDL" && state == STATE_TRANSACTION {
@@ -183,20 +312,19 @@ func handleClient(conn net.Conn, config *ServerConfig) {
 			var id int
 
 			if err == nil {
-				id, _ = strconv.Atoi(msgId)
-				id--
-				if len(mailData) <= id {
-					writeErrResponse(conn, "no such message", false)
+				var ok bool
+				if id, ok = messageIndex(msgId, mailData); !ok {
+					writeErrResponse(conn, lang.text("no such message"), sessionLog)
 					continue
 				} else {
 					if _, toDel := deletedItems[id]; toDel {
-						writeErrResponse(conn, "message deleted", false)
+						writeErrResponse(conn, lang.text("message deleted"), sessionLog)
 						continue
 					}
-					writeOKResponse(conn, "%d %s", false, id+1, mailData[id].Name)
+					writeOKResponse(conn, "%d %s", sessionLog, id+1, mailData[id].Name)
 				}
 			} else {
-				writeOKResponse(conn, "", false)
+				writeOKResponse(conn, "", sessionLog)
 
 				for id, mailItem := range mailData {
 					if _, toDel := deletedItems[id]; toDel {
@@ -204,7 +332,7 @@ func handleClient(conn net.Conn, config *ServerConfig) {
 					}
 					fmt.Fprintf(conn, "%d %s\r\n", id+1, mailItem.Name)
 				}
-				fmt.Fprintf(conn, multilineTerminator)
+				io.WriteString(conn, multilineTerminator)
 			}
 
 		} else if cmd == "TOP" && state == STATE_TRANSACTION {
@@ -212,24 +340,23 @@ func handleClient(conn net.Conn, config *ServerConfig) {
 			var id int
 
 			if err == nil {
-				id, _ = strconv.Atoi(msgId)
-				id--
-				if len(mailData) <= id {
-					writeErrResponse(conn, "no such message", false)
+				var ok bool
+				if id, ok = messageIndex(msgId, mailData); !ok {
+					writeErrResponse(conn, lang.text("no such message"), sessionLog)
 					continue
 				}
 				if _, toDel := deletedItems[id]; toDel {
-					writeErrResponse(conn, "message deleted", false)
+					writeErrResponse(conn, lang.text("message deleted"), sessionLog)
 					continue
 				}
 			} else {
-				writeErrResponse(conn, "no message selected", false)
+				writeErrResponse(conn, lang.text("no message selected"), sessionLog)
 				continue
 			}
 			lineArg, err := getSafeArg(args, 1)
 			var lines int
 			if nil != err {
-				writeErrResponse(conn, "no line argument supplied", false)
+				writeErrResponse(conn, lang.text("no line argument supplied"), sessionLog)
 				continue
 			}
 			lines, _ = strconv.Atoi(lineArg)
@@ -237,107 +364,120 @@ func handleClient(conn net.Conn, config *ServerConfig) {
 			fullFilePath := filepath.Join(emailDir, mailData[id].Name)
 			fileData, err := os.Open(fullFilePath)
 			if err != nil {
-				writeErrResponse(conn, "failed to open email %s", false, mailData[id].Name)
+				sessionLog.Error("could not open email", "error", err)
+				writeCodedErrResponse(conn, RESP_SYS_TEMP, lang.text("failed to open email %s"), sessionLog, mailData[id].Name)
+				continue
 			}
-			defer fileData.Close()
-			writeOKResponse(conn, "%d octets", false, mailData[id].TotalSize)
+			writeOKResponse(conn, lang.text("%d octets"), sessionLog, mailData[id].TotalSize)
 			bodyLinesRead := 0
 			inBody := false
-			fileScanner := bufio.NewScanner(fileData)
-			for fileScanner.Scan() {
-				line := fileScanner.Text()
-				if line == "" && !inBody {
-					fmt.Fprintf(conn, line+eol)
-					inBody = true
-				} else if line == "." {
-					fmt.Fprintf(conn, eol+line+eol)
-				} else {
-					if inBody {
-						bodyLinesRead++
-						if bodyLinesRead > lines {
-							break
-						}
+			mailutils.ReadLines(fileData, func(line string) bool {
+				if inBody {
+					bodyLinesRead++
+					if bodyLinesRead > lines {
+						return false
 					}
-					fmt.Fprintf(conn, line+eol)
+				} else if line == "" {
+					inBody = true
 				}
-
-			}
-			fmt.Fprintf(conn, multilineTerminator)
+				writeMessageLine(conn, line, !inBody, downgrade)
+				return true
+			})
+			io.WriteString(conn, multilineTerminator)
 			fileData.Close()
 
 		} else if cmd == "RETR" && state == STATE_TRANSACTION {
 			msgId, err := getSafeArg(args, 0)
 			var id int
 			if err == nil {
-				id, _ = strconv.Atoi(msgId)
-				id--
-				if len(mailData) <= id {
-					writeErrResponse(conn, "no such message", false)
+				var ok bool
+				if id, ok = messageIndex(msgId, mailData); !ok {
+					writeErrResponse(conn, lang.text("no such message"), sessionLog)
 					continue
 				}
 				if _, toDel := deletedItems[id]; toDel {
-					writeErrResponse(conn, "message deleted", false)
+					writeErrResponse(conn, lang.text("message deleted"), sessionLog)
 					continue
 				}
 			} else {
-				writeErrResponse(conn, "no message selected", false)
+				writeErrResponse(conn, lang.text("no message selected"), sessionLog)
 				continue
 			}
 
 			fullFilePath := filepath.Join(emailDir, mailData[id].Name)
-			fileData, err := os.Open(fullFilePath)
+			size, err := retrSize(fullFilePath, mailData[id], downgrade)
+			var fileData *os.File
+			if nil == err {
+				fileData, err = os.Open(fullFilePath)
+			}
 			if err != nil {
-				writeErrResponse(conn, "failed to open email %s", false, mailData[id].Name)
+				sessionLog.Error("could not open email", "error", err)
+				writeCodedErrResponse(conn, RESP_SYS_TEMP, lang.text("failed to open email %s"), sessionLog, mailData[id].Name)
+				continue
 			}
-			defer fileData.Close()
-			writeOKResponse(conn, "%d octets", false, mailData[id].TotalSize)
-
-			fileScanner := bufio.NewScanner(fileData)
-			for fileScanner.Scan() {
-				line := fileScanner.Text()
-				if line == "." {
-					fmt.Fprintf(conn, eol+line+eol)
-				} else {
-					fmt.Fprintf(conn, line+eol)
+			writeOKResponse(conn, lang.text("%d octets"), sessionLog, size)
+
+			inBody := false
+			mailutils.ReadLines(fileData, func(line string) bool {
+				if line == "" {
+					inBody = true
 				}
+				writeMessageLine(conn, line, !inBody, downgrade)
+				return true
+			})
+			io.WriteString(conn, multilineTerminator)
+			fileData.Close()
 
+			//shared with IMAP, where it is shown as the \Seen flag
+			if !mailData[id].Read {
+				mailData[id].MarkRead(true)
+				err = mailData[id].Save(emailDir)
+				if nil != err {
+					sessionLog.Warn("could not mark email read", "email", mailData[id].Name, "error", err)
+				}
 			}
-			fmt.Fprintf(conn, multilineTerminator)
-			fileData.Close()
 
 		} else if cmd == "DELE" && state == STATE_TRANSACTION {
 			msgId, err := getSafeArg(args, 0)
 			var id int
 			if err == nil {
-				id, _ = strconv.Atoi(msgId)
-				id--
-				if len(mailData) <= id {
-					writeErrResponse(conn, "no such message", false)
+				var ok bool
+				if id, ok = messageIndex(msgId, mailData); !ok {
+					writeErrResponse(conn, lang.text("no such message"), sessionLog)
 					continue
 				}
 				if _, toDel := deletedItems[id]; toDel {
-					writeErrResponse(conn, "message already deleted", false)
+					writeErrResponse(conn, lang.text("message already deleted"), sessionLog)
 					continue
 				}
 			} else {
-				writeErrResponse(conn, "no message selected", false)
+				writeErrResponse(conn, lang.text("no message selected"), sessionLog)
 				continue
 			}
 			deletedItems[id] = struct{}{}
-			fmt.Fprintf(conn, "+OK"+eol)
+			writeOKResponse(conn, lang.text("message %d deleted"), sessionLog, id+1)
 		} else if cmd == "RSET" {
 			deletedItems = make(map[int]struct{})
-			writeOKResponse(conn, "", false)
+			writeOKResponse(conn, "", sessionLog)
 		} else if cmd == "NOOP" {
-			writeOKResponse(conn, "", false)
+			writeOKResponse(conn, "", sessionLog)
 		} else if cmd == "QUIT" {
 			if state == STATE_TRANSACTION {
 				state = STATE_UPDATE
-				deleteItems(emailDir, mailData, deletedItems)
+				removed, failed := deleteItems(emailDir, mailData, deletedItems)
+				sessionLog.Info("update", "deleted", removed, "failed", failed)
+				count, size := getStat(mailData, deletedItems)
+				metrics.SetCacheSize(lockedMailbox, count, size)
+				if failed > 0 {
+					sessionLog.Error("messages could not be deleted", "failed", failed)
+					writeCodedErrResponse(conn, RESP_SYS_TEMP, lang.text("%d messages not removed"), sessionLog, failed)
+					return
+				}
 			}
+			writeOKResponse(conn, lang.text("Goodbye"), sessionLog)
 			return
 		} else {
-			writeErrResponse(conn, "Unrecognised Command", true)
+			writeErrResponse(conn, lang.text("Unrecognised Command"), sessionLog)
 		}
 	}
 }
@@ -0,0 +1,334 @@
+package sieve
+
+/*
+    s3pop-server: An AWS S3 backed POP3 server
+	Copyright (C) 2018 James W Matheson
+	fractal.mango@gmail.com
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+//Checking parsed scripts and turning them into commands and tests that
+//can be run
+
+import (
+	"strings"
+)
+
+//capabilities are the extensions scripts may require
+var capabilities = map[string]bool{
+	"fileinto":   true,
+	"imap4flags": true,
+}
+
+//Script is a checked Sieve script ready to be run against messages
+type Script struct {
+	commands []command
+}
+
+//Parse reads and checks a script
+func Parse(src string) (*Script, error) {
+	p := &parser{lexer: &lexer{src: src, line: 1}}
+	err := p.advance()
+	if nil != err {
+		return nil, err
+	}
+	nodes, err := p.parseCommands()
+	if nil != err {
+		return nil, err
+	}
+	if p.current.kind != tokenEOF {
+		return nil, errorAt(p.current.line, "unexpected \"}\"")
+	}
+
+	c := &compiler{required: make(map[string]bool)}
+	commands, err := c.commands(nodes, true)
+	if nil != err {
+		return nil, err
+	}
+	return &Script{commands: commands}, nil
+}
+
+type compiler struct {
+	required map[string]bool
+}
+
+//commands checks a list of commands, top is set for the top level of the
+//script where require may be used before any other command
+func (c *compiler) commands(nodes []*node, top bool) ([]command, error) {
+	commands := make([]command, 0, len(nodes))
+	requireAllowed := top
+	for i := 0; i < len(nodes); i++ {
+		n := nodes[i]
+		if n.name == "require" {
+			if !requireAllowed {
+				return nil, errorAt(n.line, "require must come before other commands")
+			}
+			err := c.require(n)
+			if nil != err {
+				return nil, err
+			}
+			continue
+		}
+		requireAllowed = false
+
+		if n.name == "if" {
+			cmd := &ifCommand{}
+			for {
+				branch, err := c.branch(nodes[i])
+				if nil != err {
+					return nil, err
+				}
+				cmd.branches = append(cmd.branches, branch)
+				if i+1 >= len(nodes) || nodes[i].name == "else" ||
+					(nodes[i+1].name != "elsif" && nodes[i+1].name != "else") {
+					break
+				}
+				i++
+			}
+			commands = append(commands, cmd)
+			continue
+		}
+		if n.name == "elsif" || n.name == "else" {
+			return nil, errorAt(n.line, "%s without if", n.name)
+		}
+		if nil != n.block {
+			return nil, errorAt(n.line, "%s does not take a block", n.name)
+		}
+		if len(n.tests) > 0 {
+			return nil, errorAt(n.line, "%s does not take a test", n.name)
+		}
+		cmd, err := c.action(n)
+		if nil != err {
+			return nil, err
+		}
+		commands = append(commands, cmd)
+	}
+	return commands, nil
+}
+
+func (c *compiler) require(n *node) error {
+	if len(n.args) != 1 || !n.args[0].isString() || len(n.tests) > 0 || nil != n.block {
+		return errorAt(n.line, "require takes a string list")
+	}
+	for _, capability := range n.args[0].strings {
+		if !capabilities[capability] {
+			return errorAt(n.line, "unsupported extension %q", capability)
+		}
+		c.required[capability] = true
+	}
+	return nil
+}
+
+//branch checks an if, elsif or else and its block
+func (c *compiler) branch(n *node) (ifBranch, error) {
+	var branch ifBranch
+	if nil == n.block {
+		return branch, errorAt(n.line, "%s needs a block", n.name)
+	}
+	if len(n.args) > 0 {
+		return branch, errorAt(n.line, "%s only takes a test", n.name)
+	}
+	if n.name == "else" {
+		if len(n.tests) > 0 {
+			return branch, errorAt(n.line, "else does not take a test")
+		}
+	} else {
+		if len(n.tests) != 1 {
+			return branch, errorAt(n.line, "%s needs one test", n.name)
+		}
+		test, err := c.test(n.tests[0])
+		if nil != err {
+			return branch, err
+		}
+		branch.test = test
+	}
+	block, err := c.commands(n.block, false)
+	branch.block = block
+	return branch, err
+}
+
+//stringArg checks a command has a single string argument
+func stringArg(n *node) (string, error) {
+	if len(n.args) != 1 || !n.args[0].isString() || n.args[0].isList || len(n.args[0].strings) != 1 {
+		return "", errorAt(n.line, "%s takes a string", n.name)
+	}
+	return n.args[0].strings[0], nil
+}
+
+func (c *compiler) action(n *node) (command, error) {
+	switch n.name {
+	case "keep", "discard", "stop":
+		if len(n.args) > 0 {
+			return nil, errorAt(n.line, "%s does not take arguments", n.name)
+		}
+		if n.name == "stop" {
+			return stopCommand{}, nil
+		}
+		return &actionCommand{kind: n.name}, nil
+	case "fileinto":
+		if !c.required["fileinto"] {
+			return nil, errorAt(n.line, "fileinto needs require \"fileinto\"")
+		}
+		folder, err := stringArg(n)
+		if nil != err {
+			return nil, err
+		}
+		return &actionCommand{kind: ACTION_FILEINTO, target: folder}, nil
+	case "redirect":
+		address, err := stringArg(n)
+		if nil != err {
+			return nil, err
+		}
+		if !strings.Contains(address, "@") {
+			return nil, errorAt(n.line, "redirect needs an email address")
+		}
+		return &actionCommand{kind: ACTION_REDIRECT, target: address}, nil
+	case "addflag":
+		if !c.required["imap4flags"] {
+			return nil, errorAt(n.line, "addflag needs require \"imap4flags\"")
+		}
+		if len(n.args) != 1 || !n.args[0].isString() {
+			return nil, errorAt(n.line, "addflag takes a string list")
+		}
+		flags := make([]string, 0)
+		for _, value := range n.args[0].strings {
+			flags = append(flags, strings.Fields(value)...)
+		}
+		return &addflagCommand{flags: flags}, nil
+	}
+	return nil, errorAt(n.line, "unknown command %s", n.name)
+}
+
+//matchArgs collects the match type and comparator tags common to the
+//header and address tests, returning the arguments left over
+func matchArgs(n *node, extraTags map[string]bool) (matcher, string, []*argument, error) {
+	m := matcher{matchType: MATCH_IS, comparator: COMPARATOR_ASCII_CASEMAP}
+	var extra string
+	seenMatch := false
+	rest := make([]*argument, 0)
+	for i := 0; i < len(n.args); i++ {
+		arg := n.args[i]
+		switch {
+		case arg.tag == "is" || arg.tag == "contains" || arg.tag == "matches":
+			if seenMatch {
+				return m, "", nil, errorAt(arg.line, "more than one match type")
+			}
+			seenMatch = true
+			m.matchType = arg.tag
+		case arg.tag == "comparator":
+			if i+1 >= len(n.args) || !n.args[i+1].isString() || len(n.args[i+1].strings) != 1 {
+				return m, "", nil, errorAt(arg.line, ":comparator needs a string")
+			}
+			i++
+			m.comparator = n.args[i].strings[0]
+			if m.comparator != COMPARATOR_ASCII_CASEMAP && m.comparator != COMPARATOR_OCTET {
+				return m, "", nil, errorAt(arg.line, "unsupported comparator %q", m.comparator)
+			}
+		case extraTags[arg.tag]:
+			if extra != "" {
+				return m, "", nil, errorAt(arg.line, "more than one address part")
+			}
+			extra = arg.tag
+		case arg.tag != "":
+			return m, "", nil, errorAt(arg.line, "unknown tag :%s for %s", arg.tag, n.name)
+		default:
+			rest = append(rest, arg)
+		}
+	}
+	return m, extra, rest, nil
+}
+
+//stringLists checks the arguments left after the tags are count string
+//lists
+func stringLists(n *node, args []*argument, count int) ([][]string, error) {
+	if len(args) != count || len(n.tests) > 0 {
+		return nil, errorAt(n.line, "wrong number of arguments for %s", n.name)
+	}
+	lists := make([][]string, 0, count)
+	for _, arg := range args {
+		if !arg.isString() {
+			return nil, errorAt(arg.line, "%s takes string lists", n.name)
+		}
+		lists = append(lists, arg.strings)
+	}
+	return lists, nil
+}
+
+func (c *compiler) test(n *node) (test, error) {
+	switch n.name {
+	case "true", "false":
+		if len(n.args) > 0 || len(n.tests) > 0 {
+			return nil, errorAt(n.line, "%s does not take arguments", n.name)
+		}
+		return constTest(n.name == "true"), nil
+	case "not":
+		if len(n.args) > 0 || len(n.tests) != 1 {
+			return nil, errorAt(n.line, "not takes a single test")
+		}
+		inner, err := c.test(n.tests[0])
+		return &notTest{test: inner}, err
+	case "allof", "anyof":
+		if len(n.args) > 0 || len(n.tests) == 0 {
+			return nil, errorAt(n.line, "%s takes a list of tests", n.name)
+		}
+		t := &listTest{all: n.name == "allof"}
+		for _, inner := range n.tests {
+			compiled, err := c.test(inner)
+			if nil != err {
+				return nil, err
+			}
+			t.tests = append(t.tests, compiled)
+		}
+		return t, nil
+	case "exists":
+		lists, err := stringLists(n, n.args, 1)
+		if nil != err {
+			return nil, err
+		}
+		return &existsTest{names: lists[0]}, nil
+	case "header":
+		m, _, rest, err := matchArgs(n, nil)
+		if nil != err {
+			return nil, err
+		}
+		lists, err := stringLists(n, rest, 2)
+		if nil != err {
+			return nil, err
+		}
+		m.keys = lists[1]
+		return &headerTest{names: lists[0], match: m}, nil
+	case "address":
+		m, part, rest, err := matchArgs(n, map[string]bool{PART_ALL: true, PART_LOCALPART: true, PART_DOMAIN: true})
+		if nil != err {
+			return nil, err
+		}
+		lists, err := stringLists(n, rest, 2)
+		if nil != err {
+			return nil, err
+		}
+		if part == "" {
+			part = PART_ALL
+		}
+		m.keys = lists[1]
+		return &addressTest{part: part, names: lists[0], match: m}, nil
+	case "size":
+		if len(n.args) != 2 || len(n.tests) > 0 || !n.args[1].isNumber ||
+			(n.args[0].tag != "over" && n.args[0].tag != "under") {
+			return nil, errorAt(n.line, "size takes :over or :under and a number")
+		}
+		return &sizeTest{over: n.args[0].tag == "over", limit: n.args[1].number}, nil
+	}
+	return nil, errorAt(n.line, "unknown test %s", n.name)
+}
@@ -0,0 +1,379 @@
+package sieve
+
+/*
+    s3pop-server: An AWS S3 backed POP3 server
+	Copyright (C) 2018 James W Matheson
+	fractal.mango@gmail.com
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+//Running scripts against messages
+
+import (
+	"mime"
+	"net/mail"
+	"net/textproto"
+	"strings"
+)
+
+//Action types in the result of a script
+const (
+	ACTION_KEEP     = "keep"
+	ACTION_DISCARD  = "discard"
+	ACTION_FILEINTO = "fileinto"
+	ACTION_REDIRECT = "redirect"
+)
+
+//match types and comparators (RFC 5228 section 2.7)
+const (
+	MATCH_IS                 = "is"
+	MATCH_CONTAINS           = "contains"
+	MATCH_MATCHES            = "matches"
+	COMPARATOR_ASCII_CASEMAP = "i;ascii-casemap"
+	COMPARATOR_OCTET         = "i;octet"
+)
+
+//address parts (RFC 5228 section 2.7.4)
+const (
+	PART_ALL       = "all"
+	PART_LOCALPART = "localpart"
+	PART_DOMAIN    = "domain"
+)
+
+//Message is what scripts can test, Size is in octets
+type Message struct {
+	Header mail.Header
+	Size   int
+}
+
+//Action is something the script decided should happen to the message.
+//Target is the folder for fileinto and the address for redirect, Flags
+//are the flags set with addflag when a keep or fileinto was reached.
+type Action struct {
+	Type   string
+	Target string
+	Flags  []string
+}
+
+//evaluation is the state of one run of a script
+type evaluation struct {
+	message *Message
+	actions []Action
+	flags   []string
+	//implicitKeep is cleared by any action that delivers or discards the
+	//message (RFC 5228 section 2.10.2)
+	implicitKeep bool
+	stopped      bool
+}
+
+//Evaluate runs the script against a message and returns the actions to
+//take. An empty result means the message is discarded.
+func (s *Script) Evaluate(message *Message) []Action {
+	e := &evaluation{message: message, implicitKeep: true}
+	e.run(s.commands)
+	if e.implicitKeep {
+		e.deliver(Action{Type: ACTION_KEEP})
+	}
+	return e.actions
+}
+
+func (e *evaluation) run(commands []command) {
+	for _, cmd := range commands {
+		if e.stopped {
+			return
+		}
+		cmd.run(e)
+	}
+}
+
+//deliver adds a keep, fileinto or redirect unless the same one has been
+//added already, as repeating them has no further effect
+func (e *evaluation) deliver(action Action) {
+	for _, existing := range e.actions {
+		if existing.Type == action.Type && existing.Target == action.Target {
+			return
+		}
+	}
+	if action.Type != ACTION_REDIRECT {
+		action.Flags = append([]string{}, e.flags...)
+	}
+	e.actions = append(e.actions, action)
+}
+
+type command interface {
+	run(e *evaluation)
+}
+
+type ifBranch struct {
+	//test is nil for else
+	test  test
+	block []command
+}
+
+type ifCommand struct {
+	branches []ifBranch
+}
+
+func (c *ifCommand) run(e *evaluation) {
+	for _, branch := range c.branches {
+		if nil == branch.test || branch.test.eval(e.message) {
+			e.run(branch.block)
+			return
+		}
+	}
+}
+
+type stopCommand struct{}
+
+func (stopCommand) run(e *evaluation) {
+	e.stopped = true
+}
+
+type actionCommand struct {
+	kind   string
+	target string
+}
+
+func (c *actionCommand) run(e *evaluation) {
+	e.implicitKeep = false
+	if c.kind != ACTION_DISCARD {
+		e.deliver(Action{Type: c.kind, Target: c.target})
+	}
+}
+
+type addflagCommand struct {
+	flags []string
+}
+
+func (c *addflagCommand) run(e *evaluation) {
+	for _, flag := range c.flags {
+		known := false
+		for _, existing := range e.flags {
+			if strings.EqualFold(existing, flag) {
+				known = true
+				break
+			}
+		}
+		if !known {
+			e.flags = append(e.flags, flag)
+		}
+	}
+}
+
+type test interface {
+	eval(message *Message) bool
+}
+
+type constTest bool
+
+func (t constTest) eval(message *Message) bool {
+	return bool(t)
+}
+
+type notTest struct {
+	test test
+}
+
+func (t *notTest) eval(message *Message) bool {
+	return !t.test.eval(message)
+}
+
+//listTest is allof when all is set and anyof otherwise
+type listTest struct {
+	all   bool
+	tests []test
+}
+
+func (t *listTest) eval(message *Message) bool {
+	for _, inner := range t.tests {
+		if inner.eval(message) != t.all {
+			return !t.all
+		}
+	}
+	return t.all
+}
+
+type existsTest struct {
+	names []string
+}
+
+func (t *existsTest) eval(message *Message) bool {
+	for _, name := range t.names {
+		if len(message.Header[textproto.CanonicalMIMEHeaderKey(name)]) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+type sizeTest struct {
+	over  bool
+	limit int
+}
+
+func (t *sizeTest) eval(message *Message) bool {
+	if t.over {
+		return message.Size > t.limit
+	}
+	return message.Size < t.limit
+}
+
+var headerDecoder = new(mime.WordDecoder)
+
+//headerValues returns every value of the named headers with encoded-words
+//decoded
+func headerValues(message *Message, names []string) []string {
+	values := make([]string, 0)
+	for _, name := range names {
+		for _, value := range message.Header[textproto.CanonicalMIMEHeaderKey(name)] {
+			decoded, err := headerDecoder.DecodeHeader(value)
+			if nil != err {
+				decoded = value
+			}
+			values = append(values, decoded)
+		}
+	}
+	return values
+}
+
+type headerTest struct {
+	names []string
+	match matcher
+}
+
+func (t *headerTest) eval(message *Message) bool {
+	for _, value := range headerValues(message, t.names) {
+		if t.match.matches(value) {
+			return true
+		}
+	}
+	return false
+}
+
+type addressTest struct {
+	part  string
+	names []string
+	match matcher
+}
+
+func (t *addressTest) eval(message *Message) bool {
+	for _, value := range headerValues(message, t.names) {
+		addresses, err := mail.ParseAddressList(value)
+		if nil != err {
+			//compare what is there rather than ignore the header
+			addresses = []*mail.Address{{Address: strings.TrimSpace(value)}}
+		}
+		for _, address := range addresses {
+			if t.match.matches(addressPart(address.Address, t.part)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func addressPart(address string, part string) string {
+	at := strings.LastIndexByte(address, '@')
+	switch {
+	case part == PART_LOCALPART && at >= 0:
+		return address[:at]
+	case part == PART_DOMAIN:
+		return address[at+1:]
+	}
+	return address
+}
+
+type matcher struct {
+	matchType  string
+	comparator string
+	keys       []string
+}
+
+func (m *matcher) matches(value string) bool {
+	if m.comparator == COMPARATOR_ASCII_CASEMAP {
+		value = asciiLower(value)
+	}
+	for _, key := range m.keys {
+		if m.comparator == COMPARATOR_ASCII_CASEMAP {
+			key = asciiLower(key)
+		}
+		var matched bool
+		switch m.matchType {
+		case MATCH_IS:
+			matched = value == key
+		case MATCH_CONTAINS:
+			matched = strings.Contains(value, key)
+		case MATCH_MATCHES:
+			matched = wildcardMatch(key, value)
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+//asciiLower folds only ASCII letters as i;ascii-casemap does
+func asciiLower(text string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'A' && r <= 'Z' {
+			return r + 'a' - 'A'
+		}
+		return r
+	}, text)
+}
+
+//wildcardMatch matches value against a :matches key, where * is any text,
+//? is any one character and \ escapes the character after it
+func wildcardMatch(key string, value string) bool {
+	pattern := []rune(key)
+	text := []rune(value)
+	//star and resume record the last * for backtracking
+	star, resume := -1, 0
+	p, t := 0, 0
+	for t < len(text) {
+		if p < len(pattern) {
+			switch c := pattern[p]; {
+			case c == '*':
+				star, resume = p, t
+				p++
+				continue
+			case c == '?':
+				p++
+				t++
+				continue
+			case c == '\\' && p+1 < len(pattern):
+				if pattern[p+1] == text[t] {
+					p += 2
+					t++
+					continue
+				}
+			case c == text[t]:
+				p++
+				t++
+				continue
+			}
+		}
+		if star < 0 {
+			return false
+		}
+		resume++
+		p, t = star+1, resume
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
@@ -0,0 +1,407 @@
+package sieve
+
+/*
+    s3pop-server: An AWS S3 backed POP3 server
+	Copyright (C) 2018 James W Matheson
+	fractal.mango@gmail.com
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+//A subset of Sieve (RFC 5228) for filtering email as it is downloaded.
+//Scripts may use the header, address, exists, size, allof, anyof, not,
+//true and false tests with the keep, discard, stop, fileinto, redirect and
+//addflag (RFC 5232) actions.
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+//Error is a problem with a script, Line is where it was found
+type Error struct {
+	Line int
+	Msg  string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Msg)
+}
+
+func errorAt(line int, format string, args ...interface{}) error {
+	return &Error{Line: line, Msg: fmt.Sprintf(format, args...)}
+}
+
+//token types
+const (
+	tokenEOF = iota
+	tokenIdentifier
+	tokenTag
+	tokenNumber
+	tokenString
+	tokenSpecial
+)
+
+type token struct {
+	kind   int
+	text   string
+	number int
+	line   int
+}
+
+type lexer struct {
+	src  string
+	pos  int
+	line int
+}
+
+//skipSpace moves past white space and comments
+func (l *lexer) skipSpace() error {
+	for l.pos < len(l.src) {
+		switch c := l.src[l.pos]; {
+		case c == '\n':
+			l.line++
+			l.pos++
+		case c == ' ' || c == '\t' || c == '\r':
+			l.pos++
+		case c == '#':
+			end := strings.IndexByte(l.src[l.pos:], '\n')
+			if end < 0 {
+				l.pos = len(l.src)
+			} else {
+				l.pos += end
+			}
+		case strings.HasPrefix(l.src[l.pos:], "/*"):
+			end := strings.Index(l.src[l.pos+2:], "*/")
+			if end < 0 {
+				return errorAt(l.line, "unterminated comment")
+			}
+			l.line += strings.Count(l.src[l.pos:l.pos+2+end], "\n")
+			l.pos += end + 4
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+func isAlpha(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_'
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func (l *lexer) next() (token, error) {
+	err := l.skipSpace()
+	if nil != err {
+		return token{}, err
+	}
+	if l.pos >= len(l.src) {
+		return token{kind: tokenEOF, line: l.line}, nil
+	}
+	start := l.pos
+	c := l.src[l.pos]
+	switch {
+	case isAlpha(c):
+		for l.pos < len(l.src) && (isAlpha(l.src[l.pos]) || isDigit(l.src[l.pos])) {
+			l.pos++
+		}
+		word := l.src[start:l.pos]
+		if strings.EqualFold(word, "text") && l.pos < len(l.src) && l.src[l.pos] == ':' {
+			l.pos++
+			return l.multiline()
+		}
+		return token{kind: tokenIdentifier, text: strings.ToLower(word), line: l.line}, nil
+	case c == ':':
+		l.pos++
+		for l.pos < len(l.src) && (isAlpha(l.src[l.pos]) || isDigit(l.src[l.pos])) {
+			l.pos++
+		}
+		if l.pos == start+1 {
+			return token{}, errorAt(l.line, "tag without a name")
+		}
+		return token{kind: tokenTag, text: strings.ToLower(l.src[start+1 : l.pos]), line: l.line}, nil
+	case isDigit(c):
+		for l.pos < len(l.src) && isDigit(l.src[l.pos]) {
+			l.pos++
+		}
+		number, err := strconv.Atoi(l.src[start:l.pos])
+		if nil != err {
+			return token{}, errorAt(l.line, "number out of range")
+		}
+		if l.pos < len(l.src) {
+			//quantifiers (RFC 5228 section 2.4.1)
+			switch l.src[l.pos] {
+			case 'K', 'k':
+				number <<= 10
+				l.pos++
+			case 'M', 'm':
+				number <<= 20
+				l.pos++
+			case 'G', 'g':
+				number <<= 30
+				l.pos++
+			}
+		}
+		return token{kind: tokenNumber, number: number, line: l.line}, nil
+	case c == '"':
+		return l.quoted()
+	case strings.IndexByte(";,()[]{}", c) >= 0:
+		l.pos++
+		return token{kind: tokenSpecial, text: string(c), line: l.line}, nil
+	}
+	return token{}, errorAt(l.line, "unexpected character %q", c)
+}
+
+//quoted reads a quoted string, where a backslash escapes the character
+//after it
+func (l *lexer) quoted() (token, error) {
+	line := l.line
+	var text strings.Builder
+	for l.pos++; l.pos < len(l.src); l.pos++ {
+		c := l.src[l.pos]
+		switch c {
+		case '"':
+			l.pos++
+			return token{kind: tokenString, text: text.String(), line: line}, nil
+		case '\\':
+			l.pos++
+			if l.pos < len(l.src) {
+				c = l.src[l.pos]
+			}
+		}
+		if c == '\n' {
+			l.line++
+		}
+		text.WriteByte(c)
+	}
+	return token{}, errorAt(line, "unterminated string")
+}
+
+//multiline reads the lines after text: up to a line holding only a dot,
+//removing the dot stuffing of lines that start with one
+func (l *lexer) multiline() (token, error) {
+	line := l.line
+	end := strings.IndexByte(l.src[l.pos:], '\n')
+	if end < 0 {
+		return token{}, errorAt(line, "unterminated text: string")
+	}
+	if rest := strings.TrimSpace(l.src[l.pos : l.pos+end]); rest != "" && !strings.HasPrefix(rest, "#") {
+		return token{}, errorAt(line, "text: must be followed by a new line")
+	}
+	l.pos += end + 1
+	l.line++
+	lines := make([]string, 0)
+	for l.pos < len(l.src) {
+		end := strings.IndexByte(l.src[l.pos:], '\n')
+		if end < 0 {
+			end = len(l.src) - l.pos
+		}
+		text := strings.TrimSuffix(l.src[l.pos:l.pos+end], "\r")
+		l.pos += end + 1
+		l.line++
+		if text == "." {
+			return token{kind: tokenString, text: strings.Join(lines, "\r\n"), line: line}, nil
+		}
+		lines = append(lines, strings.TrimPrefix(text, "."))
+	}
+	return token{}, errorAt(line, "unterminated text: string")
+}
+
+//argument is a positional or tagged argument of a command or test
+type argument struct {
+	line    int
+	tag     string
+	number  int
+	strings []string
+	//isList is set for a string list in brackets, a single string can be
+	//used wherever a list is expected
+	isList   bool
+	isNumber bool
+}
+
+func (a *argument) isString() bool {
+	return a.tag == "" && !a.isNumber
+}
+
+//node is a command or test as parsed, before it is checked
+type node struct {
+	name  string
+	line  int
+	args  []*argument
+	tests []*node
+	//block is the body of a control command, nil for other commands
+	block []*node
+}
+
+type parser struct {
+	lexer   *lexer
+	current token
+}
+
+func (p *parser) advance() error {
+	var err error
+	p.current, err = p.lexer.next()
+	return err
+}
+
+func (p *parser) isSpecial(text string) bool {
+	return p.current.kind == tokenSpecial && p.current.text == text
+}
+
+func (p *parser) expect(text string) error {
+	if !p.isSpecial(text) {
+		return errorAt(p.current.line, "expected %q", text)
+	}
+	return p.advance()
+}
+
+//parseCommands reads commands up to the end of the script or a block
+func (p *parser) parseCommands() ([]*node, error) {
+	commands := make([]*node, 0)
+	for p.current.kind != tokenEOF && !p.isSpecial("}") {
+		if p.current.kind != tokenIdentifier {
+			return nil, errorAt(p.current.line, "expected a command")
+		}
+		command := &node{name: p.current.text, line: p.current.line}
+		err := p.advance()
+		if nil == err {
+			command.args, command.tests, err = p.parseArguments()
+		}
+		if nil != err {
+			return nil, err
+		}
+		if p.isSpecial("{") {
+			p.advance()
+			command.block, err = p.parseCommands()
+			if nil == err {
+				err = p.expect("}")
+			}
+		} else {
+			err = p.expect(";")
+		}
+		if nil != err {
+			return nil, err
+		}
+		commands = append(commands, command)
+	}
+	return commands, nil
+}
+
+//parseArguments reads the arguments of a command or test followed by its
+//test or list of tests
+func (p *parser) parseArguments() ([]*argument, []*node, error) {
+	args := make([]*argument, 0)
+	for {
+		arg := &argument{line: p.current.line}
+		switch {
+		case p.current.kind == tokenTag:
+			arg.tag = p.current.text
+		case p.current.kind == tokenNumber:
+			arg.number = p.current.number
+			arg.isNumber = true
+		case p.current.kind == tokenString:
+			arg.strings = []string{p.current.text}
+		case p.isSpecial("["):
+			list, err := p.parseStringList()
+			if nil != err {
+				return nil, nil, err
+			}
+			arg.strings = list
+			arg.isList = true
+			args = append(args, arg)
+			continue
+		default:
+			tests, err := p.parseTests()
+			return args, tests, err
+		}
+		args = append(args, arg)
+		err := p.advance()
+		if nil != err {
+			return nil, nil, err
+		}
+	}
+}
+
+func (p *parser) parseStringList() ([]string, error) {
+	list := make([]string, 0)
+	for {
+		err := p.advance()
+		if nil != err {
+			return nil, err
+		}
+		if p.current.kind != tokenString {
+			return nil, errorAt(p.current.line, "expected a string")
+		}
+		list = append(list, p.current.text)
+		err = p.advance()
+		if nil != err {
+			return nil, err
+		}
+		if p.isSpecial("]") {
+			return list, p.advance()
+		}
+		if !p.isSpecial(",") {
+			return nil, errorAt(p.current.line, "expected \",\" or \"]\"")
+		}
+	}
+}
+
+//parseTests reads a single test, a list of tests in brackets or nothing
+func (p *parser) parseTests() ([]*node, error) {
+	if p.current.kind == tokenIdentifier {
+		test, err := p.parseTest()
+		if nil != err {
+			return nil, err
+		}
+		return []*node{test}, nil
+	}
+	if !p.isSpecial("(") {
+		return nil, nil
+	}
+	tests := make([]*node, 0)
+	for {
+		err := p.advance()
+		if nil != err {
+			return nil, err
+		}
+		test, err := p.parseTest()
+		if nil != err {
+			return nil, err
+		}
+		tests = append(tests, test)
+		if p.isSpecial(")") {
+			return tests, p.advance()
+		}
+		if !p.isSpecial(",") {
+			return nil, errorAt(p.current.line, "expected \",\" or \")\"")
+		}
+	}
+}
+
+func (p *parser) parseTest() (*node, error) {
+	if p.current.kind != tokenIdentifier {
+		return nil, errorAt(p.current.line, "expected a test")
+	}
+	test := &node{name: p.current.text, line: p.current.line}
+	err := p.advance()
+	if nil != err {
+		return nil, err
+	}
+	test.args, test.tests, err = p.parseArguments()
+	return test, err
+}
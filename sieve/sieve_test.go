@@ -0,0 +1,192 @@
+package sieve
+
+/*
+    s3pop-server: An AWS S3 backed POP3 server
+	Copyright (C) 2018 James W Matheson
+	fractal.mango@gmail.com
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+
+import (
+	"errors"
+	"net/mail"
+	"strings"
+	"testing"
+)
+
+const testEmail = "From: \"Alice\" <Alice@Example.com>\r\n" +
+	"To: bob@example.com, carol@example.org\r\n" +
+	"Subject: =?UTF-8?Q?Gr=C3=BC=C3=9Fe?= from the weekly *news*\r\n" +
+	"List-Id: <news.example.com>\r\n" +
+	"\r\n" +
+	"Body\r\n"
+
+func testMessage(t *testing.T) *Message {
+	parsed, err := mail.ReadMessage(strings.NewReader(testEmail))
+	if nil != err {
+		t.Fatalf("reading test email: %v", err)
+	}
+	return &Message{Header: parsed.Header, Size: 5000}
+}
+
+//formatActions writes actions as type:target[flags] separated by
+//semicolons so results can be compared as text
+func formatActions(actions []Action) string {
+	items := make([]string, 0, len(actions))
+	for _, action := range actions {
+		item := action.Type
+		if action.Target != "" {
+			item += ":" + action.Target
+		}
+		if len(action.Flags) > 0 {
+			item += "[" + strings.Join(action.Flags, " ") + "]"
+		}
+		items = append(items, item)
+	}
+	return strings.Join(items, "; ")
+}
+
+func TestEvaluate(t *testing.T) {
+	tests := []struct {
+		name    string
+		script  string
+		actions string
+	}{
+		{"empty script keeps", "", "keep"},
+		{"discard", "discard;", ""},
+		{"explicit keep survives discard", "keep; discard;", "keep"},
+		{"fileinto cancels implicit keep", `require "fileinto"; fileinto "Work"; fileinto "Work";`, "fileinto:Work"},
+		{"redirect and keep", `redirect "x@example.net"; keep;`, "redirect:x@example.net; keep"},
+		{"case of identifiers", "IF TRUE { DISCARD; }", ""},
+		{"comments", "# keep\r\n/* discard;\r\n*/ discard;", ""},
+		{"multi-line string", "require \"fileinto\";\r\nfileinto text:\r\nWork\r\n.\r\n;", "fileinto:Work"},
+		{"encoded header", `if header :contains "subject" "GRüße" { discard; }`, ""},
+		{"header is", `if header :is "subject" "Grüße" { discard; }`, "keep"},
+		{"header matches", `if header :matches "Subject" "gr?*weekly*" { discard; }`, ""},
+		{"escaped wildcard", `if header :matches "subject" "*\\*news\\*" { discard; }`, ""},
+		{"escaped wildcard needs a star", `if header :matches "list-id" "*\\*news*" { discard; }`, "keep"},
+		{"any of several names and keys", `if header :contains ["x-spam", "list-id"] ["nothing", "news"] { discard; }`, ""},
+		{"address domain", `if address :domain "from" "example.com" { redirect "a@example.net"; }`, "redirect:a@example.net"},
+		{"address localpart octet", `if address :localpart :comparator "i;octet" :is "from" "alice" { discard; }`, "keep"},
+		{"address in a list", `if address :all :is "to" "CAROL@example.org" { discard; }`, ""},
+		{"size over", "if size :over 4K { discard; }", ""},
+		{"size under", "if size :under 5000 { discard; }", "keep"},
+		{"exists", `if exists ["List-Id", "to"] { discard; }`, ""},
+		{"exists needs all", `if exists ["List-Id", "X-Missing"] { discard; }`, "keep"},
+		{"allof", `if allof (true, header :contains "to" "bob") { discard; }`, ""},
+		{"allof fails", `if allof (true, false) { discard; }`, "keep"},
+		{"anyof", `if anyof (false, not false) { discard; }`, ""},
+		{"elsif", `require "fileinto"; if false { discard; } elsif true { fileinto "A"; } else { fileinto "B"; }`, "fileinto:A"},
+		{"else", `require "fileinto"; if false { discard; } elsif false { fileinto "A"; } else { fileinto "B"; }`, "fileinto:B"},
+		{"stop", "stop; discard;", "keep"},
+		{"stop in a block", "if true { stop; } discard;", "keep"},
+		{"flags", `require ["fileinto", "imap4flags"]; addflag ["\\Flagged", "$Work Later"]; fileinto "Work";`, `fileinto:Work[\Flagged $Work Later]`},
+		{"flags set before delivery only", `require "imap4flags"; keep; addflag "$Late";`, "keep"},
+		{"flags on implicit keep", `require "imap4flags"; addflag ["$a", "$A", "$b"];`, "keep[$a $b]"},
+		{"no flags on redirect", `require "imap4flags"; addflag "$a"; redirect "x@example.net";`, "redirect:x@example.net"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			script, err := Parse(test.script)
+			if nil != err {
+				t.Fatalf("Parse: %v", err)
+			}
+			actions := formatActions(script.Evaluate(testMessage(t)))
+			if actions != test.actions {
+				t.Errorf("actions = %q, want %q", actions, test.actions)
+			}
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		script string
+		line   int
+	}{
+		{"keep", 1},
+		{"keep }", 1},
+		{"bogus;", 1},
+		{"discard 1;", 1},
+		{"keep { discard; }", 1},
+		{`fileinto "Work";`, 1},
+		{`require "imap4flags"; addflag 1;`, 1},
+		{`redirect "nobody";`, 1},
+		{`redirect ["a@example.com", "b@example.com"];`, 1},
+		{"keep;\nrequire \"fileinto\";", 2},
+		{`require "vacation";`, 1},
+		{`if true { require "fileinto"; }`, 1},
+		{"if true keep;", 1},
+		{"if true { keep; }\nelse { keep; }\nelse { keep; }", 3},
+		{"\nelsif true { keep; }", 2},
+		{"if true { keep; } elsif { keep; }", 1},
+		{"if true { keep; } else true { keep; }", 1},
+		{"if bogus { keep; }", 1},
+		{"if not { keep; }", 1},
+		{"if anyof () { keep; }", 1},
+		{`if header :is :contains "a" "b" { keep; }`, 1},
+		{`if header :comparator "i;unicode-casemap" "a" "b" { keep; }`, 1},
+		{`if header :domain "a" "b" { keep; }`, 1},
+		{`if address :domain :localpart "a" "b" { keep; }`, 1},
+		{`if header "a" { keep; }`, 1},
+		{"if size 10 { keep; }", 1},
+		{"if size :over \"10\" { keep; }", 1},
+		{"/* unterminated", 1},
+		{"\n\n\"unterminated", 3},
+		{"require \"fileinto\";\nfileinto text:\nWork\n", 2},
+		{"keep;\n\n@", 3},
+		{"if header : \"a\" \"b\" { keep; }", 1},
+	}
+	for _, test := range tests {
+		_, err := Parse(test.script)
+		var scriptErr *Error
+		if !errors.As(err, &scriptErr) {
+			t.Errorf("Parse(%q) err = %v, want a script error", test.script, err)
+			continue
+		}
+		if scriptErr.Line != test.line {
+			t.Errorf("Parse(%q) error on line %d, want %d: %v", test.script, scriptErr.Line, test.line, err)
+		}
+	}
+}
+
+func TestWildcardMatch(t *testing.T) {
+	tests := []struct {
+		key   string
+		value string
+		match bool
+	}{
+		{"", "", true},
+		{"*", "", true},
+		{"*", "anything", true},
+		{"a*c", "abbbc", true},
+		{"a*c", "abbbd", false},
+		{"a?c", "abc", true},
+		{"a?c", "ac", false},
+		{"?", "ü", true},
+		{"*a*b", "xaxaxb", true},
+		{"*a*b", "xaxaxbx", false},
+		{`\*`, "*", true},
+		{`\*`, "x", false},
+		{`\?x`, "ax", false},
+		{`a\\b`, `a\b`, true},
+	}
+	for _, test := range tests {
+		if match := wildcardMatch(test.key, test.value); match != test.match {
+			t.Errorf("wildcardMatch(%q, %q) = %v, want %v", test.key, test.value, match, test.match)
+		}
+	}
+}
@@ -0,0 +1,676 @@
+package main
+
+/*
+    s3pop-server: An AWS S3 backed POP3 server
+	Copyright (C) 2018 James W Matheson
+	fractal.mango@gmail.com
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+//Message submission (RFC 6409) for clients of the POP3 and IMAP servers.
+//Mail is relayed through SES with the server's AWS credentials, so clients
+//log in with the same local credentials as POP3 and need no SES SMTP
+//credentials of their own.
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/mail"
+	"os"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/FractalJim/s3pop-server/backend"
+	"github.com/FractalJim/s3pop-server/mailutils"
+	"github.com/FractalJim/s3pop-server/metrics"
+)
+
+//RFC 5321 section 4.5.3.1 limits command lines to 512 octets and text
+//lines to 1000, text lines up to the message size are accepted
+const smtpMaxLineLength = 512
+
+//smtpMaxRecipients is the SES limit for one message
+const smtpMaxRecipients = 50
+
+//defaultSentFolder is where copies of sent messages are kept, as sent/
+//under the mailbox's prefix in S3
+const defaultSentFolder = "sent"
+
+type smtpSession struct {
+	conn     *bufferedConn
+	reader   *bufio.Reader
+	config   *ServerConfig
+	stopping <-chan struct{}
+	//starttls is the TLS config offered with STARTTLS, nil if it is not
+	//available or TLS has been started
+	starttls  *tls.Config
+	tls       bool
+	clientLog *slog.Logger
+	log       *slog.Logger
+	hostname  string
+
+	//helo is the name the client gave in HELO or EHLO, empty until then
+	helo     string
+	extended bool
+	user     string
+	//the transaction in progress, from is empty when there is none
+	from       string
+	recipients []string
+	quit       bool
+}
+
+//smtpCommands maps each verb to its handler, which is given the rest of
+//the command line
+var smtpCommands = map[string]func(s *smtpSession, arg string){
+	"EHLO":     (*smtpSession).ehloCommand,
+	"HELO":     (*smtpSession).heloCommand,
+	"STARTTLS": (*smtpSession).startTLS,
+	"AUTH":     (*smtpSession).auth,
+	"MAIL":     (*smtpSession).mail,
+	"RCPT":     (*smtpSession).rcpt,
+	"DATA":     (*smtpSession).data,
+	"RSET": func(s *smtpSession, arg string) {
+		s.reset()
+		s.reply(250, "2.0.0 OK")
+	},
+	"NOOP": func(s *smtpSession, arg string) {
+		s.reply(250, "2.0.0 OK")
+	},
+	"VRFY": func(s *smtpSession, arg string) {
+		s.reply(252, "2.5.0 Cannot VRFY user, but will accept message and attempt delivery")
+	},
+	"QUIT": func(s *smtpSession, arg string) {
+		s.reply(221, "2.0.0 Bye")
+		s.quit = true
+	},
+}
+
+//handleSMTPClient runs a submission session. stlsConfig is non nil if the
+//client may start TLS with STARTTLS.
+func handleSMTPClient(conn net.Conn, config *ServerConfig, stlsConfig *tls.Config, stopping <-chan struct{}) {
+	defer conn.Close()
+	clientLog := slog.With("session", newSessionID(), "remote", conn.RemoteAddr().String(), "protocol", "smtp")
+	started := time.Now()
+	commandCount := 0
+	clientLog.Info("session started", "local", conn.LocalAddr().String())
+	metrics.SessionsTotal.Inc()
+	metrics.SessionsActive.Inc()
+
+	hostname, err := os.Hostname()
+	if nil != err {
+		hostname = "localhost"
+	}
+	_, implicitTLS := conn.(*tls.Conn)
+	buffered := newBufferedConn(&timeoutConn{Conn: conn, writeTimeout: time.Duration(config.WriteTimeout) * time.Second})
+	defer buffered.Flush()
+	s := &smtpSession{
+		conn:      buffered,
+		reader:    bufio.NewReader(buffered),
+		config:    config,
+		stopping:  stopping,
+		starttls:  stlsConfig,
+		tls:       implicitTLS,
+		clientLog: clientLog,
+		log:       clientLog,
+		hostname:  hostname,
+	}
+	defer func() {
+		metrics.SessionsActive.Dec()
+		s.log.Info("session ended", "duration", time.Since(started).Round(time.Millisecond), "commands", commandCount)
+	}()
+	defer func() {
+		if r := recover(); r != nil {
+			metrics.SessionPanics.Inc()
+			s.log.Error("session panicked", "panic", r, "stack", string(debug.Stack()))
+			s.reply(421, "4.3.0 internal error")
+		}
+	}()
+	idleTimeout := time.Duration(config.IdleTimeout) * time.Second
+	//also bounds the TLS handshake on implicit TLS listeners
+	conn.SetReadDeadline(time.Now().Add(idleTimeout))
+
+	s.reply(220, s.hostname+" ESMTP S3 mail submission ready")
+	for !s.quit {
+		if s.reader.Buffered() == 0 {
+			err := s.conn.Flush()
+			if nil != err {
+				if !isClosed(stopping) {
+					s.log.Warn("write failed", "error", err)
+				}
+				return
+			}
+		}
+		s.conn.SetReadDeadline(time.Now().Add(idleTimeout))
+		if isClosed(stopping) {
+			s.reply(421, "4.3.2 Server shutting down")
+			return
+		}
+
+		line, err := readLine(s.reader, smtpMaxLineLength)
+		if err == errLineTooLong {
+			s.reply(500, "5.5.6 Line too long")
+			continue
+		}
+		if nil != err {
+			s.readFailed(err)
+			return
+		}
+
+		line = strings.TrimRight(line, "\r\n")
+		verb, arg := line, ""
+		if i := strings.IndexByte(line, ' '); i >= 0 {
+			verb, arg = line[:i], line[i+1:]
+		}
+		verb = strings.ToUpper(verb)
+		commandCount++
+		s.log.Info("command", "cmd", verb)
+		handler, ok := smtpCommands[verb]
+		if !ok {
+			s.reply(500, "5.5.2 Unknown command")
+			continue
+		}
+		handler(s, arg)
+	}
+}
+
+//readFailed ends the session after a read error, telling the client why
+//if it is still there
+func (s *smtpSession) readFailed(err error) {
+	switch {
+	case isClosed(s.stopping):
+		s.reply(421, "4.3.2 Server shutting down")
+	case isTimeout(err):
+		s.reply(421, "4.4.2 Idle timeout, closing connection")
+	case err != io.EOF:
+		s.log.Warn("read failed", "error", err)
+	}
+}
+
+//reply sends a single line response, text starting with the enhanced
+//status code (RFC 3463) where there is one
+func (s *smtpSession) reply(code int, text string) {
+	fmt.Fprintf(s.conn, "%d %s"+eol, code, text)
+	if code < 400 {
+		s.log.Debug("response", "code", code, "text", text)
+	} else {
+		s.log.Info("response", "code", code, "text", text)
+	}
+}
+
+//reset abandons the transaction in progress
+func (s *smtpSession) reset() {
+	s.from = ""
+	s.recipients = nil
+}
+
+func (s *smtpSession) extensions() []string {
+	extensions := []string{
+		"PIPELINING",
+		"8BITMIME",
+		"ENHANCEDSTATUSCODES",
+		"SIZE " + strconv.Itoa(s.config.MaxMessageSize),
+	}
+	if nil != s.starttls {
+		extensions = append(extensions, "STARTTLS")
+	}
+	return append(extensions, "AUTH PLAIN LOGIN")
+}
+
+func (s *smtpSession) ehloCommand(arg string) {
+	if arg == "" {
+		s.reply(501, "5.5.4 EHLO needs a domain or address")
+		return
+	}
+	s.reset()
+	s.helo = arg
+	s.extended = true
+	fmt.Fprintf(s.conn, "250-%s greets %s"+eol, s.hostname, arg)
+	extensions := s.extensions()
+	for i, extension := range extensions {
+		separator := "-"
+		if i == len(extensions)-1 {
+			separator = " "
+		}
+		fmt.Fprintf(s.conn, "250%s%s"+eol, separator, extension)
+	}
+}
+
+func (s *smtpSession) heloCommand(arg string) {
+	if arg == "" {
+		s.reply(501, "5.5.4 HELO needs a domain or address")
+		return
+	}
+	s.reset()
+	s.helo = arg
+	s.extended = false
+	s.reply(250, s.hostname)
+}
+
+func (s *smtpSession) startTLS(arg string) {
+	if nil == s.starttls {
+		s.reply(502, "5.5.1 TLS not available")
+		return
+	}
+	if s.reader.Buffered() > 0 {
+		//anything sent before the handshake could have been injected
+		s.reply(503, "5.5.1 Command received after STARTTLS")
+		return
+	}
+	s.reply(220, "2.0.0 Ready to start TLS")
+	s.conn.Flush()
+	tlsConn := tls.Server(s.conn.Conn, s.starttls)
+	err := tlsConn.Handshake()
+	if nil != err {
+		s.log.Warn("TLS handshake failed", "error", err)
+		s.quit = true
+		return
+	}
+	s.conn.upgrade(tlsConn)
+	s.reader = bufio.NewReader(s.conn)
+	s.starttls = nil
+	s.tls = true
+	//RFC 3207 section 4.2, the client starts again with EHLO
+	s.reset()
+	s.helo = ""
+	s.user = ""
+	s.log = s.clientLog
+}
+
+//readAuthResponse asks for the next part of an AUTH exchange, ok is false
+//if the client cancelled or sent something that is not base64
+func (s *smtpSession) readAuthResponse(challenge string) (string, bool, error) {
+	io.WriteString(s.conn, "334 "+base64.StdEncoding.EncodeToString([]byte(challenge))+eol)
+	s.conn.Flush()
+	line, err := readLine(s.reader, smtpMaxLineLength)
+	if nil != err {
+		return "", false, err
+	}
+	return decodeAuthResponse(strings.TrimRight(line, "\r\n"))
+}
+
+func decodeAuthResponse(response string) (string, bool, error) {
+	if response == "*" {
+		return "", false, nil
+	}
+	decoded, err := base64.StdEncoding.DecodeString(response)
+	if nil != err {
+		return "", false, nil
+	}
+	return string(decoded), true, nil
+}
+
+func (s *smtpSession) auth(arg string) {
+	if s.helo == "" || !s.extended {
+		s.reply(503, "5.5.1 Send EHLO first")
+		return
+	}
+	if s.user != "" {
+		s.reply(503, "5.5.1 Already authenticated")
+		return
+	}
+	if s.from != "" {
+		s.reply(503, "5.5.1 Not allowed during a mail transaction")
+		return
+	}
+	fields := strings.Fields(arg)
+	if len(fields) == 0 || len(fields) > 2 {
+		s.reply(501, "5.5.4 Syntax: AUTH mechanism [initial-response]")
+		return
+	}
+
+	var user string
+	var ok bool
+	var err error
+	switch strings.ToUpper(fields[0]) {
+	case "PLAIN":
+		var response string
+		if len(fields) == 2 {
+			//= is an empty initial response (RFC 4954 section 4)
+			if fields[1] == "=" {
+				response, ok = "", true
+			} else {
+				response, ok, err = decodeAuthResponse(fields[1])
+			}
+		} else {
+			response, ok, err = s.readAuthResponse("")
+		}
+		if ok {
+			//authzid NUL authcid NUL password (RFC 4616)
+			parts := strings.Split(response, "\x00")
+			ok = len(parts) == 3 && (parts[0] == "" || parts[0] == parts[1])
+			if ok {
+				user = parts[1]
+			}
+		}
+	case "LOGIN":
+		if len(fields) == 2 {
+			user, ok, err = decodeAuthResponse(fields[1])
+		} else {
+			user, ok, err = s.readAuthResponse("Username:")
+		}
+		if ok && nil == err {
+			//Accept all passwords (local service only), as POP3 PASS does
+			_, ok, err = s.readAuthResponse("Password:")
+		}
+	default:
+		s.reply(504, "5.5.4 Unrecognized authentication type")
+		return
+	}
+	if nil != err {
+		s.readFailed(err)
+		s.quit = true
+		return
+	}
+	if !ok {
+		metrics.AuthFailures.Inc()
+		s.reply(501, "5.5.2 Authentication cancelled or malformed")
+		return
+	}
+	if !utf8.ValidString(user) || !mailutils.ValidName(user) {
+		metrics.AuthFailures.Inc()
+		s.reply(535, "5.7.8 Invalid user name")
+		return
+	}
+	s.user = user
+	s.log = s.clientLog.With("user", user)
+	s.reply(235, "2.7.0 Authentication successful")
+}
+
+//parsePath reads the <address> after MAIL FROM: or RCPT TO: and returns
+//it with the ESMTP parameters that follow
+func parsePath(arg string, prefix string) (string, []string, bool) {
+	if len(arg) < len(prefix) || !strings.EqualFold(arg[:len(prefix)], prefix) {
+		return "", nil, false
+	}
+	arg = strings.TrimLeft(arg[len(prefix):], " ")
+	if !strings.HasPrefix(arg, "<") {
+		return "", nil, false
+	}
+	end := strings.IndexByte(arg, '>')
+	if end < 0 {
+		return "", nil, false
+	}
+	address := arg[1:end]
+	//source routes are obsolete and ignored (RFC 5321 section 4.1.1.3)
+	if i := strings.IndexByte(address, ':'); strings.HasPrefix(address, "@") && i >= 0 {
+		address = address[i+1:]
+	}
+	return address, strings.Fields(arg[end+1:]), true
+}
+
+//addressDomain returns the domain of address, empty if it does not have
+//one
+func addressDomain(address string) string {
+	at := strings.LastIndexByte(address, '@')
+	if at <= 0 || at == len(address)-1 {
+		return ""
+	}
+	return address[at+1:]
+}
+
+func (s *smtpSession) mail(arg string) {
+	if s.helo == "" {
+		s.reply(503, "5.5.1 Send EHLO first")
+		return
+	}
+	if s.user == "" {
+		s.reply(530, "5.7.0 Authentication required")
+		return
+	}
+	if s.from != "" {
+		s.reply(503, "5.5.1 Mail transaction already in progress")
+		return
+	}
+	from, params, ok := parsePath(arg, "FROM:")
+	if !ok {
+		s.reply(501, "5.5.4 Syntax: MAIL FROM:<address>")
+		return
+	}
+	for _, param := range params {
+		name, value, _ := strings.Cut(param, "=")
+		switch strings.ToUpper(name) {
+		case "SIZE":
+			size, err := strconv.Atoi(value)
+			if nil != err {
+				s.reply(501, "5.5.4 SIZE is not a number")
+				return
+			}
+			if size > s.config.MaxMessageSize {
+				s.reply(552, "5.3.4 Message too big")
+				return
+			}
+		case "BODY":
+			if !strings.EqualFold(value, "7BIT") && !strings.EqualFold(value, "8BITMIME") {
+				s.reply(501, "5.5.4 BODY must be 7BIT or 8BITMIME")
+				return
+			}
+		case "AUTH":
+			//the session's own login is what counts
+		default:
+			s.reply(555, "5.5.4 Unsupported parameter "+name)
+			return
+		}
+	}
+
+	if !s.senderAllowed(from) {
+		return
+	}
+	s.from = from
+	s.log.Info("sender accepted", "from", from)
+	s.reply(250, "2.1.0 OK")
+}
+
+//senderAllowed checks the logged in mailbox may send as from, which must
+//be its own name or an alias in one of its sender domains, and that SES
+//will send from that domain, replying to the client if it is not
+func (s *smtpSession) senderAllowed(from string) bool {
+	domain := addressDomain(from)
+	if domain == "" {
+		s.reply(553, "5.1.7 Sender address must have a domain")
+		return false
+	}
+	if !s.config.senderAllowed(s.user, from) {
+		s.reply(553, "5.7.1 Sender address not allowed for this mailbox")
+		return false
+	}
+	verified, err := backend.DomainVerified(domain)
+	if nil != err {
+		s.log.Error("could not check sender domain", "domain", domain, "error", err)
+		if backend.IsPermanent(err) {
+			s.reply(554, "5.3.5 Sending is not configured correctly")
+		} else {
+			s.reply(451, "4.4.3 Could not check the sender domain, try again later")
+		}
+		return false
+	}
+	if !verified {
+		s.reply(553, "5.7.1 Sender domain is not verified with SES")
+		return false
+	}
+	return true
+}
+
+func (s *smtpSession) rcpt(arg string) {
+	if s.from == "" {
+		s.reply(503, "5.5.1 Send MAIL first")
+		return
+	}
+	to, params, ok := parsePath(arg, "TO:")
+	if !ok {
+		s.reply(501, "5.5.4 Syntax: RCPT TO:<address>")
+		return
+	}
+	if len(params) > 0 {
+		s.reply(555, "5.5.4 Unsupported parameter")
+		return
+	}
+	if addressDomain(to) == "" {
+		s.reply(553, "5.1.3 Recipient address must have a domain")
+		return
+	}
+	if len(s.recipients) >= smtpMaxRecipients {
+		s.reply(452, "4.5.3 Too many recipients")
+		return
+	}
+	s.recipients = append(s.recipients, to)
+	s.reply(250, "2.1.5 OK")
+}
+
+func (s *smtpSession) data(arg string) {
+	if s.from == "" {
+		s.reply(503, "5.5.1 Send MAIL first")
+		return
+	}
+	if len(s.recipients) == 0 {
+		s.reply(554, "5.5.1 No valid recipients")
+		return
+	}
+	s.reply(354, "End data with <CR><LF>.<CR><LF>")
+	s.conn.Flush()
+
+	message, tooBig, err := s.readMessage()
+	if nil != err {
+		s.readFailed(err)
+		s.quit = true
+		return
+	}
+	defer s.reset()
+	if tooBig {
+		metrics.MessagesSubmitted.WithLabelValues("rejected").Inc()
+		s.reply(552, "5.3.4 Message too big")
+		return
+	}
+	if !s.fromHeaderAllowed(message) {
+		metrics.MessagesSubmitted.WithLabelValues("rejected").Inc()
+		return
+	}
+
+	messageID, err := backend.SendRawEmail(s.from, s.recipients, message)
+	if nil != err {
+		s.log.Error("could not send email", "from", s.from, "recipients", len(s.recipients), "error", err)
+		metrics.MessagesSubmitted.WithLabelValues("failed").Inc()
+		if backend.IsPermanent(err) {
+			s.reply(554, "5.3.0 Message rejected by SES")
+		} else {
+			s.reply(451, "4.3.0 Could not send the message, try again later")
+		}
+		return
+	}
+	s.log.Info("email sent", "from", s.from, "recipients", len(s.recipients), "octets", len(message), "id", messageID)
+	metrics.MessagesSubmitted.WithLabelValues("sent").Inc()
+	s.saveSent(messageID, message)
+	s.reply(250, "2.0.0 OK queued as "+messageID)
+}
+
+//fromHeaderAllowed applies the sender checks to the From header, which is
+//the address recipients see, replying to the client if it fails them
+func (s *smtpSession) fromHeaderAllowed(message []byte) bool {
+	parsed, err := mail.ReadMessage(bytes.NewReader(message))
+	var addresses []*mail.Address
+	if nil == err && len(parsed.Header["From"]) == 1 {
+		addresses, err = parsed.Header.AddressList("From")
+	}
+	if nil != err || len(addresses) == 0 {
+		s.reply(550, "5.6.0 Message must have one From header with valid addresses")
+		return false
+	}
+	for _, address := range addresses {
+		if !s.senderAllowed(address.Address) {
+			s.log.Info("from header not allowed", "from", address.Address)
+			return false
+		}
+	}
+	return true
+}
+
+//saveSent stores a copy of a sent message in the mailbox's sent folder.
+//The message has gone by then, so a failure is only logged. No copy is
+//kept while the mailbox is full, as it is read-only.
+func (s *smtpSession) saveSent(messageID string, message []byte) {
+	if s.config.SentFolder == "" {
+		return
+	}
+	if mailboxFull(s.config, s.user) {
+		s.log.Warn("mailbox full, sent email not saved", "id", messageID, "folder", s.config.SentFolder)
+		return
+	}
+	name := messageID
+	if !mailutils.ValidName(name) {
+		//SES ids are always usable as names, this only keeps the key
+		//inside the folder if that ever changes
+		name = newSessionID()
+	}
+	err := backend.StoreEmail(s.config.S3Bucket, s.user, s.config.SentFolder, name, message)
+	if nil != err {
+		s.log.Error("could not save sent email", "id", messageID, "folder", s.config.SentFolder, "error", err)
+	}
+}
+
+//readMessage reads message text up to the terminating dot, removing dot
+//stuffing and adding a Received header. A message over the size limit is
+//read to the end and discarded.
+func (s *smtpSession) readMessage() ([]byte, bool, error) {
+	protocol := "SMTP"
+	if s.extended {
+		protocol = "ESMTP"
+		if s.tls {
+			protocol += "S"
+		}
+		protocol += "A"
+	}
+	var message strings.Builder
+	fmt.Fprintf(&message, "Received: from %s (%s)"+eol+"\tby %s with %s;"+eol+"\t%s"+eol,
+		s.helo, remoteHost(s.conn), s.hostname, protocol, time.Now().Format(time.RFC1123Z))
+
+	tooBig := false
+	for {
+		s.conn.SetReadDeadline(time.Now().Add(time.Duration(s.config.IdleTimeout) * time.Second))
+		line, err := readLine(s.reader, s.config.MaxMessageSize)
+		if err == errLineTooLong {
+			tooBig = true
+			continue
+		}
+		if nil != err {
+			return nil, false, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "." {
+			break
+		}
+		if tooBig {
+			continue
+		}
+		line = strings.TrimPrefix(line, ".")
+		if message.Len()+len(line)+len(eol) > s.config.MaxMessageSize {
+			tooBig = true
+			message.Reset()
+			continue
+		}
+		message.WriteString(line + eol)
+	}
+	if tooBig {
+		return nil, true, nil
+	}
+	return []byte(message.String()), false, nil
+}
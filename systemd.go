@@ -0,0 +1,350 @@
+package main
+
+/*
+    s3pop-server: An AWS S3 backed POP3 server
+	Copyright (C) 2018 James W Matheson
+	fractal.mango@gmail.com
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+//systemd integration, see sd_listen_fds(3), sd_notify(3) and
+//systemd.service(5). Everything here is a no-op when not run by systemd.
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+//first file descriptor passed by socket activation
+const sdListenFdsStart = 3
+
+const serviceName = "s3pop-server"
+
+//systemdListeners returns the listening sockets passed to the process by
+//systemd socket activation, or nil if the process was not socket activated
+func systemdListeners() ([]net.Listener, error) {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if nil != err || pid != os.Getpid() {
+		return nil, nil
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if nil != err || count <= 0 {
+		return nil, nil
+	}
+
+	listeners := make([]net.Listener, 0, count)
+	for fd := sdListenFdsStart; fd < sdListenFdsStart+count; fd++ {
+		file := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+		listener, err := net.FileListener(file)
+		//FileListener dups the descriptor so the original can be closed
+		file.Close()
+		if nil != err {
+			for _, opened := range listeners {
+				opened.Close()
+			}
+			return nil, fmt.Errorf("socket activation fd %d: %s", fd, err.Error())
+		}
+		listeners = append(listeners, listener)
+	}
+	return listeners, nil
+}
+
+//sdNotify sends a state change to the service manager. Errors are ignored,
+//notification is best effort and absent when not run under systemd.
+func sdNotify(state string) {
+	socketPath := os.Getenv("NOTIFY_SOCKET")
+	if socketPath == "" {
+		return
+	}
+	if strings.HasPrefix(socketPath, "@") {
+		//abstract namespace socket
+		socketPath = "\x00" + socketPath[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socketPath, Net: "unixgram"})
+	if nil != err {
+		return
+	}
+	defer conn.Close()
+	conn.Write([]byte(state))
+}
+
+//watchdogInterval returns how often the service manager expects a
+//WATCHDOG=1 ping, or zero if the watchdog is not enabled for this process
+func watchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if nil != err || usec <= 0 {
+		return 0
+	}
+	if pidEnv := os.Getenv("WATCHDOG_PID"); pidEnv != "" {
+		pid, err := strconv.Atoi(pidEnv)
+		if nil != err || pid != os.Getpid() {
+			return 0
+		}
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+//startWatchdog pings the service manager at half the watchdog interval
+//until the returned function is called. Pings are skipped while healthy
+//returns false so systemd restarts a server that has stopped accepting
+//connections.
+func startWatchdog(healthy func() bool) (stop func()) {
+	interval := watchdogInterval()
+	if interval == 0 {
+		return func() {}
+	}
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if healthy() {
+					sdNotify("WATCHDOG=1")
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+type unitParams struct {
+	Name       string
+	User       string
+	Group      string
+	Binary     string
+	WorkingDir string
+	ConfigPath string
+	EmailDir   string
+	AwsDir     string
+	Uid        int
+	Gid        int
+	//ListenAddrs has the address of each configured listener
+	ListenAddrs []string
+	Socket      bool
+	//StopTimeout is how long systemd waits for the server to drain before
+	//killing it, in seconds
+	StopTimeout int
+}
+
+//stopTimeoutMargin is the time, in seconds, systemd allows on top of the
+//shutdown timeout for the server to close sessions and exit
+const stopTimeoutMargin = 15
+
+var serviceTemplate = template.Must(template.New("service").Parse(`[Unit]
+Description=S3 POP3 server
+Documentation=https://github.com/FractalJim/s3pop-server
+After=network-online.target
+Wants=network-online.target
+{{- if .Socket}}
+Requires={{.Name}}.socket
+{{- end}}
+
+[Service]
+Type=notify
+ExecStart={{.Binary}}{{if .ConfigPath}} --config {{.ConfigPath}}{{end}} serve
+ExecReload=/bin/kill -HUP $MAINPID
+WorkingDirectory={{.WorkingDir}}
+User={{.User}}
+Group={{.Group}}
+Restart=on-failure
+WatchdogSec=60
+TimeoutStopSec={{.StopTimeout}}
+
+# Hardening
+NoNewPrivileges=yes
+CapabilityBoundingSet=
+AmbientCapabilities=
+ProtectSystem=strict
+ProtectHome=read-only
+ReadWritePaths={{.EmailDir}}
+ReadOnlyPaths=-{{.AwsDir}}
+PrivateTmp=yes
+PrivateDevices=yes
+ProtectKernelTunables=yes
+ProtectKernelModules=yes
+ProtectKernelLogs=yes
+ProtectControlGroups=yes
+ProtectClock=yes
+ProtectHostname=yes
+RestrictAddressFamilies=AF_INET AF_INET6 AF_UNIX
+RestrictNamespaces=yes
+RestrictRealtime=yes
+RestrictSUIDSGID=yes
+LockPersonality=yes
+MemoryDenyWriteExecute=yes
+SystemCallArchitectures=native
+SystemCallFilter=@system-service
+UMask=0077
+
+[Install]
+WantedBy=multi-user.target
+`))
+
+var socketTemplate = template.Must(template.New("socket").Parse(`[Unit]
+Description=S3 POP3 server socket
+
+[Socket]
+{{- range .ListenAddrs}}
+ListenStream={{.}}
+{{- end}}
+NoDelay=true
+
+[Install]
+WantedBy=sockets.target
+`))
+
+//installService implements the install-service subcommand, writing unit
+//files that run the server as the given user from the current directory
+func installService(args []string) int {
+	flags := newFlagSet("install-service")
+	userName := flags.String("user", "", "user to run the service as (default current user)")
+	unitDir := flags.String("dir", "/etc/systemd/system", "directory to write unit files to, - for stdout")
+	socket := flags.Bool("socket", false, "also write a .socket unit for socket activation")
+	if !parseArgs(flags, args, 0, 0) {
+		return EXIT_USAGE
+	}
+
+	params, err := newUnitParams(*userName, *socket)
+	if nil != err {
+		fmt.Fprintf(os.Stderr, "Error.. %s\n", err.Error())
+		return EXIT_STARTUP
+	}
+
+	units := map[string]*template.Template{serviceName + ".service": serviceTemplate}
+	if params.Socket {
+		units[serviceName+".socket"] = socketTemplate
+	}
+	for _, unitName := range []string{serviceName + ".service", serviceName + ".socket"} {
+		unitTemplate, ok := units[unitName]
+		if !ok {
+			continue
+		}
+		err = writeUnit(*unitDir, unitName, unitTemplate, params)
+		if nil != err {
+			fmt.Fprintf(os.Stderr, "Error.. %s\n", err.Error())
+			return EXIT_STARTUP
+		}
+	}
+	if *unitDir != "-" {
+		//ProtectHome makes the home directory read only so the mail cache
+		//has to exist before the service first starts
+		err = ensureEmailDir(params)
+		if nil != err {
+			fmt.Fprintf(os.Stderr, "Error.. %s\n", err.Error())
+			return EXIT_STARTUP
+		}
+		enable := serviceName + ".service"
+		if params.Socket {
+			enable = serviceName + ".socket"
+		}
+		fmt.Printf("Now run: systemctl daemon-reload && systemctl enable --now %s\n", enable)
+	}
+	return EXIT_OK
+}
+
+func newUnitParams(userName string, socket bool) (*unitParams, error) {
+	var userInfo *user.User
+	var err error
+	if userName == "" {
+		userInfo, err = user.Current()
+	} else {
+		userInfo, err = user.Lookup(userName)
+	}
+	if nil != err {
+		return nil, err
+	}
+	group, err := user.LookupGroupId(userInfo.Gid)
+	if nil != err {
+		return nil, err
+	}
+	binary, err := os.Executable()
+	if nil != err {
+		return nil, err
+	}
+	workingDir, err := os.Getwd()
+	if nil != err {
+		return nil, err
+	}
+	config, err := readConfig()
+	if nil != err {
+		return nil, err
+	}
+	listenAddrs := make([]string, 0, len(config.Listeners))
+	for _, listenerConfig := range config.Listeners {
+		listenAddrs = append(listenAddrs, listenerConfig.addr())
+	}
+	uid, _ := strconv.Atoi(userInfo.Uid)
+	gid, _ := strconv.Atoi(userInfo.Gid)
+	return &unitParams{
+		Name:        serviceName,
+		User:        userInfo.Username,
+		Group:       group.Name,
+		Binary:      binary,
+		WorkingDir:  workingDir,
+		ConfigPath:  config.path,
+		EmailDir:    filepath.Join(userInfo.HomeDir, ".email"),
+		AwsDir:      filepath.Join(userInfo.HomeDir, ".aws"),
+		Uid:         uid,
+		Gid:         gid,
+		ListenAddrs: listenAddrs,
+		Socket:      socket,
+		StopTimeout: config.ShutdownTimeout + stopTimeoutMargin,
+	}, nil
+}
+
+func writeUnit(unitDir, unitName string, unitTemplate *template.Template, params *unitParams) error {
+	if unitDir == "-" {
+		fmt.Printf("# %s\n", unitName)
+		return unitTemplate.Execute(os.Stdout, params)
+	}
+	unitFile, err := os.Create(filepath.Join(unitDir, unitName))
+	if nil != err {
+		return err
+	}
+	defer unitFile.Close()
+	err = unitTemplate.Execute(unitFile, params)
+	if nil != err {
+		return err
+	}
+	fmt.Println("Wrote " + unitFile.Name())
+	return unitFile.Close()
+}
+
+func ensureEmailDir(params *unitParams) error {
+	_, err := os.Stat(params.EmailDir)
+	if nil == err {
+		return nil
+	}
+	err = os.Mkdir(params.EmailDir, 0700)
+	if nil != err {
+		return err
+	}
+	return os.Chown(params.EmailDir, params.Uid, params.Gid)
+}